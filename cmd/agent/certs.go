@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"otun-node-agent/internal/config"
+)
+
+// checkCertificate 检查 TLS 证书：进入续期窗口时向 TLS 服务续期，
+// 证书失效时停用 TLS 协议，重新获得有效证书后恢复（定时调用）
+func (a *Agent) checkCertificate(ctx context.Context) error {
+	if !a.generator.WantsTLS() {
+		return nil
+	}
+
+	a.certMu.Lock()
+	defer a.certMu.Unlock()
+
+	certMgr := config.NewCertManager(a.dataDir)
+	info, err := certMgr.Info()
+
+	renewed := false
+	if err != nil || time.Until(info.NotAfter) < a.cfg.CertRenewBefore {
+		var renewErr error
+		renewed, renewErr = a.renewCertificate(ctx, certMgr, info)
+		a.setCertRenewalError(renewErr)
+		if renewErr != nil {
+			log.Printf("[Cert] Renewal failed, will retry: %v", renewErr)
+		}
+	}
+
+	err = a.applyCertState(certMgr, renewed)
+	if err != nil && renewed {
+		// 续期的证书无法应用：恢复之前的证书，下次检查时重新续期
+		log.Printf("[Cert] Failed to apply renewed certificate, restoring previous one: %v", err)
+		if rbErr := certMgr.Rollback(); rbErr != nil {
+			log.Printf("[Cert] Failed to restore previous certificate: %v", rbErr)
+		} else if err := a.applyCertState(certMgr, true); err != nil {
+			log.Printf("[Cert] Failed to apply previous certificate: %v", err)
+		}
+		err = fmt.Errorf("apply renewed certificate: %w", err)
+		a.setCertRenewalError(err)
+	}
+	return err
+}
+
+// renewCertificate 通过 TLS 服务续期，没有 TLS 服务时只能等待管理端下发新证书
+func (a *Agent) renewCertificate(ctx context.Context, certMgr *config.CertManager, current *config.CertInfo) (bool, error) {
+	if a.multiProto == nil || a.multiProto.TLSClient == nil {
+		if current != nil {
+			log.Printf("[Cert] Certificate expires at %s, no TLS service configured, waiting for a certificate update from manager",
+				current.NotAfter.Format(time.RFC3339))
+		}
+		return false, nil
+	}
+
+	domain := a.multiProto.NodeConfig.VpnDomain
+	log.Printf("[Cert] Renewing certificate for %s...", domain)
+	renewed, err := certMgr.Renew(ctx, a.multiProto.TLSClient, domain)
+	if err != nil {
+		return false, err
+	}
+	if !renewed {
+		log.Println("[Cert] TLS service has not issued a newer certificate yet")
+		return false, nil
+	}
+
+	if info, err := certMgr.Info(); err == nil {
+		log.Printf("[Cert] Certificate renewed, expires at %s", info.NotAfter.Format(time.RFC3339))
+	}
+	return true, nil
+}
+
+// applyCertState 根据当前证书启用或停用 TLS 协议
+// 证书内容变化但 TLS 状态不变时（changed=true）只需重新加载 sing-box
+func (a *Agent) applyCertState(certMgr *config.CertManager, changed bool) error {
+	info, err := certMgr.Info()
+	valid := err == nil && info.IsValidAt(time.Now())
+	domain := a.vpnDomain()
+
+	switch {
+	case !valid && a.generator.TLSEnabled():
+		reason := "unreadable"
+		if err == nil {
+			reason = fmt.Sprintf("valid %s - %s", info.NotBefore.Format(time.RFC3339), info.NotAfter.Format(time.RFC3339))
+		}
+		log.Println("[Cert] ========================================")
+		log.Printf("[Cert] WARNING: TLS certificate for %s is no longer valid (%s)", domain, reason)
+		log.Println("[Cert] WARNING: disabling TLS inbounds (vmess/trojan/hysteria2/tuic) until a valid certificate is available")
+		log.Println("[Cert] ========================================")
+		a.generator.SetTLS(domain, "", "")
+		return a.reapplyConfig()
+
+	case valid && !a.generator.TLSEnabled():
+		log.Printf("[Cert] Valid certificate available (expires at %s), enabling TLS inbounds",
+			info.NotAfter.Format(time.RFC3339))
+		a.generator.SetTLS(domain, certMgr.GetCertPath(), certMgr.GetKeyPath())
+		return a.reapplyConfig()
+
+	case valid && changed && a.manager.IsRunning():
+		log.Println("[Cert] Reloading sing-box to apply new certificate...")
+		return a.manager.Reload()
+	}
+	return nil
+}
+
+// vpnDomain TLS 域名：manager 节点配置优先，其次是环境变量
+func (a *Agent) vpnDomain() string {
+	if a.multiProto != nil && a.multiProto.NodeConfig.VpnDomain != "" {
+		return a.multiProto.NodeConfig.VpnDomain
+	}
+	return a.cfg.VpnDomain
+}
+
+func (a *Agent) setCertRenewalError(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.certRenewalError = err.Error()
+	} else {
+		a.certRenewalError = ""
+	}
+}
+
+// fillCertStatus 在心跳中附带证书状态
+func (a *Agent) fillCertStatus(req *config.HeartbeatRequest) {
+	if info, err := config.NewCertManager(a.dataDir).Info(); err == nil {
+		expiresAt := info.NotAfter
+		req.CertExpiresAt = &expiresAt
+		req.CertExpired = !info.IsValidAt(time.Now())
+	}
+
+	a.mu.RLock()
+	req.CertRenewalError = a.certRenewalError
+	a.mu.RUnlock()
+}
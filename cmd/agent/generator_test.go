@@ -119,3 +119,87 @@ func TestGeneratorStatsUsers(t *testing.T) {
 	t.Logf("✅ All %d enabled users are correctly added to stats list", len(expectedUsers))
 	t.Logf("Stats users: %v", statsUsers)
 }
+
+// TestGeneratorTLSProtocols 测试 TLS 协议只在配置了证书时生成 inbound
+func TestGeneratorTLSProtocols(t *testing.T) {
+	users := []config.User{
+		{
+			UUID:       "user1-all",
+			Protocols:  []string{"vless", "shadowsocks", "vmess", "trojan", "hysteria2", "tuic"},
+			SSPassword: "pass1",
+			Enabled:    true,
+		},
+	}
+
+	gen := config.NewGeneratorWithOptions(config.GeneratorOptions{
+		Ports: map[string]int{
+			"vless":       443,
+			"shadowsocks": 8388,
+			"vmess":       8443,
+			"trojan":      8444,
+			"hysteria2":   8445,
+			"tuic":        0, // 未启用
+		},
+		PrivateKey: "test-key",
+		ShortIDs:   []string{"test-short-id"},
+	})
+
+	inboundTags := func(cfg map[string]any) []string {
+		inbounds, ok := cfg["inbounds"].([]map[string]any)
+		if !ok {
+			t.Fatal("inbounds not found or wrong type")
+		}
+		var tags []string
+		for _, inbound := range inbounds {
+			tags = append(tags, inbound["tag"].(string))
+		}
+		return tags
+	}
+
+	// 没有证书：只有 VLESS 和 Shadowsocks
+	tags := inboundTags(gen.Generate(users, "", false))
+	if fmt.Sprint(tags) != "[vless-in ss-in]" {
+		t.Errorf("Expected only non-TLS inbounds without cert, got %v", tags)
+	}
+
+	// 有证书：启用所有端口 > 0 的协议
+	gen.SetTLS("vpn.example.com", "/tmp/cert.pem", "/tmp/key.pem")
+	tags = inboundTags(gen.Generate(users, "", false))
+	if fmt.Sprint(tags) != "[vless-in ss-in vmess-in trojan-in hysteria2-in]" {
+		t.Errorf("Unexpected inbounds with cert: %v", tags)
+	}
+}
+
+// TestGeneratorPerProtocolStats 测试按协议统计时用户名为 uuid@protocol
+func TestGeneratorPerProtocolStats(t *testing.T) {
+	users := []config.User{
+		{
+			UUID:       "user1",
+			Protocols:  []string{"vless", "shadowsocks"},
+			SSPassword: "pass1",
+			Enabled:    true,
+		},
+	}
+
+	gen := config.NewGeneratorWithOptions(config.GeneratorOptions{
+		Ports:            map[string]int{"vless": 443, "shadowsocks": 8388},
+		PrivateKey:       "test-key",
+		ShortIDs:         []string{"test-short-id"},
+		PerProtocolStats: true,
+	})
+	cfg := gen.Generate(users, "", false)
+
+	stats := cfg["experimental"].(map[string]any)["v2ray_api"].(map[string]any)["stats"].(map[string]any)
+	if got := fmt.Sprint(stats["users"]); got != "[user1@vless user1@shadowsocks]" {
+		t.Errorf("Unexpected stats users: %s", got)
+	}
+
+	for _, inbound := range cfg["inbounds"].([]map[string]any) {
+		for _, u := range inbound["users"].([]map[string]any) {
+			uuid, proto := config.ParseStatsUserName(u["name"].(string))
+			if uuid != "user1" || proto != inbound["type"] {
+				t.Errorf("Inbound %s has user name %v", inbound["tag"], u["name"])
+			}
+		}
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,41 +15,60 @@ import (
 	"time"
 
 	"otun-node-agent/internal/api"
+	"otun-node-agent/internal/audit"
 	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/controlplane"
+	"otun-node-agent/internal/history"
 	"otun-node-agent/internal/local"
+	"otun-node-agent/internal/push"
 	"otun-node-agent/internal/quota"
+	"otun-node-agent/internal/scheduler"
 	"otun-node-agent/internal/singbox"
 	"otun-node-agent/internal/stats"
 )
 
 // Agent 是主控制器
 type Agent struct {
-	cfg        *config.AgentConfig
-	secrets    *config.NodeSecrets
-	syncer     *config.Syncer
-	cache      *config.Cache
-	generator  *config.Generator
-	manager    *singbox.Manager
-	connMgr    *singbox.ConnectionManager
-	monitor    *quota.Monitor
-	collector  *stats.Collector
-	reporter   *stats.Reporter
+	cfg       *config.AgentConfig
+	secrets   *config.NodeSecrets
+	control   *controlplane.Client // 管理端 HTTP 客户端
+	syncer    *config.Syncer
+	cache     *config.Cache
+	generator *config.Generator
+	manager   *singbox.Manager
+	connMgr   *singbox.ConnectionManager
+	monitor   *quota.Monitor
+	ipLimiter *quota.IPLimiter
+	scheduler *scheduler.Scheduler
+	push      *push.Client // 管理端推送通道（未启用时为 nil）
+	collector *stats.Collector
+	reporter  *stats.Reporter
+	metrics   *AgentMetrics
 
 	// 本地用户管理
 	localStore *local.Store
 	localAPI   *api.LocalAPIServer
+	history    *history.Store // 本地流量历史（本地/混合模式）
 
 	// 多协议模式 (remote 模式 VPN 节点)
 	multiProto *MultiProtocolContext
 	dataDir    string // 数据目录路径
 
-	currentVersion string
-	mu             sync.RWMutex
+	currentVersion   string
+	remoteUsers      *config.UsersResponse // 最近一次同步的远程用户（增量同步的基准）
+	certRenewalError string                // 最近一次证书续期失败原因
+	mu               sync.RWMutex
+	regenMu          sync.Mutex // 串行化本地配置重新生成
+	collectMu        sync.Mutex // 串行化流量收集（定时任务与停止/重载前的收集）
+	certMu           sync.Mutex // 串行化证书安装、回滚和续期（推送与心跳可能同时下发同一更新）
 }
 
+// agentVersion Agent 版本（写入 User-Agent）
+const agentVersion = "1.1.0"
+
 func main() {
 	log.Println("========================================")
-	log.Println("  OTun Node Agent v1.1.0")
+	log.Println("  OTun Node Agent v" + agentVersion)
 	log.Println("========================================")
 
 	// 加载配置
@@ -101,8 +122,19 @@ func NewAgent(cfg *config.AgentConfig) (*Agent, error) {
 		return nil, err
 	}
 
+	// Agent 停止期间到期的轮换步骤
+	if secrets.AdvanceRotation(time.Now()) {
+		if err := config.SaveSecrets(dataDir, secrets); err != nil {
+			return nil, err
+		}
+		log.Println("Applied pending Reality key rotation step")
+	}
+
 	log.Printf("Reality Public Key: %s", secrets.PublicKey)
 	log.Printf("Short ID: %s", secrets.ShortIDs[0])
+	if secrets.Rotation != nil {
+		log.Printf("Reality rotation in progress (retiring short_ids: %v)", secrets.Rotation.RetiringShortIDs)
+	}
 
 	// 使用随机端口（如果环境变量未指定）
 	ssPort := cfg.SSPort
@@ -114,17 +146,61 @@ func NewAgent(cfg *config.AgentConfig) (*Agent, error) {
 
 	// 创建各个组件
 	singboxAPIAddr := "127.0.0.1:10085"
-	syncer := config.NewSyncer(cfg.APIURL, cfg.NodeAPIKey)
+	// 管理端请求共用一个客户端：统一重试和熔断
+	control := controlplane.New(controlplane.Options{
+		BaseURL: cfg.APIURL,
+		APIKey:  cfg.NodeAPIKey,
+		NodeID:  cfg.NodeID,
+		Version: agentVersion,
+	})
+	syncer := config.NewSyncer(control)
 	cache := config.NewCache(dataDir)
-	generator := config.NewGenerator(cfg.VLESSPort, ssPort, secrets.PrivateKey, secrets.ShortIDs)
+
+	routePolicy, err := loadRoutePolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RoutePolicy = routePolicy
+
+	generator := config.NewGeneratorWithOptions(config.GeneratorOptions{
+		Ports: map[string]int{
+			"vless":       cfg.VLESSPort,
+			"shadowsocks": ssPort,
+			"vmess":       cfg.VmessPort,
+			"trojan":      cfg.TrojanPort,
+			"hysteria2":   cfg.Hysteria2Port,
+			"tuic":        cfg.TuicPort,
+		},
+		PrivateKey:       secrets.PrivateKey,
+		ShortIDs:         secrets.ShortIDs,
+		PerProtocolStats: cfg.StatsPerProtocol,
+		Route:            routePolicy,
+	})
+
+	// 已有有效证书（例如本地模式下手动放置）时启用 TLS 协议，过期证书不启用
+	if certMgr := config.NewCertManager(dataDir); certMgr.HasValidCert() {
+		generator.SetTLS(cfg.VpnDomain, certMgr.GetCertPath(), certMgr.GetKeyPath())
+	}
 	manager := singbox.NewManager(cfg.SingboxBin, cfg.SingboxConfig)
 	connMgr := singbox.NewConnectionManager(singboxAPIAddr)
 	collector := stats.NewCollector(singboxAPIAddr)
-	reporter := stats.NewReporter(cfg.APIURL, cfg.NodeAPIKey, statsCache)
+	journalPolicy, err := stats.ParseFullPolicy(cfg.StatsJournalPolicy)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := stats.OpenJournal(statsCache, stats.JournalOptions{
+		MaxSize: cfg.StatsJournalMaxSize,
+		Policy:  journalPolicy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reporter := stats.NewReporter(control, journal)
 
 	agent := &Agent{
 		cfg:       cfg,
 		secrets:   secrets,
+		control:   control,
 		syncer:    syncer,
 		cache:     cache,
 		generator: generator,
@@ -138,6 +214,33 @@ func NewAgent(cfg *config.AgentConfig) (*Agent, error) {
 	// 更新配置中的实际端口
 	cfg.SSPort = ssPort
 
+	agent.scheduler = scheduler.New()
+	if cfg.PushEnabled && cfg.ManagementMode != config.ModeLocal {
+		// 推送与其他管理端请求共用认证头、User-Agent 和熔断器
+		pushControl := controlplane.New(controlplane.Options{
+			BaseURL: agent.pushURL(),
+			APIKey:  cfg.NodeAPIKey,
+			NodeID:  cfg.NodeID,
+			Version: agentVersion,
+			Breaker: control.Breaker(),
+		})
+		agent.push = push.NewClient(pushControl, "", cfg.NodeID, agent.handleCommands, func() {
+			// 补拉断线期间可能错过的指令和用户变更
+			agent.scheduler.Trigger(jobHeartbeat)
+			agent.scheduler.Trigger(jobSync)
+		})
+	}
+	agent.metrics = newAgentMetrics(agent, cfg.MetricsPerUser)
+
+	// 停止/重载会清空 sing-box 的流量计数，先把未收集的流量落盘
+	manager.SetPreStopHook(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := agent.checkpointTraffic(ctx); err != nil {
+			log.Printf("Failed to checkpoint traffic before sing-box stop/reload: %v", err)
+		}
+	})
+
 	// 创建限额监控器（带移除回调）
 	agent.monitor = quota.NewMonitor(func(uuid, reason string) {
 		log.Printf("User quota exceeded: %s (%s), kicking...", uuid, reason)
@@ -146,27 +249,74 @@ func NewAgent(cfg *config.AgentConfig) (*Agent, error) {
 		} else if kicked > 0 {
 			log.Printf("Kicked %d connections for user %s", kicked, uuid)
 		}
+
+		// 本地用户：从 sing-box 配置中移除，防止重新连接
+		if agent.localStore != nil {
+			if _, ok := agent.localStore.GetUser(uuid); ok {
+				agent.regenerateConfig()
+			}
+		}
+	})
+
+	// 创建并发 IP 限制器：超限的最新 IP 上的连接会被断开
+	agent.ipLimiter = quota.NewIPLimiter(cfg.IPLimitGrace, connMgr.KickConnection, func(e quota.IPLimitEvent) {
+		log.Printf("[IPLimit] User %s exceeded max_ips=%d (online IPs: %v), kicked %d connections from %v",
+			e.UUID, e.Limit, e.IPs, e.Kicked, e.KickedIPs)
+		agent.metrics.RecordIPLimit(e)
 	})
 
 	// 本地/混合模式：初始化本地用户存储
 	if cfg.ManagementMode == config.ModeLocal || cfg.ManagementMode == config.ModeHybrid {
-		agent.localStore = local.NewStore(dataDir, func() {
+		localStore, err := local.NewStore(dataDir, func() {
 			// 用户变更回调：重新生成配置
 			log.Println("Local users changed, regenerating config...")
 			agent.regenerateConfig()
 		})
+		if err != nil {
+			// 数据文件损坏时拒绝启动，避免以空用户运行并覆盖原文件
+			return nil, err
+		}
+		agent.localStore = localStore
 
 		// 创建本地 API 服务
 		nodeConfig := &api.NodeConfig{
-			NodeID:    cfg.NodeID,
-			ServerIP:  cfg.ServerIP,
-			PublicKey: secrets.PublicKey,
-			ShortID:   secrets.ShortIDs[0],
-			VLESSPort: cfg.VLESSPort,
-			SSPort:    ssPort,
-			SSMethod:  "chacha20-ietf-poly1305",
+			NodeID:        cfg.NodeID,
+			ServerIP:      cfg.ServerIP,
+			PublicKey:     secrets.PublicKey,
+			ShortID:       secrets.ShortIDs[0],
+			VLESSPort:     cfg.VLESSPort,
+			SSPort:        ssPort,
+			SSMethod:      config.SSMethod,
+			VmessPort:     cfg.VmessPort,
+			TrojanPort:    cfg.TrojanPort,
+			Hysteria2Port: cfg.Hysteria2Port,
+			TuicPort:      cfg.TuicPort,
+			VpnDomain:     cfg.VpnDomain,
+			SubBaseURL:    cfg.SubBaseURL,
+		}
+		if nodeConfig.SubBaseURL == "" && cfg.ServerIP != "" {
+			nodeConfig.SubBaseURL = fmt.Sprintf("http://%s:8080", cfg.ServerIP)
 		}
 		agent.localAPI = api.NewLocalAPIServer(agent.localStore, cfg.NodeAPIKey, nodeConfig)
+		agent.localAPI.SetRealityRotator(agent)
+		agent.localAPI.SetEnabledProtocols(agent.generator.EnabledProtocols)
+
+		keys, err := local.NewKeyStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		agent.localAPI.SetKeyStore(keys)
+		agent.localAPI.SetAuditLog(audit.NewLog(dataDir, audit.DefaultMaxSize, audit.DefaultMaxFiles))
+
+		agent.history, err = history.Open(dataDir, history.Retention{
+			Hourly:  cfg.HistoryHourlyRetention,
+			Daily:   cfg.HistoryDailyRetention,
+			Monthly: cfg.HistoryMonthlyMonths,
+		})
+		if err != nil {
+			return nil, err
+		}
+		agent.localAPI.SetHistory(agent.history)
 
 		log.Printf("Local management API enabled")
 		if cfg.ServerIP != "" {
@@ -194,12 +344,12 @@ func (a *Agent) Run(ctx context.Context) {
 	case config.ModeRemote:
 		// 远程模式：与原来行为一致
 		log.Println("Running in REMOTE mode")
-		a.initRemoteMode()
+		a.initRemoteMode(ctx)
 
 	case config.ModeHybrid:
 		// 混合模式：本地 + 远程
 		log.Println("Running in HYBRID mode")
-		a.initHybridMode()
+		a.initHybridMode(ctx)
 	}
 
 	// 启动 sing-box
@@ -223,6 +373,10 @@ func (a *Agent) startHTTPServer() {
 	healthServer := api.NewHealthServer(func() bool {
 		return a.manager.IsRunning() || os.Getenv("SKIP_SINGBOX") == "true"
 	})
+	healthServer.SetConfigStatus(func() (string, bool) {
+		status := a.manager.GetConfigStatus()
+		return status.LastError, status.RolledBack
+	})
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		healthServer.HandleHealth(w, r)
 	})
@@ -236,6 +390,9 @@ func (a *Agent) startHTTPServer() {
 		log.Println("Local API routes registered")
 	}
 
+	// Prometheus 指标单独监听：按用户的标签值是连接凭证，不能和订阅一起对外
+	go a.metrics.Serve(a.cfg.MetricsAddr, a.cfg.MetricsToken)
+
 	go func() {
 		log.Println("HTTP server starting on :8080")
 		server := &http.Server{
@@ -257,21 +414,22 @@ func (a *Agent) initLocalMode() {
 }
 
 // initRemoteMode 初始化远程模式
-func (a *Agent) initRemoteMode() {
+func (a *Agent) initRemoteMode(ctx context.Context) {
 	// 尝试初始化多协议模式 (如果 manager 返回了多协议配置)
-	multiProto, err := a.initMultiProtocol(a.dataDir)
+	multiProto, err := a.initMultiProtocol(ctx, a.dataDir)
 	if err != nil {
 		log.Printf("Multi-protocol init failed (will use standard mode): %v", err)
 	}
 	a.multiProto = multiProto
 
 	// 节点注册
-	if err := a.register(); err != nil {
+	if err := a.register(ctx); err != nil {
 		log.Printf("Node registration failed: %v", err)
 	}
 
-	// 首次同步配置
-	if err := a.syncAndApply(); err != nil {
+	// 首次同步配置（以缓存为增量基准）
+	a.loadCachedRemoteUsers()
+	if err := a.syncUsers(ctx); err != nil {
 		log.Printf("Initial sync failed: %v", err)
 		if a.cache.HasCache() {
 			log.Println("Using cached configuration...")
@@ -282,94 +440,179 @@ func (a *Agent) initRemoteMode() {
 	}
 
 	// 尝试上报缓存的统计
-	if err := a.reporter.FlushCache(); err != nil {
+	if err := a.reporter.FlushCache(ctx); err != nil {
 		log.Printf("Failed to flush stats cache: %v", err)
 	}
 }
 
 // initHybridMode 初始化混合模式
-func (a *Agent) initHybridMode() {
+func (a *Agent) initHybridMode(ctx context.Context) {
+	// 与远程模式一致，支持多协议
+	multiProto, err := a.initMultiProtocol(ctx, a.dataDir)
+	if err != nil {
+		log.Printf("Multi-protocol init failed (will use standard mode): %v", err)
+	}
+	a.multiProto = multiProto
+
 	// 节点注册
-	if err := a.register(); err != nil {
+	if err := a.register(ctx); err != nil {
 		log.Printf("Node registration failed: %v", err)
 	}
 
-	// 同步远程用户并合并本地用户
-	if err := a.syncAndApplyHybrid(); err != nil {
+	// 同步远程用户并合并本地用户（以缓存为增量基准）
+	a.loadCachedRemoteUsers()
+	if err := a.syncUsers(ctx); err != nil {
 		log.Printf("Initial sync failed: %v", err)
-		// 回退到本地用户
+		// 回退到缓存的远程用户和本地用户
 		a.regenerateConfig()
 	}
 
 	// 尝试上报缓存的统计
-	if err := a.reporter.FlushCache(); err != nil {
+	if err := a.reporter.FlushCache(ctx); err != nil {
 		log.Printf("Failed to flush stats cache: %v", err)
 	}
 }
 
-// runMainLoop 主循环
+// 定时任务名称
+const (
+	jobSync        = "sync"
+	jobHeartbeat   = "heartbeat"
+	jobConnections = "connections"
+	jobStats       = "stats"
+	jobQuota       = "quota"
+	jobIPLimit     = "ip_limit"
+	jobReality     = "reality_rotation"
+	jobTraffic     = "traffic_reset"
+	jobCert        = "cert_renewal"
+)
+
+// shutdownTimeout 停止时最后一次上报统计的超时
+const shutdownTimeout = 15 * time.Second
+
+// runMainLoop 注册定时任务并运行到 ctx 取消
+// 每个任务有独立的 worker，慢请求（例如同步超时）不会拖延心跳和限额检查
 func (a *Agent) runMainLoop(ctx context.Context) {
-	// 根据模式决定是否启用远程同步定时器
-	var syncTicker *time.Ticker
-	var statsTicker *time.Ticker
-	var heartbeatTicker *time.Ticker
-	var connectionsTicker *time.Ticker
-
-	if a.cfg.ManagementMode == config.ModeRemote || a.cfg.ManagementMode == config.ModeHybrid {
-		syncTicker = time.NewTicker(a.cfg.SyncInterval)
-		statsTicker = time.NewTicker(a.cfg.StatsInterval)
-		heartbeatTicker = time.NewTicker(30 * time.Second)
-		connectionsTicker = time.NewTicker(10 * time.Second)
-		defer syncTicker.Stop()
-		defer statsTicker.Stop()
-		defer heartbeatTicker.Stop()
-		defer connectionsTicker.Stop()
-	}
-
-	quotaTicker := time.NewTicker(10 * time.Second)
-	defer quotaTicker.Stop()
+	remote := a.cfg.ManagementMode == config.ModeRemote || a.cfg.ManagementMode == config.ModeHybrid
+
+	// 所有模式都需要收集流量（本地模式写入本地存储，远程模式上报）
+	a.scheduler.Add(scheduler.Job{
+		Name:     jobStats,
+		Interval: a.cfg.StatsInterval,
+		Timeout:  2 * time.Minute,
+		Run:      a.collectAndReport,
+	})
+	a.scheduler.Add(scheduler.Job{
+		Name:     jobQuota,
+		Interval: 10 * time.Second,
+		Run: func(context.Context) error {
+			a.monitor.CheckAllUsers()
+			return nil
+		},
+	})
+	a.scheduler.Add(scheduler.Job{
+		Name:     jobIPLimit,
+		Interval: a.cfg.IPLimitInterval,
+		Timeout:  30 * time.Second,
+		Run: func(context.Context) error {
+			a.enforceIPLimits()
+			return nil
+		},
+	})
+	a.scheduler.Add(scheduler.Job{
+		Name:     jobReality,
+		Interval: time.Minute,
+		Timeout:  2 * time.Minute,
+		Run: func(ctx context.Context) error {
+			a.advanceRealityRotation(ctx)
+			return nil
+		},
+	})
+
+	a.scheduler.Add(scheduler.Job{
+		Name:     jobCert,
+		Interval: time.Hour,
+		Timeout:  2 * time.Minute,
+		Run:      a.checkCertificate,
+	})
+
+	// 本地/混合模式：本地用户按周期重置流量
+	if a.localStore != nil {
+		a.scheduler.Add(scheduler.Job{
+			Name:     jobTraffic,
+			Interval: time.Minute,
+			Timeout:  30 * time.Second,
+			Run: func(context.Context) error {
+				return a.resetDueTraffic()
+			},
+		})
+	}
+
+	// 远程/混合模式：与管理服务器交互，加随机抖动避免大量节点同时请求
+	if remote {
+		a.scheduler.Add(scheduler.Job{
+			Name:     jobSync,
+			Interval: a.cfg.SyncInterval,
+			Jitter:   a.cfg.SyncInterval / 10,
+			Timeout:  2 * time.Minute,
+			Run:      a.syncUsers,
+		})
+		a.scheduler.Add(scheduler.Job{
+			Name:     jobHeartbeat,
+			Interval: 30 * time.Second,
+			Jitter:   3 * time.Second,
+			Timeout:  25 * time.Second,
+			Run:      a.sendHeartbeat,
+		})
+		a.scheduler.Add(scheduler.Job{
+			Name:     jobConnections,
+			Interval: 10 * time.Second,
+			Jitter:   time.Second,
+			Timeout:  10 * time.Second,
+			Run:      a.reportConnections,
+		})
+	}
 
+	a.scheduler.Start(ctx)
 	log.Printf("Agent is running (mode: %s)", a.cfg.ManagementMode)
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping agent...")
-			if a.cfg.ManagementMode != config.ModeLocal {
-				a.collectAndReport()
-			}
-			a.manager.Stop()
-			return
+	// 启动时立即检查证书，不等待第一个周期
+	a.scheduler.Trigger(jobCert)
+
+	// 推送通道：指令即时送达，断开期间依赖心跳轮询
+	var pushDone chan struct{}
+	if a.push != nil {
+		pushDone = make(chan struct{})
+		go func() {
+			defer close(pushDone)
+			a.push.Run(ctx)
+		}()
+	}
 
-		case <-quotaTicker.C:
-			a.monitor.CheckAllUsers()
+	<-ctx.Done()
+	log.Println("Stopping agent...")
 
-		default:
-			// 远程/混合模式的定时任务
-			if syncTicker != nil {
-				select {
-				case <-syncTicker.C:
-					if a.cfg.ManagementMode == config.ModeHybrid {
-						if err := a.syncAndApplyHybrid(); err != nil {
-							log.Printf("Sync error: %v", err)
-						}
-					} else {
-						if err := a.syncAndApply(); err != nil {
-							log.Printf("Sync error: %v", err)
-						}
-					}
-				case <-statsTicker.C:
-					a.collectAndReport()
-				case <-heartbeatTicker.C:
-					a.sendHeartbeat()
-				case <-connectionsTicker.C:
-					a.reportConnections()
-				default:
-				}
-			}
+	// 等待运行中的任务收到取消并退出
+	a.scheduler.Wait()
+	if pushDone != nil {
+		<-pushDone
+	}
 
-			// 小睡一下避免 CPU 空转
-			time.Sleep(100 * time.Millisecond)
+	// 最后一次收集流量（ctx 已取消，使用独立的超时）
+	// 停止 sing-box 时的钩子还会再收集一次，覆盖两者之间产生的流量
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if _, err := a.checkpointTraffic(shutdownCtx); err != nil {
+		log.Printf("Final traffic collection failed: %v", err)
+	}
+	a.manager.Stop()
+	a.collector.Close()
+	a.flushHistory()
+
+	// 已写入日志的统计尽量在退出前送达，未送达的下次启动重发
+	if a.cfg.ManagementMode != config.ModeLocal {
+		if err := a.reporter.FlushCache(shutdownCtx); err != nil {
+			log.Printf("Final stats report failed (%d reports kept for next start): %v",
+				a.reporter.GetCacheCount(), err)
 		}
 	}
 }
@@ -380,19 +623,23 @@ func (a *Agent) regenerateConfig() {
 		return
 	}
 
+	// 混合模式：合并已同步的远程用户，避免本地变更时丢掉远程用户
+	if a.cfg.ManagementMode == config.ModeHybrid {
+		if err := a.applyHybrid(); err != nil {
+			log.Printf("Failed to apply config: %v", err)
+		}
+		return
+	}
+
+	a.regenMu.Lock()
+	defer a.regenMu.Unlock()
+
 	localUsers := a.localStore.ListUsers()
 	users := make([]config.User, 0, len(localUsers))
 
-	for _, lu := range localUsers {
-		users = append(users, config.User{
-			UUID:         lu.UUID,
-			Protocols:    lu.Protocols,
-			SSPassword:   lu.SSPassword,
-			Enabled:      lu.Enabled,
-			TrafficLimit: lu.TrafficLimit,
-			TrafficUsed:  lu.TrafficUsed,
-			ExpireAt:     lu.ExpireAt,
-		})
+	now := time.Now()
+	for i := range localUsers {
+		users = append(users, localToConfigUser(&localUsers[i], now))
 	}
 
 	// 检查熔断状态
@@ -404,34 +651,98 @@ func (a *Agent) regenerateConfig() {
 	log.Printf("Regenerating config with %d local users (circuit breaker: %v)", len(users), circuitBreakerEnabled)
 
 	// 更新限额监控
-	a.monitor.UpdateUsers(users)
+	a.updateUserLimits(users)
 
 	// 生成配置
-	singboxCfg := a.generator.Generate(users, "www.microsoft.com", circuitBreakerEnabled)
+	singboxCfg := a.generator.Generate(users, a.realitySNI(""), circuitBreakerEnabled)
+
+	// 校验、写入并重载 sing-box
+	if err := a.applyConfig(singboxCfg); err != nil {
+		log.Printf("Failed to apply config: %v", err)
+	}
+}
+
+// applyConfig 校验生成的配置并交给 sing-box（运行中会自动重载，失败时回滚到 last-good）
+func (a *Agent) applyConfig(singboxCfg map[string]any) error {
+	data, err := a.generator.Marshal(singboxCfg)
+	if err != nil {
+		return err
+	}
+	return a.manager.ApplyConfig(data)
+}
 
-	if err := a.generator.WriteToFile(singboxCfg, a.cfg.SingboxConfig); err != nil {
-		log.Printf("Failed to write config: %v", err)
+// localToConfigUser 将本地用户转换为配置用户
+// 已过期或流量用尽的本地用户不会写入 sing-box 配置，避免被踢后重新连接
+func localToConfigUser(lu *local.LocalUser, now time.Time) config.User {
+	return config.User{
+		UUID:         lu.UUID,
+		Protocols:    lu.Protocols,
+		SSPassword:   lu.SSPassword,
+		Enabled:      lu.Enabled && !lu.IsExpired(now) && !lu.IsOverQuota(),
+		TrafficLimit: lu.TrafficLimit,
+		TrafficUsed:  lu.TrafficUsed,
+		ExpireAt:     lu.ExpireAt,
+		MaxIPs:       lu.MaxIPs,
+	}
+}
+
+// updateUserLimits 更新限额监控和并发 IP 限制
+func (a *Agent) updateUserLimits(users []config.User) {
+	a.monitor.UpdateUsers(users)
+	a.ipLimiter.UpdateUsers(users)
+	a.metrics.PruneUsers(users)
+}
+
+// enforceIPLimits 扫描活跃连接，断开超出 max_ips 的 IP 上的连接
+func (a *Agent) enforceIPLimits() {
+	if a.ipLimiter.GetLimitedUserCount() == 0 {
 		return
 	}
 
-	// 重载 sing-box
-	if a.manager.IsRunning() {
-		log.Println("Reloading sing-box...")
-		if err := a.manager.Reload(); err != nil {
-			log.Printf("Failed to reload sing-box: %v", err)
-		}
+	connections, err := a.connMgr.GetActiveConnections()
+	if err != nil {
+		log.Printf("[IPLimit] Failed to get connections: %v", err)
+		return
+	}
+
+	conns := make([]quota.ClientConn, 0, len(connections))
+	for i := range connections {
+		conns = append(conns, quota.ClientConn{
+			ID:   connections[i].ID,
+			User: connections[i].Metadata.User,
+			IP:   connections[i].SourceIP(),
+		})
 	}
+	a.ipLimiter.Scan(conns)
 }
 
-// syncAndApplyHybrid 混合模式：同步远程用户并合并本地用户
-func (a *Agent) syncAndApplyHybrid() error {
+// syncAndApplyHybrid 混合模式：同步远程用户，有变化时合并本地用户并应用
+func (a *Agent) syncAndApplyHybrid(ctx context.Context) error {
 	log.Println("Syncing configuration (hybrid mode)...")
 
-	// 获取远程用户
-	resp, err := a.syncer.FetchUsers()
+	resp, changed, err := a.fetchRemoteUsers(ctx)
 	if err != nil {
 		return err
 	}
+	if !changed {
+		log.Printf("Remote configuration unchanged (version: %s)", resp.Version)
+		return nil
+	}
+
+	return a.applyHybrid()
+}
+
+// applyHybrid 合并远程用户和本地用户（本地优先）并应用配置
+func (a *Agent) applyHybrid() error {
+	a.regenMu.Lock()
+	defer a.regenMu.Unlock()
+
+	a.mu.RLock()
+	resp := a.remoteUsers
+	a.mu.RUnlock()
+	if resp == nil {
+		resp = &config.UsersResponse{}
+	}
 
 	// 获取本地用户
 	localUsers := a.localStore.ListUsers()
@@ -445,16 +756,9 @@ func (a *Agent) syncAndApplyHybrid() error {
 	}
 
 	// 再添加本地用户（覆盖同 UUID 的远程用户）
-	for _, lu := range localUsers {
-		userMap[lu.UUID] = config.User{
-			UUID:         lu.UUID,
-			Protocols:    lu.Protocols,
-			SSPassword:   lu.SSPassword,
-			Enabled:      lu.Enabled,
-			TrafficLimit: lu.TrafficLimit,
-			TrafficUsed:  lu.TrafficUsed,
-			ExpireAt:     lu.ExpireAt,
-		}
+	now := time.Now()
+	for i := range localUsers {
+		userMap[localUsers[i].UUID] = localToConfigUser(&localUsers[i], now)
 	}
 
 	// 转换为列表
@@ -467,23 +771,16 @@ func (a *Agent) syncAndApplyHybrid() error {
 		len(resp.Users), len(localUsers), len(users))
 
 	// 更新限额监控
-	a.monitor.UpdateUsers(users)
-
-	// 缓存远程用户
-	if err := a.cache.SaveUsers(resp); err != nil {
-		log.Printf("Failed to cache users: %v", err)
-	}
+	a.updateUserLimits(users)
 
 	// 检查熔断状态（混合模式下也检查本地熔断）
-	circuitBreakerEnabled := false
-	if a.localStore != nil {
-		circuitBreakerEnabled = a.localStore.IsCircuitBreakerEnabled()
-	}
+	circuitBreakerEnabled := a.localStore.IsCircuitBreakerEnabled()
 
 	// 生成配置
-	singboxCfg := a.generator.Generate(users, resp.Config.RealitySNI, circuitBreakerEnabled)
+	a.applyRoutePolicy(resp.Config.RoutePolicy)
+	singboxCfg := a.generator.Generate(users, a.realitySNI(resp.Config.RealitySNI), circuitBreakerEnabled)
 
-	if err := a.generator.WriteToFile(singboxCfg, a.cfg.SingboxConfig); err != nil {
+	if err := a.applyConfig(singboxCfg); err != nil {
 		return err
 	}
 
@@ -491,21 +788,68 @@ func (a *Agent) syncAndApplyHybrid() error {
 	a.currentVersion = resp.Version
 	a.mu.Unlock()
 
-	if a.manager.IsRunning() {
-		log.Println("Reloading sing-box...")
-		return a.manager.Reload()
+	return nil
+}
+
+// fetchRemoteUsers 以上次同步结果为基准增量同步远程用户，并更新缓存
+// changed 表示结果与当前已应用的版本不同
+func (a *Agent) fetchRemoteUsers(ctx context.Context) (*config.UsersResponse, bool, error) {
+	a.mu.RLock()
+	base := a.remoteUsers
+	current := a.currentVersion
+	a.mu.RUnlock()
+
+	result, err := a.syncer.SyncUsers(ctx, base)
+	if err != nil {
+		return nil, false, err
 	}
 
-	return nil
+	resp := result.Users
+	if !result.NotModified {
+		if result.Delta {
+			log.Printf("Applied user delta %s -> %s", base.Version, resp.Version)
+		}
+
+		// 缓存远程用户
+		if err := a.cache.SaveUsers(resp); err != nil {
+			log.Printf("Failed to cache users: %v", err)
+		}
+
+		a.mu.Lock()
+		a.remoteUsers = resp
+		a.mu.Unlock()
+	}
+
+	return resp, current == "" || resp.Version != current, nil
+}
+
+// loadCachedRemoteUsers 启动时用缓存作为增量同步基准，首次同步即可使用条件请求
+func (a *Agent) loadCachedRemoteUsers() {
+	if !a.cache.HasCache() {
+		return
+	}
+	resp, err := a.cache.LoadUsers()
+	if err != nil {
+		log.Printf("Ignoring unreadable user cache: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	a.remoteUsers = resp
+	a.mu.Unlock()
 }
 
 // register 向管理服务器注册
-func (a *Agent) register() error {
+func (a *Agent) register(ctx context.Context) error {
+	a.mu.RLock()
+	reality := a.secrets.Status()
+	a.mu.RUnlock()
+
 	// 使用多协议注册配置
 	regCfg := &config.RegisterConfig{
 		NodeID:        a.cfg.NodeID,
-		PublicKey:     a.secrets.PublicKey,
-		ShortIDs:      a.secrets.ShortIDs,
+		PublicKey:     reality.PublicKey,
+		ShortIDs:      reality.ShortIDs,
 		VlessPort:     a.cfg.VLESSPort,
 		SSPort:        a.cfg.SSPort,
 		VmessPort:     a.cfg.VmessPort,     // 可选：VMess+TLS
@@ -513,12 +857,16 @@ func (a *Agent) register() error {
 		Hysteria2Port: a.cfg.Hysteria2Port, // 可选：Hysteria2
 		TuicPort:      a.cfg.TuicPort,      // 可选：TUIC
 		VpnDomain:     a.cfg.VpnDomain,     // 可选：VPN TLS 域名
+
+		// 轮换中：提前通知新公钥，切换后客户端需使用新公钥
+		NextPublicKey: reality.PendingPublicKey,
+		KeySwitchAt:   reality.SwitchAt,
 	}
-	return a.syncer.RegisterWithConfig(regCfg)
+	return a.syncer.RegisterWithConfig(ctx, regCfg)
 }
 
 // sendHeartbeat 发送心跳
-func (a *Agent) sendHeartbeat() {
+func (a *Agent) sendHeartbeat(ctx context.Context) error {
 	// 获取系统负载
 	sysLoad := stats.GetSystemLoad()
 
@@ -540,12 +888,34 @@ func (a *Agent) sendHeartbeat() {
 		PublicIP: publicIP,
 	}
 
-	resp, err := a.syncer.Heartbeat(req)
+	// 上报最近一次配置应用失败（已回滚或仍在使用旧配置）
+	if status := a.manager.GetConfigStatus(); status.LastError != "" {
+		req.ConfigError = status.LastError
+		req.ConfigRolledBack = status.RolledBack
+	}
+	a.fillCertStatus(req)
+
+	start := time.Now()
+	resp, err := a.syncer.Heartbeat(ctx, req)
+	a.metrics.RecordHeartbeat(time.Since(start), err)
 	if err != nil {
-		log.Printf("Heartbeat failed: %v", err)
-		return
+		return fmt.Errorf("heartbeat: %w", err)
 	}
 
+	a.handleCommands(ctx, resp)
+	return nil
+}
+
+// pushURL 推送通道地址（未配置时使用管理服务器的默认路径）
+func (a *Agent) pushURL() string {
+	if a.cfg.PushURL != "" {
+		return a.cfg.PushURL
+	}
+	return fmt.Sprintf("%s/api/node/push?node_id=%s", a.cfg.APIURL, url.QueryEscape(a.cfg.NodeID))
+}
+
+// handleCommands 处理管理端下发的指令（心跳响应与推送通道共用）
+func (a *Agent) handleCommands(ctx context.Context, resp *config.HeartbeatResponse) {
 	// 处理踢人指令
 	if len(resp.KickUsers) > 0 {
 		a.kickUsers(resp.KickUsers)
@@ -553,59 +923,103 @@ func (a *Agent) sendHeartbeat() {
 
 	// 处理证书更新
 	if resp.CertUpdate != nil {
-		a.handleCertUpdate(resp.CertUpdate)
+		a.handleCertUpdate(ctx, resp.CertUpdate)
 	}
 
-	// 检查是否需要重新加载用户
+	// 处理 Reality 密钥轮换指令
+	if resp.RotateReality != nil {
+		a.handleRotateCommand(ctx, resp.RotateReality)
+	}
+
+	// 检查是否需要重新加载用户：交给 sync 任务执行，不阻塞调用方
 	if resp.ReloadUsers {
 		log.Println("Manager requested user reload")
-		if a.cfg.ManagementMode == config.ModeHybrid {
-			a.syncAndApplyHybrid()
-		} else {
-			a.syncAndApply()
-		}
+		a.scheduler.Trigger(jobSync)
 	}
 }
 
-// handleCertUpdate 处理证书更新
-func (a *Agent) handleCertUpdate(certUpdate *config.CertUpdate) {
+// syncUsers 按管理模式同步远程用户并记录指标
+func (a *Agent) syncUsers(ctx context.Context) error {
+	var err error
+	if a.cfg.ManagementMode == config.ModeHybrid {
+		err = a.syncAndApplyHybrid(ctx)
+	} else {
+		err = a.syncAndApply(ctx)
+	}
+	a.metrics.RecordSync(err)
+	if controlplane.IsAuth(err) {
+		log.Printf("WARNING: manager rejected NODE_API_KEY, check the node key: %v", err)
+	}
+	return err
+}
+
+// handleCertUpdate 处理证书更新：校验通过并成功应用后才确认，否则恢复旧证书并报告失败
+func (a *Agent) handleCertUpdate(ctx context.Context, certUpdate *config.CertUpdate) {
+	a.certMu.Lock()
+	defer a.certMu.Unlock()
+
 	log.Printf("[CertUpdate] Received certificate update for domain: %s", certUpdate.Domain)
 
-	// 创建证书管理器并保存证书
 	certMgr := config.NewCertManager(a.dataDir)
-	if err := certMgr.SaveCertFromUpdate(certUpdate); err != nil {
-		log.Printf("[CertUpdate] Failed to save certificate: %v", err)
+
+	// 未确认的更新会在每次心跳中重复下发；已安装的不再安装，避免 .prev 备份被覆盖成同一张证书
+	if certMgr.Installed([]byte(certUpdate.Cert), []byte(certUpdate.Key)) {
+		log.Println("[CertUpdate] Certificate already installed")
+		a.ackCertUpdate(ctx)
 		return
 	}
 
-	log.Printf("[CertUpdate] Certificate saved successfully, expires at: %s", certUpdate.ExpiresAt)
+	info, err := certMgr.SaveCertFromUpdate(certUpdate, a.vpnDomain())
+	if err != nil {
+		a.rejectCertUpdate(ctx, certUpdate, err)
+		return
+	}
 
-	// 确认证书更新
-	if err := a.syncer.AckCertUpdate(a.cfg.NodeID); err != nil {
+	// 应用新证书：之前因证书过期停用的 TLS 协议在此恢复
+	if err := a.applyCertState(certMgr, true); err != nil {
+		if rbErr := certMgr.Rollback(); rbErr != nil {
+			log.Printf("[CertUpdate] Failed to restore previous certificate: %v", rbErr)
+		} else if err := a.applyCertState(certMgr, true); err != nil {
+			log.Printf("[CertUpdate] Failed to apply previous certificate: %v", err)
+		}
+		a.rejectCertUpdate(ctx, certUpdate, fmt.Errorf("apply certificate: %w", err))
+		return
+	}
+
+	log.Printf("[CertUpdate] Certificate installed, expires at: %s", info.NotAfter.Format(time.RFC3339))
+	a.setCertRenewalError(nil)
+	a.ackCertUpdate(ctx)
+}
+
+// ackCertUpdate 确认证书更新，管理端停止重复下发
+func (a *Agent) ackCertUpdate(ctx context.Context) {
+	if err := a.syncer.AckCertUpdate(ctx, a.cfg.NodeID); err != nil {
 		log.Printf("[CertUpdate] Failed to acknowledge cert update: %v", err)
 	} else {
 		log.Println("[CertUpdate] Certificate update acknowledged")
 	}
+}
 
-	// 重新加载 sing-box 以应用新证书
-	if a.manager.IsRunning() {
-		log.Println("[CertUpdate] Reloading sing-box to apply new certificate...")
-		if err := a.manager.Reload(); err != nil {
-			log.Printf("[CertUpdate] Failed to reload sing-box: %v", err)
-		}
+// rejectCertUpdate 记录证书更新失败并报告管理端（不确认，管理端可重新下发）
+func (a *Agent) rejectCertUpdate(ctx context.Context, certUpdate *config.CertUpdate, err error) {
+	log.Printf("[CertUpdate] Rejected certificate update for %s: %v", certUpdate.Domain, err)
+	a.setCertRenewalError(err)
+
+	if err := a.syncer.ReportCertFailure(ctx, a.cfg.NodeID, certUpdate.Domain, err.Error()); err != nil {
+		log.Printf("[CertUpdate] Failed to report cert update failure: %v", err)
 	}
 }
 
 // reportConnections 上报活跃连接
-func (a *Agent) reportConnections() {
+func (a *Agent) reportConnections(ctx context.Context) error {
 	connections, err := a.connMgr.GetActiveConnections()
 	if err != nil {
 		// sing-box 可能未运行
-		return
+		return nil
 	}
 
 	if len(connections) == 0 {
-		return
+		return nil
 	}
 
 	report := &config.ConnectionsReport{
@@ -633,16 +1047,13 @@ func (a *Agent) reportConnections() {
 		})
 	}
 
-	resp, err := a.syncer.ReportConnections(report)
+	resp, err := a.syncer.ReportConnections(ctx, report)
 	if err != nil {
-		log.Printf("Report connections failed: %v", err)
-		return
+		return fmt.Errorf("report connections: %w", err)
 	}
 
-	// 处理踢人指令
-	if len(resp.KickUsers) > 0 {
-		a.kickUsers(resp.KickUsers)
-	}
+	a.handleCommands(ctx, resp)
+	return nil
 }
 
 // kickUsers 踢掉指定用户
@@ -663,57 +1074,49 @@ func (a *Agent) kickUsers(uuids []string) {
 }
 
 // syncAndApply 同步配置并应用
-func (a *Agent) syncAndApply() error {
+func (a *Agent) syncAndApply(ctx context.Context) error {
 	log.Println("Syncing configuration...")
 
-	resp, err := a.syncer.FetchUsers()
+	resp, changed, err := a.fetchRemoteUsers(ctx)
 	if err != nil {
 		return err
 	}
 
-	a.mu.RLock()
-	sameVersion := a.currentVersion == resp.Version
-	a.mu.RUnlock()
-
-	if sameVersion {
+	if !changed {
 		log.Printf("Configuration unchanged (version: %s)", resp.Version)
 		return nil
 	}
 
 	log.Printf("New configuration version: %s (%d users)", resp.Version, len(resp.Users))
 
-	a.monitor.UpdateUsers(resp.Users)
-
-	if err := a.cache.SaveUsers(resp); err != nil {
-		log.Printf("Failed to cache users: %v", err)
-	}
+	a.updateUserLimits(resp.Users)
 
-	// 根据是否有多协议上下文选择不同的生成器
-	if a.multiProto != nil {
-		// 多协议模式：使用多协议生成器
-		if err := a.generateMultiProtocolConfig(a.multiProto, resp.Users, false); err != nil {
-			return err
-		}
-	} else {
-		// 标准模式：使用基础生成器
-		singboxCfg := a.generator.Generate(resp.Users, resp.Config.RealitySNI, false)
-		if err := a.generator.WriteToFile(singboxCfg, a.cfg.SingboxConfig); err != nil {
-			return err
-		}
+	a.applyRoutePolicy(resp.Config.RoutePolicy)
+	singboxCfg := a.generator.Generate(resp.Users, a.realitySNI(resp.Config.RealitySNI), false)
+	if err := a.applyConfig(singboxCfg); err != nil {
+		return err
 	}
 
 	a.mu.Lock()
 	a.currentVersion = resp.Version
 	a.mu.Unlock()
 
-	if a.manager.IsRunning() {
-		log.Println("Reloading sing-box...")
-		return a.manager.Reload()
-	}
-
 	return nil
 }
 
+// reapplyConfig 生成器参数（密钥、证书等）变化后，按管理模式用现有用户重新生成并应用配置
+func (a *Agent) reapplyConfig() error {
+	switch a.cfg.ManagementMode {
+	case config.ModeLocal:
+		a.regenerateConfig()
+		return nil
+	case config.ModeHybrid:
+		return a.applyHybrid()
+	default:
+		return a.applyFromCache()
+	}
+}
+
 // applyFromCache 从缓存应用配置
 func (a *Agent) applyFromCache() error {
 	resp, err := a.cache.LoadUsers()
@@ -721,53 +1124,154 @@ func (a *Agent) applyFromCache() error {
 		return err
 	}
 
-	a.monitor.UpdateUsers(resp.Users)
-
-	// 根据是否有多协议上下文选择不同的生成器
-	if a.multiProto != nil {
-		return a.generateMultiProtocolConfig(a.multiProto, resp.Users, false)
+	a.mu.Lock()
+	if a.remoteUsers == nil {
+		a.remoteUsers = resp
 	}
+	a.mu.Unlock()
+
+	a.updateUserLimits(resp.Users)
 
-	// 标准模式
-	singboxCfg := a.generator.Generate(resp.Users, resp.Config.RealitySNI, false)
-	return a.generator.WriteToFile(singboxCfg, a.cfg.SingboxConfig)
+	a.applyRoutePolicy(resp.Config.RoutePolicy)
+	singboxCfg := a.generator.Generate(resp.Users, a.realitySNI(resp.Config.RealitySNI), false)
+	return a.applyConfig(singboxCfg)
 }
 
-// collectAndReport 收集并上报统计
-func (a *Agent) collectAndReport() {
+// collectAndReport 收集流量并上报统计（本地模式只写入本地存储）
+func (a *Agent) collectAndReport(ctx context.Context) error {
 	log.Println("Collecting stats...")
-	userStats, err := a.collector.Collect()
+	_, err := a.checkpointTraffic(ctx)
+	a.flushHistory()
+	if err != nil {
+		return err
+	}
+	if a.cfg.ManagementMode == config.ModeLocal {
+		return nil
+	}
+
+	if err := a.reporter.FlushCache(ctx); err != nil {
+		log.Printf("Stats delivery deferred (%d reports pending): %v", a.reporter.GetCacheCount(), err)
+	}
+
+	// 统计已写入日志，未送达的部分由日志负责重发；
+	// 未送达的流量还不在管理端的 traffic_used 中，继续计入限额检查
+	a.monitor.SetSessionTraffic(a.pendingRemoteTraffic())
+	return nil
+}
+
+// pendingRemoteTraffic 统计日志中尚未送达的远程用户流量
+// 本地用户的流量已计入本地存储的 TrafficUsed，不再重复计入会话流量
+func (a *Agent) pendingRemoteTraffic() map[string]int64 {
+	pending := a.reporter.Journal().PendingTraffic()
+	if a.localStore != nil {
+		for uuid := range pending {
+			if _, ok := a.localStore.GetUser(uuid); ok {
+				delete(pending, uuid)
+			}
+		}
+	}
+	return pending
+}
+
+// checkpointTraffic 从 sing-box 收集流量并落盘，只有落盘成功的流量才会在 sing-box 中清零
+func (a *Agent) checkpointTraffic(ctx context.Context) (*stats.Usage, error) {
+	a.collectMu.Lock()
+	defer a.collectMu.Unlock()
+
+	usage, err := a.collector.CollectDurable(ctx, a.recordTraffic)
+	a.metrics.RecordTraffic(usage)
+	a.recordHistory(usage)
 	if err != nil {
-		log.Printf("Failed to collect stats: %v", err)
+		return usage, fmt.Errorf("collect stats: %w", err)
+	}
+	return usage, nil
+}
+
+// recordHistory 将收集到的用户和 inbound 流量计入本地历史（落盘由定时任务负责）
+func (a *Agent) recordHistory(usage *stats.Usage) {
+	if a.history == nil || usage == nil {
 		return
 	}
 
-	if len(userStats) == 0 {
-		log.Println("No stats to report (no active users with traffic)")
+	samples := make([]history.Sample, 0, len(usage.Users)+len(usage.Inbounds))
+	for uuid, s := range usage.Users {
+		samples = append(samples, history.Sample{Kind: history.KindUser, Name: uuid, Upload: s.Upload, Download: s.Download})
+	}
+	for tag, t := range usage.Inbounds {
+		samples = append(samples, history.Sample{Kind: history.KindInbound, Name: tag, Upload: t.Upload, Download: t.Download})
+	}
+	a.history.Add(time.Now(), samples)
+}
+
+// flushHistory 将流量历史写盘
+func (a *Agent) flushHistory() {
+	if a.history == nil {
 		return
 	}
+	if err := a.history.Flush(); err != nil {
+		log.Printf("Failed to save traffic history: %v", err)
+	}
+}
 
-	// 检查每个用户的流量限制，超限用户会被踢出
-	for uuid, stat := range userStats {
-		traffic := stat.Upload + stat.Download
-		if traffic > 0 {
-			if !a.monitor.CheckUser(uuid, traffic) {
-				log.Printf("User %s failed quota check during stats collection", uuid)
-			}
+// recordTraffic 持久化一批流量增量并做限额检查
+// 远程/混合模式写入统计日志；本地/混合模式累加到本地用户存储
+func (a *Agent) recordTraffic(userStats map[string]*stats.UserStats) error {
+	if a.cfg.ManagementMode != config.ModeLocal {
+		log.Printf("Recording stats for %d users", len(userStats))
+		if err := a.reporter.Record(userStats); err != nil {
+			return fmt.Errorf("record stats: %w", err)
 		}
 	}
 
-	log.Printf("Reporting stats for %d users", len(userStats))
+	// 本地存储是本地用户已用流量的权威来源（包括混合模式）
+	var totals map[string]int64
+	if a.localStore != nil {
+		// 保存失败时内存中的计数已经累加，下次保存会写入；返回错误会导致重复计数
+		var err error
+		totals, err = a.localStore.AddTraffic(trafficByUser(userStats))
+		if err != nil {
+			log.Printf("Failed to persist local user traffic: %v", err)
+		}
+		log.Printf("Recorded traffic for %d local users", len(totals))
 
-	if err := a.reporter.Report(userStats); err != nil {
-		log.Printf("Failed to report stats: %v", err)
-	} else {
-		a.monitor.ResetSessionTraffic()
+		for uuid, used := range totals {
+			a.monitor.SetTrafficUsed(uuid, used)
+		}
+	}
 
-		if a.reporter.GetCacheCount() > 0 {
-			if err := a.reporter.FlushCache(); err != nil {
-				log.Printf("Failed to flush stats cache: %v", err)
-			}
+	// 检查每个用户的流量限制，超限用户会被踢出
+	// 远程用户的增量计入会话流量；本地用户的增量已包含在 TrafficUsed 中
+	for uuid, stat := range userStats {
+		delta := stat.Upload + stat.Download
+		if _, ok := totals[uuid]; ok {
+			delta = 0
+		} else if a.cfg.ManagementMode == config.ModeLocal {
+			continue
 		}
+		if !a.monitor.CheckUser(uuid, delta) {
+			log.Printf("User %s failed quota check during stats collection", uuid)
+		}
+	}
+	return nil
+}
+
+// resetDueTraffic 归档到期用户的流量周期并清零（配置由存储的变更回调重新生成）
+func (a *Agent) resetDueTraffic() error {
+	reset, err := a.localStore.ResetDueTraffic(time.Now())
+	if len(reset) > 0 {
+		log.Printf("Traffic period reset for %d local users", len(reset))
+	}
+	if err != nil {
+		return fmt.Errorf("reset traffic: %w", err)
+	}
+	return nil
+}
+
+// trafficByUser 将统计结果转换为 uuid -> 总流量
+func trafficByUser(userStats map[string]*stats.UserStats) map[string]int64 {
+	traffic := make(map[string]int64, len(userStats))
+	for uuid, stat := range userStats {
+		traffic[uuid] = stat.Upload + stat.Download
 	}
+	return traffic
 }
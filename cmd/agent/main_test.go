@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/local"
+	"otun-node-agent/internal/quota"
+	"otun-node-agent/internal/stats"
+)
+
+// TestRecordTrafficLocalMode 测试本地模式下流量累加到本地存储，并以存储的已用流量做限额检查
+func TestRecordTrafficLocalMode(t *testing.T) {
+	dir := t.TempDir()
+	store, err := local.NewStore(dir, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := store.CreateUser(&local.CreateUserRequest{Name: "limited", TrafficLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited, err := store.CreateUser(&local.CreateUserRequest{Name: "unlimited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := make(chan string, 2)
+	monitor := quota.NewMonitor(func(uuid, reason string) {
+		if reason == "quota_exceeded" {
+			removed <- uuid
+		}
+	})
+	monitor.UpdateUsers([]config.User{
+		{UUID: limited.UUID, Enabled: true, TrafficLimit: 1000},
+		{UUID: unlimited.UUID, Enabled: true},
+	})
+
+	a := &Agent{
+		cfg:        &config.AgentConfig{ManagementMode: config.ModeLocal},
+		monitor:    monitor,
+		localStore: store,
+	}
+
+	record := func(traffic map[string]*stats.UserStats) {
+		t.Helper()
+		if err := a.recordTraffic(traffic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record(map[string]*stats.UserStats{
+		limited.UUID:   {Upload: 300, Download: 300},
+		unlimited.UUID: {Upload: 5000, Download: 5000},
+		"not-local":    {Upload: 1, Download: 1},
+	})
+	if u, _ := store.GetUser(limited.UUID); u.TrafficUsed != 600 {
+		t.Fatalf("limited traffic used = %d, want 600", u.TrafficUsed)
+	}
+	if monitor.GetUserCount() != 2 {
+		t.Fatalf("active users = %d, want 2 while under the limit", monitor.GetUserCount())
+	}
+
+	// 第二批使累计流量超过限额：以存储中的累计值为准，而不是单批增量
+	record(map[string]*stats.UserStats{limited.UUID: {Upload: 200, Download: 200}})
+	select {
+	case uuid := <-removed:
+		if uuid != limited.UUID {
+			t.Fatalf("removed %s, want the limited user", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("user over the limit was not removed")
+	}
+	if monitor.GetUserCount() != 1 {
+		t.Fatalf("active users = %d, want only the unlimited user", monitor.GetUserCount())
+	}
+
+	// 累计流量已写盘，重启后保留
+	reopened, err := local.NewStore(dir, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := reopened.GetUser(limited.UUID); u.TrafficUsed != 1000 {
+		t.Fatalf("persisted traffic used = %d, want 1000", u.TrafficUsed)
+	}
+	if u, _ := reopened.GetUser(unlimited.UUID); u.TrafficUsed != 10000 {
+		t.Fatalf("persisted unlimited traffic used = %d, want 10000", u.TrafficUsed)
+	}
+	if _, ok := reopened.GetUser("not-local"); ok {
+		t.Fatal("traffic for unknown users must not create local users")
+	}
+}
+
+// TestRecordTrafficHybridMode 测试混合模式下本地用户同样以本地存储的已用流量做限额检查，
+// 且不会因统计日志中未送达的流量被重复计入
+func TestRecordTrafficHybridMode(t *testing.T) {
+	store, err := local.NewStore(t.TempDir(), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localUser, err := store.CreateUser(&local.CreateUserRequest{Name: "local", TrafficLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const remoteUUID = "remote-user"
+
+	journal, err := stats.OpenJournal(t.TempDir(), stats.JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := make(chan string, 2)
+	monitor := quota.NewMonitor(func(uuid, reason string) {
+		if reason == "quota_exceeded" {
+			removed <- uuid
+		}
+	})
+	monitor.UpdateUsers([]config.User{
+		{UUID: localUser.UUID, Enabled: true, TrafficLimit: 1000},
+		{UUID: remoteUUID, Enabled: true, TrafficLimit: 1000},
+	})
+
+	a := &Agent{
+		cfg:        &config.AgentConfig{ManagementMode: config.ModeHybrid},
+		monitor:    monitor,
+		reporter:   stats.NewReporter(nil, journal),
+		localStore: store,
+	}
+
+	traffic := map[string]*stats.UserStats{
+		localUser.UUID: {Upload: 300, Download: 300},
+		remoteUUID:     {Upload: 300, Download: 300},
+	}
+	if err := a.recordTraffic(traffic); err != nil {
+		t.Fatal(err)
+	}
+
+	// 上报未送达：远程用户的流量继续计入会话流量，本地用户不重复计入
+	monitor.SetSessionTraffic(a.pendingRemoteTraffic())
+	if got := monitor.GetSessionTraffic(localUser.UUID); got != 0 {
+		t.Fatalf("local session traffic = %d, want 0 (already in traffic used)", got)
+	}
+	if got := monitor.GetSessionTraffic(remoteUUID); got != 600 {
+		t.Fatalf("remote session traffic = %d, want 600 pending", got)
+	}
+	if monitor.GetUserCount() != 2 {
+		t.Fatalf("active users = %d, want 2 while under the limit", monitor.GetUserCount())
+	}
+
+	// 上报已确认后本地用户的累计流量仍然有效，超过限额被移除
+	for _, p := range journal.Pending() {
+		if err := journal.Ack(p.ReportID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	monitor.SetSessionTraffic(a.pendingRemoteTraffic())
+	if err := a.recordTraffic(map[string]*stats.UserStats{localUser.UUID: {Upload: 200, Download: 200}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case uuid := <-removed:
+		if uuid != localUser.UUID {
+			t.Fatalf("removed %s, want the local user", uuid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("local user over the limit was not removed in hybrid mode")
+	}
+	if u, _ := store.GetUser(localUser.UUID); u.TrafficUsed != 1000 {
+		t.Fatalf("local traffic used = %d, want 1000", u.TrafficUsed)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"time"
+
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/metrics"
+	"otun-node-agent/internal/quota"
+	"otun-node-agent/internal/stats"
+)
+
+// AgentMetrics Agent 的 Prometheus 指标
+type AgentMetrics struct {
+	registry *metrics.Registry
+	perUser  bool // 是否输出按用户区分的标签
+
+	userTraffic     *metrics.Vec // 用户流量计数
+	protoTraffic    *metrics.Vec // 用户流量按协议计数（需开启按协议统计）
+	inboundTraffic  *metrics.Vec // inbound 流量计数
+	outboundTraffic *metrics.Vec // outbound 流量计数
+	syncTotal       *metrics.Vec // 同步结果计数
+	syncLastAttempt *metrics.Vec
+	syncLastSuccess *metrics.Vec
+	heartbeatTotal  *metrics.Vec
+	heartbeatLatest *metrics.Vec // 最近一次心跳耗时
+	ipLimitEvents   *metrics.Vec // 并发 IP 超限处理次数
+	ipLimitKicked   *metrics.Vec // 因并发 IP 超限断开的连接数
+}
+
+// newAgentMetrics 创建指标并注册抓取时动态计算的指标
+// perUser 为 false 时聚合掉 user 标签：标签值是用户 UUID（即连接凭证），
+// 同时避免大量用户导致时间序列爆炸
+func newAgentMetrics(a *Agent, perUser bool) *AgentMetrics {
+	r := metrics.NewRegistry()
+	m := &AgentMetrics{
+		registry: r,
+		perUser:  perUser,
+	}
+
+	if perUser {
+		m.userTraffic = r.NewCounterVec("otun_user_traffic_bytes_total",
+			"Traffic collected from sing-box per user since agent start.", "user", "direction")
+	} else {
+		m.userTraffic = r.NewCounterVec("otun_user_traffic_bytes_total",
+			"Traffic collected from sing-box for all users since agent start.", "direction")
+	}
+	if perUser {
+		m.protoTraffic = r.NewCounterVec("otun_user_protocol_traffic_bytes_total",
+			"User traffic per protocol since agent start (requires STATS_PER_PROTOCOL).", "user", "protocol", "direction")
+	} else {
+		m.protoTraffic = r.NewCounterVec("otun_user_protocol_traffic_bytes_total",
+			"User traffic per protocol since agent start (requires STATS_PER_PROTOCOL).", "protocol", "direction")
+	}
+	m.inboundTraffic = r.NewCounterVec("otun_inbound_traffic_bytes_total",
+		"Traffic per sing-box inbound since agent start.", "inbound", "direction")
+	m.outboundTraffic = r.NewCounterVec("otun_outbound_traffic_bytes_total",
+		"Traffic per sing-box outbound since agent start.", "outbound", "direction")
+	m.syncTotal = r.NewCounterVec("otun_sync_total",
+		"User sync attempts by result.", "result")
+	m.syncLastAttempt = r.NewGaugeVec("otun_sync_last_attempt_timestamp_seconds",
+		"Unix time of the last user sync attempt.")
+	m.syncLastSuccess = r.NewGaugeVec("otun_sync_last_success_timestamp_seconds",
+		"Unix time of the last successful user sync.")
+	m.heartbeatTotal = r.NewCounterVec("otun_heartbeat_total",
+		"Heartbeats sent to the manager by result.", "result")
+	m.heartbeatLatest = r.NewGaugeVec("otun_heartbeat_duration_seconds",
+		"Duration of the last heartbeat request.")
+
+	if perUser {
+		m.ipLimitEvents = r.NewCounterVec("otun_ip_limit_events_total",
+			"Times a user exceeded max_ips and had connections kicked.", "user")
+	} else {
+		m.ipLimitEvents = r.NewCounterVec("otun_ip_limit_events_total",
+			"Times a user exceeded max_ips and had connections kicked.")
+	}
+	m.ipLimitKicked = r.NewCounterVec("otun_ip_limit_kicked_connections_total",
+		"Connections kicked because their user exceeded max_ips.")
+
+	r.RegisterFunc(func() []metrics.Family {
+		return m.gatherAgent(a)
+	})
+	r.RegisterFunc(func() []metrics.Family {
+		return m.gatherConnections(a)
+	})
+	r.RegisterFunc(func() []metrics.Family {
+		return m.gatherJobs(a)
+	})
+
+	return m
+}
+
+// Serve 在 addr 上提供 /metrics，token 不为空时要求 Bearer 认证
+func (m *AgentMetrics) Serve(addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handler(token))
+
+	log.Printf("Metrics server starting on %s", addr)
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("Metrics server error: %v", err)
+	}
+}
+
+// handler /metrics 处理函数
+func (m *AgentMetrics) handler(token string) http.HandlerFunc {
+	next := m.registry.Handler()
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// PruneUsers 删除已不存在用户的按用户序列
+func (m *AgentMetrics) PruneUsers(users []config.User) {
+	if !m.perUser {
+		return
+	}
+	active := make(map[string]bool, len(users))
+	for _, u := range users {
+		active[u.UUID] = true
+	}
+	keep := func(uuid string) bool { return active[uuid] }
+	m.userTraffic.Retain("user", keep)
+	m.protoTraffic.Retain("user", keep)
+	m.ipLimitEvents.Retain("user", keep)
+}
+
+// RecordTraffic 记录一次收集到的流量
+func (m *AgentMetrics) RecordTraffic(usage *stats.Usage) {
+	if usage == nil {
+		return
+	}
+	for uuid, s := range usage.Users {
+		if m.perUser {
+			m.userTraffic.Add(float64(s.Upload), uuid, "upload")
+			m.userTraffic.Add(float64(s.Download), uuid, "download")
+		} else {
+			m.userTraffic.Add(float64(s.Upload), "upload")
+			m.userTraffic.Add(float64(s.Download), "download")
+		}
+		for proto, t := range s.Protocols {
+			if m.perUser {
+				m.protoTraffic.Add(float64(t.Upload), uuid, proto, "upload")
+				m.protoTraffic.Add(float64(t.Download), uuid, proto, "download")
+			} else {
+				m.protoTraffic.Add(float64(t.Upload), proto, "upload")
+				m.protoTraffic.Add(float64(t.Download), proto, "download")
+			}
+		}
+	}
+	for tag, t := range usage.Inbounds {
+		m.inboundTraffic.Add(float64(t.Upload), tag, "upload")
+		m.inboundTraffic.Add(float64(t.Download), tag, "download")
+	}
+	for tag, t := range usage.Outbounds {
+		m.outboundTraffic.Add(float64(t.Upload), tag, "upload")
+		m.outboundTraffic.Add(float64(t.Download), tag, "download")
+	}
+}
+
+// RecordSync 记录一次同步结果
+func (m *AgentMetrics) RecordSync(err error) {
+	now := float64(time.Now().Unix())
+	m.syncLastAttempt.Set(now)
+	if err != nil {
+		m.syncTotal.Inc("failure")
+		return
+	}
+	m.syncTotal.Inc("success")
+	m.syncLastSuccess.Set(now)
+}
+
+// RecordHeartbeat 记录一次心跳耗时和结果
+func (m *AgentMetrics) RecordHeartbeat(duration time.Duration, err error) {
+	m.heartbeatLatest.Set(duration.Seconds())
+	if err != nil {
+		m.heartbeatTotal.Inc("failure")
+	} else {
+		m.heartbeatTotal.Inc("success")
+	}
+}
+
+// RecordIPLimit 记录一次并发 IP 超限处理
+func (m *AgentMetrics) RecordIPLimit(e quota.IPLimitEvent) {
+	if m.perUser {
+		m.ipLimitEvents.Inc(e.UUID)
+	} else {
+		m.ipLimitEvents.Inc()
+	}
+	m.ipLimitKicked.Add(float64(e.Kicked))
+}
+
+// gatherAgent 抓取时读取各组件状态
+func (m *AgentMetrics) gatherAgent(a *Agent) []metrics.Family {
+	up := 0.0
+	if a.manager.IsRunning() {
+		up = 1
+	}
+
+	families := []metrics.Family{
+		gauge("otun_singbox_up", "Whether the sing-box process is running.", up),
+		gauge("otun_singbox_restart_count", "Consecutive sing-box crash restarts.",
+			float64(a.manager.GetRestartCount())),
+		gauge("otun_quota_monitored_users", "Users currently tracked by the quota monitor.",
+			float64(a.monitor.GetUserCount())),
+		gauge("otun_ip_limited_users", "Users with a max_ips limit.",
+			float64(a.ipLimiter.GetLimitedUserCount())),
+		gauge("otun_stats_cache_backlog", "Stats reports cached locally waiting to be sent.",
+			float64(a.reporter.GetCacheCount())),
+		gauge("otun_stats_journal_bytes", "Size of the pending stats journal.",
+			float64(a.reporter.Journal().Size())),
+		{
+			Name:    "otun_stats_journal_dropped_total",
+			Help:    "Stats reports dropped because the journal was full.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(a.reporter.Journal().Dropped())}},
+		},
+	}
+
+	// 推送通道状态（未启用时不输出）
+	if a.push != nil {
+		connected := 0.0
+		if a.push.Connected() {
+			connected = 1
+		}
+		families = append(families, gauge("otun_push_connected",
+			"Whether the manager push channel is connected.", connected))
+	}
+
+	// 管理端熔断状态（仅远程/混合模式）
+	if a.cfg.ManagementMode != config.ModeLocal {
+		open := 0.0
+		if a.control.Breaker().Open() {
+			open = 1
+		}
+		families = append(families, gauge("otun_control_plane_circuit_open",
+			"Whether requests to the manager are short-circuited after repeated failures.", open))
+	}
+
+	// 证书过期时间（没有证书时不输出）
+	if expiresAt, err := config.NewCertManager(a.dataDir).ExpiresAt(); err == nil {
+		families = append(families, gauge("otun_cert_expiry_timestamp_seconds",
+			"Unix time when the TLS certificate expires.", float64(expiresAt.Unix())))
+	}
+
+	return families
+}
+
+// gatherConnections 按用户和 inbound 统计活跃连接
+func (m *AgentMetrics) gatherConnections(a *Agent) []metrics.Family {
+	connections, err := a.connMgr.GetActiveConnections()
+	if err != nil {
+		return nil
+	}
+
+	type key struct{ user, inbound string }
+	counts := make(map[key]int)
+	for i := range connections {
+		k := key{inbound: connections[i].InboundTag()}
+		if m.perUser {
+			k.user = connections[i].Metadata.User
+		}
+		counts[k]++
+	}
+
+	f := metrics.Family{
+		Name: "otun_active_connections",
+		Help: "Active connections reported by sing-box.",
+		Type: metrics.TypeGauge,
+	}
+	for k, n := range counts {
+		labels := map[string]string{"inbound": k.inbound}
+		if m.perUser {
+			labels["user"] = k.user
+		}
+		f.Samples = append(f.Samples, metrics.Sample{Labels: labels, Value: float64(n)})
+	}
+	return []metrics.Family{f}
+}
+
+// gatherJobs 定时任务运行统计
+func (m *AgentMetrics) gatherJobs(a *Agent) []metrics.Family {
+	runs := metrics.Family{Name: "otun_job_runs_total", Help: "Scheduled job runs.", Type: metrics.TypeCounter}
+	failures := metrics.Family{Name: "otun_job_failures_total", Help: "Scheduled job runs that returned an error.", Type: metrics.TypeCounter}
+	duration := metrics.Family{Name: "otun_job_last_duration_seconds", Help: "Duration of the last run of each job.", Type: metrics.TypeGauge}
+	lastRun := metrics.Family{Name: "otun_job_last_run_timestamp_seconds", Help: "Unix time when each job last started.", Type: metrics.TypeGauge}
+	running := metrics.Family{Name: "otun_job_running", Help: "Whether each job is currently running.", Type: metrics.TypeGauge}
+
+	for _, s := range a.scheduler.Stats() {
+		labels := map[string]string{"job": s.Name}
+		runs.Samples = append(runs.Samples, metrics.Sample{Labels: labels, Value: float64(s.Runs)})
+		failures.Samples = append(failures.Samples, metrics.Sample{Labels: labels, Value: float64(s.Failures)})
+		duration.Samples = append(duration.Samples, metrics.Sample{Labels: labels, Value: s.LastDuration.Seconds()})
+		if !s.LastRun.IsZero() {
+			lastRun.Samples = append(lastRun.Samples, metrics.Sample{Labels: labels, Value: float64(s.LastRun.Unix())})
+		}
+		isRunning := 0.0
+		if s.Running {
+			isRunning = 1
+		}
+		running.Samples = append(running.Samples, metrics.Sample{Labels: labels, Value: isRunning})
+	}
+
+	return []metrics.Family{runs, failures, duration, lastRun, running}
+}
+
+// gauge 构造单值 gauge
+func gauge(name, help string, value float64) metrics.Family {
+	return metrics.Family{
+		Name:    name,
+		Help:    help,
+		Type:    metrics.TypeGauge,
+		Samples: []metrics.Sample{{Value: value}},
+	}
+}
@@ -1,23 +1,25 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"otun-node-agent/internal/client"
 	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/controlplane"
 )
 
 // MultiProtocolContext 多协议上下文
 type MultiProtocolContext struct {
-	NodeConfig   *client.NodeConfigResponse
-	CertManager  *config.CertManager
-	TLSClient    *client.TLSClient
-	Generator    *config.MultiProtocolGenerator
+	NodeConfig  *client.NodeConfigResponse
+	CertManager *config.CertManager
+	TLSClient   *client.TLSClient
 }
 
-// initMultiProtocol 初始化多协议模式
+// initMultiProtocol 初始化多协议模式（remote / hybrid 模式）
 // 优先使用本地环境变量配置（真实来源原则），manager 配置作为参考
-func (a *Agent) initMultiProtocol(dataDir string) (*MultiProtocolContext, error) {
+// 获取到的证书和端口直接应用到 Agent 共用的配置生成器上
+func (a *Agent) initMultiProtocol(ctx context.Context, dataDir string) (*MultiProtocolContext, error) {
 	log.Println("[MultiProtocol] Checking local multi-protocol configuration...")
 
 	// 1. 首先检查本地环境变量是否配置了多协议端口
@@ -35,8 +37,8 @@ func (a *Agent) initMultiProtocol(dataDir string) (*MultiProtocolContext, error)
 
 	// 2. 从 manager 获取节点配置（主要获取 TLS 服务 URL 等信息）
 	log.Println("[MultiProtocol] Fetching node configuration from manager...")
-	managerClient := client.NewManagerClient(a.cfg.APIURL, a.cfg.NodeAPIKey)
-	nodeConfig, err := managerClient.GetNodeConfig()
+	managerClient := client.NewManagerClient(a.control)
+	nodeConfig, err := managerClient.GetNodeConfig(ctx)
 	if err != nil {
 		log.Printf("[MultiProtocol] Warning: Failed to get config from manager: %v", err)
 		// 即使 manager 不可用，也尝试使用本地配置继续
@@ -88,51 +90,55 @@ func (a *Agent) initMultiProtocol(dataDir string) (*MultiProtocolContext, error)
 			apiKey = a.cfg.NodeAPIKey // 回退使用节点 API Key
 		}
 
-		tlsClient = client.NewTLSClient(nodeConfig.TLSServiceURL, apiKey)
+		tlsClient = client.NewTLSClient(controlplane.New(controlplane.Options{
+			BaseURL: nodeConfig.TLSServiceURL,
+			APIKey:  apiKey,
+			NodeID:  a.cfg.NodeID,
+			Version: agentVersion,
+			Timeout: client.TLSTimeout,
+		}))
 
 		// 检查是否已有证书
 		if !certManager.HasValidCert() {
 			log.Println("[MultiProtocol] Fetching TLS certificate...")
-			if err := certManager.FetchAndSaveCert(tlsClient, nodeConfig.VpnDomain); err != nil {
+			if err := certManager.FetchAndSaveCert(ctx, tlsClient, nodeConfig.VpnDomain); err != nil {
 				log.Printf("[MultiProtocol] Warning: Failed to fetch certificate: %v", err)
-				log.Println("[MultiProtocol] TLS protocols will be disabled")
-				// 清除 TLS 协议，只保留基础协议
-				nodeConfig.VmessPort = 0
-				nodeConfig.TrojanPort = 0
-				nodeConfig.Hysteria2Port = 0
-				nodeConfig.TuicPort = 0
+				// 保留端口：没有证书时生成器不会输出 TLS inbound，
+				// 证书检查任务会继续续期，拿到有效证书后自动启用
+				log.Println("[MultiProtocol] TLS protocols disabled until a valid certificate is available")
 			}
 		} else {
 			log.Println("[MultiProtocol] Using existing TLS certificate")
 		}
 	}
 
-	// 6. 创建多协议生成器
-	certPath := ""
-	keyPath := ""
+	// 6. 将端口和证书应用到配置生成器
+	a.generator.SetPort("vmess", nodeConfig.VmessPort)
+	a.generator.SetPort("trojan", nodeConfig.TrojanPort)
+	a.generator.SetPort("hysteria2", nodeConfig.Hysteria2Port)
+	a.generator.SetPort("tuic", nodeConfig.TuicPort)
 	if certManager.HasValidCert() {
-		certPath = certManager.GetCertPath()
-		keyPath = certManager.GetKeyPath()
+		a.generator.SetTLS(nodeConfig.VpnDomain, certManager.GetCertPath(), certManager.GetKeyPath())
+	} else {
+		a.generator.SetTLS(nodeConfig.VpnDomain, "", "")
 	}
 
-	generator := config.NewMultiProtocolGenerator(
-		nodeConfig,
-		a.secrets.PrivateKey,
-		a.secrets.ShortIDs,
-		certPath,
-		keyPath,
-	)
+	log.Printf("[MultiProtocol] Enabled inbounds: %v", a.generator.EnabledProtocols())
 
 	return &MultiProtocolContext{
 		NodeConfig:  nodeConfig,
 		CertManager: certManager,
 		TLSClient:   tlsClient,
-		Generator:   generator,
 	}, nil
 }
 
-// generateMultiProtocolConfig 使用多协议生成器生成配置
-func (a *Agent) generateMultiProtocolConfig(ctx *MultiProtocolContext, users []config.User, circuitBreakerEnabled bool) error {
-	singboxCfg := ctx.Generator.Generate(users, circuitBreakerEnabled)
-	return ctx.Generator.WriteToFile(singboxCfg, a.cfg.SingboxConfig)
+// realitySNI 选择 Reality SNI：同步响应优先，其次是 manager 节点配置
+func (a *Agent) realitySNI(syncSNI string) string {
+	if syncSNI != "" {
+		return syncSNI
+	}
+	if a.multiProto != nil && a.multiProto.NodeConfig.RealitySNI != "" {
+		return a.multiProto.NodeConfig.RealitySNI
+	}
+	return config.DefaultRealitySNI
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"otun-node-agent/internal/config"
+)
+
+// RealityStatus 返回当前 Reality 密钥和轮换状态
+func (a *Agent) RealityStatus() *config.RealityStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.secrets.Status()
+}
+
+// StartRealityRotation 开始 Reality 密钥轮换（本地 API 与管理端指令共用）
+// switchAfter/overlap 为 0 时使用默认值
+func (a *Agent) StartRealityRotation(ctx context.Context, switchAfter, overlap time.Duration) (*config.RealityStatus, error) {
+	if switchAfter <= 0 {
+		switchAfter = config.DefaultRealitySwitchAfter
+	}
+	if overlap <= 0 {
+		overlap = config.DefaultRealityOverlap
+	}
+
+	a.mu.Lock()
+	next := a.secrets.Clone()
+	if err := next.StartRotation(time.Now(), switchAfter, overlap); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	if err := config.SaveSecrets(a.dataDir, next); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	a.secrets = next
+	status := next.Status()
+	a.mu.Unlock()
+
+	log.Printf("[Reality] Rotation started: new short_id %s, key switch at %s",
+		status.ShortIDs[0], status.SwitchAt.Format(time.RFC3339))
+
+	a.applyRealityChange(ctx)
+	return status, nil
+}
+
+// advanceRealityRotation 推进到期的轮换步骤（定时调用）
+func (a *Agent) advanceRealityRotation(ctx context.Context) {
+	a.mu.Lock()
+	if a.secrets.Rotation == nil {
+		a.mu.Unlock()
+		return
+	}
+	next := a.secrets.Clone()
+	if !next.AdvanceRotation(time.Now()) {
+		a.mu.Unlock()
+		return
+	}
+	if err := config.SaveSecrets(a.dataDir, next); err != nil {
+		a.mu.Unlock()
+		log.Printf("[Reality] Failed to save rotated secrets, will retry: %v", err)
+		return
+	}
+	a.secrets = next
+	status := next.Status()
+	a.mu.Unlock()
+
+	if status.Rotating {
+		log.Printf("[Reality] Switched to new key %s, retiring short_ids %v at %s",
+			status.PublicKey, status.RetiringShortIDs, status.RetireAt.Format(time.RFC3339))
+	} else {
+		log.Printf("[Reality] Rotation complete, active short_ids: %v", status.ShortIDs)
+	}
+
+	a.applyRealityChange(ctx)
+}
+
+// handleRotateCommand 处理管理端下发的轮换指令
+func (a *Agent) handleRotateCommand(ctx context.Context, cmd *config.RealityRotateCommand) {
+	log.Println("[Reality] Manager requested key rotation")
+	_, err := a.StartRealityRotation(ctx,
+		time.Duration(cmd.SwitchAfter)*time.Second,
+		time.Duration(cmd.Overlap)*time.Second,
+	)
+	if errors.Is(err, config.ErrRotationInProgress) {
+		log.Println("[Reality] Rotation already in progress, ignoring command")
+	} else if err != nil {
+		log.Printf("[Reality] Failed to start rotation: %v", err)
+	}
+}
+
+// applyRealityChange 将新密钥应用到 sing-box 配置和分享链接，并向管理服务器重新注册
+func (a *Agent) applyRealityChange(ctx context.Context) {
+	a.mu.RLock()
+	privateKey := a.secrets.PrivateKey
+	publicKey := a.secrets.PublicKey
+	shortIDs := append([]string(nil), a.secrets.ShortIDs...)
+	a.mu.RUnlock()
+
+	a.generator.SetReality(privateKey, shortIDs)
+	if a.localAPI != nil {
+		a.localAPI.SetReality(publicKey, shortIDs[0])
+	}
+
+	if err := a.reapplyConfig(); err != nil {
+		log.Printf("[Reality] Failed to apply config: %v", err)
+	}
+
+	if a.cfg.ManagementMode != config.ModeLocal {
+		if err := a.register(ctx); err != nil {
+			log.Printf("[Reality] Failed to report new keys to manager: %v", err)
+		}
+	}
+}
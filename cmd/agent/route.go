@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"otun-node-agent/internal/config"
+)
+
+// loadRoutePolicy 本地路由策略：设置了 ROUTE_POLICY_FILE 时使用文件，否则使用环境变量
+// 本地策略无效时拒绝启动，避免以用户可访问内网的配置运行
+func loadRoutePolicy(cfg *config.AgentConfig) (config.RoutePolicy, error) {
+	policy := cfg.RoutePolicy
+	if cfg.RoutePolicyFile != "" {
+		p, err := config.LoadRoutePolicy(cfg.RoutePolicyFile)
+		if err != nil {
+			return policy, err
+		}
+		policy = *p
+	}
+	if err := policy.Validate(); err != nil {
+		return policy, fmt.Errorf("invalid route policy: %w", err)
+	}
+	logRoutePolicy("local", &policy)
+	return policy, nil
+}
+
+// applyRoutePolicy 设置生成器的路由策略：管理端下发的策略优先，无效或未下发时使用本地策略
+// 在生成配置前调用
+func (a *Agent) applyRoutePolicy(override *config.RoutePolicy) {
+	policy, source := a.cfg.RoutePolicy, "local"
+	if override != nil {
+		if err := override.Validate(); err != nil {
+			log.Printf("[Route] Ignoring invalid route policy from manager, using local policy: %v", err)
+		} else {
+			policy, source = *override, "manager"
+		}
+	}
+	if a.generator.SetRoutePolicy(policy) {
+		logRoutePolicy(source, &policy)
+	}
+}
+
+func logRoutePolicy(source string, p *config.RoutePolicy) {
+	log.Printf("[Route] Using %s route policy: block_private=%v block_bittorrent=%v sniff=%v domains=%d ips=%d rule_sets=%d",
+		source, !p.AllowPrivate, p.BlockBitTorrent, p.Sniff || p.BlockBitTorrent,
+		len(p.BlockDomains), len(p.BlockIPs), len(p.RuleSets))
+	if p.AllowPrivate {
+		log.Println("[Route] WARNING: private network protection is disabled, users can reach this node's local services and private networks")
+	}
+}
@@ -6,18 +6,18 @@ toolchain go1.24.12
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/v2fly/v2ray-core/v5 v5.44.1
 	golang.org/x/crypto v0.47.0
+	google.golang.org/grpc v1.78.0
 )
 
 require (
 	github.com/adrg/xdg v0.5.3 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/pires/go-proxyproto v0.8.1 // indirect
-	github.com/v2fly/v2ray-core/v5 v5.44.1 // indirect
 	golang.org/x/net v0.49.0 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/text v0.33.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251029180050-ab9386a59fda // indirect
-	google.golang.org/grpc v1.78.0 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
 )
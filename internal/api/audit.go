@@ -0,0 +1,109 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"otun-node-agent/internal/audit"
+)
+
+// maxAuditLimit 审计查询单次最多返回的记录数
+const maxAuditLimit = 1000
+
+// SetAuditLog 设置审计日志
+func (s *LocalAPIServer) SetAuditLog(l *audit.Log) {
+	s.audit = l
+}
+
+// record 记录一次修改操作；before/after 为修改前后的对象（创建时 before 为 nil，删除时 after 为 nil）
+// 写入失败只记录日志，不影响已经完成的操作
+func (s *LocalAPIServer) record(r *http.Request, action, target string, before, after any, detail map[string]any) {
+	if s.audit == nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:     time.Now().UTC(),
+		Actor:    APIKeyName(r.Context()),
+		ClientIP: clientIP(r),
+		Action:   action,
+		Target:   target,
+		Changes:  audit.Diff(before, after),
+		Detail:   detail,
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Printf("[Audit] Failed to record %s %s: %v", action, target, err)
+	}
+}
+
+// clientIP 请求来源地址（直接连接的对端；经反向代理时为代理地址）
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// handleAudit 查询审计日志
+// GET /api/local/audit?since=RFC3339&until=RFC3339&user=UUID&actor=NAME&action=ACTION&limit=100
+func (s *LocalAPIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.audit == nil {
+		s.jsonError(w, http.StatusServiceUnavailable, "audit log not available")
+		return
+	}
+
+	values := r.URL.Query()
+	q := audit.Query{
+		Target: values.Get("user"),
+		Actor:  values.Get("actor"),
+		Action: values.Get("action"),
+		Limit:  100,
+	}
+	if q.Target == "" {
+		q.Target = values.Get("target")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := values.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				s.jsonError(w, http.StatusBadRequest, "invalid "+p.name+": expected RFC3339 time")
+				return
+			}
+			*p.dst = t
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			s.jsonError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit))
+			return
+		}
+		q.Limit = limit
+	}
+
+	entries, err := s.audit.Query(q)
+	if err != nil {
+		s.jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+
+	s.jsonSuccess(w, map[string]any{
+		"entries": entries,
+		"total":   len(entries),
+	})
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"otun-node-agent/internal/local"
+)
+
+// maxBulkBody 导入和批量操作请求体上限
+const maxBulkBody = 32 << 20
+
+// maxBatchOps 单次批量操作的最大数量
+const maxBatchOps = 5000
+
+// exportFile JSON 导出格式（导入时同样接受，也接受直接的用户数组）
+type exportFile struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	NodeID     string            `json:"node_id,omitempty"`
+	Users      []local.LocalUser `json:"users"`
+}
+
+// handleExport 导出全部用户 GET /api/local/users/export?format=json|csv
+func (s *LocalAPIServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	page, err := s.store.QueryUsers(local.UserQuery{})
+	if err != nil {
+		s.jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	filename := "users-" + now.Format("20060102-150405")
+
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		var buf bytes.Buffer
+		if err := local.WriteUsersCSV(&buf, page.Users); err != nil {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+		w.Write(buf.Bytes())
+	case "", "json":
+		file := exportFile{ExportedAt: now, Users: page.Users}
+		if node := s.node(); node != nil {
+			file.NodeID = node.NodeID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		json.NewEncoder(w).Encode(file)
+	default:
+		s.jsonError(w, http.StatusBadRequest, "unsupported format: "+r.URL.Query().Get("format"))
+	}
+}
+
+// handleImport 导入用户 POST /api/local/users/import?format=json|csv&on_conflict=error|skip|overwrite
+// 未指定 format 时按 Content-Type 判断
+func (s *LocalAPIServer) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBulkBody))
+	if err != nil {
+		s.jsonError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		format = "csv"
+	}
+
+	var users []local.LocalUser
+	switch format {
+	case "csv":
+		users, err = local.ReadUsersCSV(bytes.NewReader(body))
+	case "", "json":
+		users, err = decodeImportJSON(body)
+	default:
+		s.jsonError(w, http.StatusBadRequest, "unsupported format: "+format)
+		return
+	}
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, "invalid import data: "+err.Error())
+		return
+	}
+
+	onConflict := local.ConflictPolicy(r.URL.Query().Get("on_conflict"))
+	result, err := s.store.ImportUsers(users, onConflict)
+	if err != nil {
+		if strings.Contains(err.Error(), "save users") {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			s.jsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	// 每个新建或覆盖的用户单独记录修改前后的差异，汇总记录保留导入参数和数量
+	for _, c := range result.Changes {
+		action := "user.create"
+		if c.Before != nil {
+			action = "user.overwrite"
+		}
+		s.record(r, action, c.After.UUID, c.Before, c.After, map[string]any{"import": true})
+	}
+	s.record(r, "users.import", "", nil, nil, map[string]any{
+		"format":      format,
+		"on_conflict": onConflict,
+		"created":     result.Created,
+		"updated":     result.Updated,
+		"skipped":     result.Skipped,
+	})
+	s.jsonSuccess(w, result)
+}
+
+// decodeImportJSON 接受导出文件格式 {"users": [...]} 或直接的用户数组
+func decodeImportJSON(body []byte) ([]local.LocalUser, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var users []local.LocalUser
+		err := json.Unmarshal(body, &users)
+		return users, err
+	}
+
+	var file exportFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return nil, err
+	}
+	return file.Users, nil
+}
+
+// handleBatch 批量创建/更新/删除 POST /api/local/users/batch
+// 所有操作在一个事务中生效，只触发一次配置重新生成
+func (s *LocalAPIServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		Operations []local.BatchOp `json:"operations"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBody)).Decode(&req); err != nil {
+		s.jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(req.Operations) == 0 {
+		s.jsonError(w, http.StatusBadRequest, "operations is required")
+		return
+	}
+	if len(req.Operations) > maxBatchOps {
+		s.jsonError(w, http.StatusBadRequest, fmt.Sprintf("at most %d operations per batch", maxBatchOps))
+		return
+	}
+
+	// 记录修改前的状态用于审计
+	before := make([]*local.LocalUser, len(req.Operations))
+	for i, op := range req.Operations {
+		if op.UUID != "" {
+			before[i], _ = s.store.GetUser(op.UUID)
+		}
+	}
+
+	result, err := s.store.Batch(req.Operations)
+	if err != nil {
+		var batchErr *local.BatchError
+		switch {
+		case errors.As(err, &batchErr) && strings.Contains(batchErr.Err.Error(), "not found"):
+			s.jsonError(w, http.StatusNotFound, err.Error())
+		case errors.As(err, &batchErr):
+			s.jsonError(w, http.StatusBadRequest, err.Error())
+		default:
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	results := make([]any, len(result.Users))
+	for i, u := range result.Users {
+		op := req.Operations[i]
+		target := op.UUID
+		if u != nil {
+			target = u.UUID
+		}
+		s.record(r, "user."+op.Op, target, before[i], u, map[string]any{"batch_index": i})
+
+		if u == nil {
+			results[i] = map[string]any{"op": req.Operations[i].Op, "uuid": req.Operations[i].UUID}
+			continue
+		}
+		results[i] = s.toUserResponse(u)
+	}
+
+	s.jsonSuccess(w, map[string]any{
+		"results": results,
+		"total":   len(results),
+	})
+}
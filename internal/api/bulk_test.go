@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otun-node-agent/internal/audit"
+	"otun-node-agent/internal/local"
+)
+
+func TestExportImportCSVRoundTrip(t *testing.T) {
+	_, store, mux := newTestAPI(t)
+	user, err := store.CreateUser(&local.CreateUserRequest{Name: "alice", Protocols: []string{"vless"}, TrafficLimit: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(mux, testNodeKey, http.MethodGet, "/api/local/users/export?format=csv", nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("export: status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	exported := rec.Body.String()
+	records, err := csv.NewReader(strings.NewReader(exported)).ReadAll()
+	if err != nil || len(records) != 2 || records[1][0] != user.UUID {
+		t.Fatalf("export = %q (%v), want header and one user", exported, err)
+	}
+
+	// 导入到另一个节点，通过 Content-Type 识别 CSV
+	_, other, otherMux := newTestAPI(t)
+	rec = doWithType(otherMux, http.MethodPost, "/api/local/users/import", "text/csv", strings.NewReader(exported))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import: status = %d: %s", rec.Code, rec.Body)
+	}
+	got, ok := other.GetUser(user.UUID)
+	if !ok || got.Name != "alice" || got.TrafficLimit != 1<<30 || got.SubToken != user.SubToken {
+		t.Fatalf("imported user = %+v", got)
+	}
+
+	// 默认冲突策略为 error，整个导入失败
+	rec = doWithType(otherMux, http.MethodPost, "/api/local/users/import", "text/csv", strings.NewReader(exported))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("conflicting import: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestImportAuditsEachUser(t *testing.T) {
+	s, store, mux := newTestAPI(t)
+	auditLog := audit.NewLog(t.TempDir(), 0, 0)
+	s.SetAuditLog(auditLog)
+	existing, err := store.CreateUser(&local.CreateUserRequest{Name: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `[{"uuid":"` + existing.UUID + `","name":"renamed","enabled":true},{"name":"new","enabled":true}]`
+	rec := do(mux, testNodeKey, http.MethodPost, "/api/local/users/import?on_conflict=overwrite", strings.NewReader(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	entries, err := auditLog.Query(audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make(map[string]int)
+	for _, e := range entries {
+		if e.Action == "user.overwrite" && (e.Target != existing.UUID || e.Changes["name"].After == nil) {
+			t.Fatalf("overwrite entry = %+v, want the name change of the existing user", e)
+		}
+		actions[e.Action]++
+	}
+	if actions["user.overwrite"] != 1 || actions["user.create"] != 1 || actions["users.import"] != 1 {
+		t.Fatalf("audit actions = %v, want one overwrite, one create and the summary", actions)
+	}
+}
+
+func TestImportRejectsUnknownFormat(t *testing.T) {
+	_, _, mux := newTestAPI(t)
+	for _, target := range []string{
+		"/api/local/users/import?format=xml",
+		"/api/local/users/import?on_conflict=merge",
+	} {
+		rec := do(mux, testNodeKey, http.MethodPost, target, strings.NewReader(`[]`))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+// doWithType 使用节点密钥发送指定 Content-Type 的请求
+func doWithType(mux *http.ServeMux, method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+testNodeKey)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
@@ -8,8 +8,9 @@ import (
 
 // HealthServer 提供健康检查接口
 type HealthServer struct {
-	startTime time.Time
-	isHealthy func() bool
+	startTime    time.Time
+	isHealthy    func() bool
+	configStatus func() (lastError string, rolledBack bool)
 }
 
 // NewHealthServer 创建健康检查服务
@@ -20,6 +21,11 @@ func NewHealthServer(isHealthy func() bool) *HealthServer {
 	}
 }
 
+// SetConfigStatus 设置配置应用状态来源（最近一次失败信息）
+func (s *HealthServer) SetConfigStatus(fn func() (lastError string, rolledBack bool)) {
+	s.configStatus = fn
+}
+
 // Start 启动健康检查 HTTP 服务
 func (s *HealthServer) Start(addr string) error {
 	mux := http.NewServeMux()
@@ -46,13 +52,26 @@ func (s *HealthServer) HandleHealth(w http.ResponseWriter, r *http.Request) {
 		code = http.StatusServiceUnavailable
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]any{
+	resp := map[string]any{
 		"status":  status,
 		"uptime":  time.Since(s.startTime).String(),
 		"version": "1.1.0",
-	})
+	}
+
+	// 配置应用失败：sing-box 仍在运行（旧配置或 last-good），标记为 degraded
+	if s.configStatus != nil {
+		if lastError, rolledBack := s.configStatus(); lastError != "" {
+			if code == http.StatusOK {
+				resp["status"] = "degraded"
+			}
+			resp["config_error"] = lastError
+			resp["config_rolled_back"] = rolledBack
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
 }
 
 // HandleReady 处理就绪检查请求
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"otun-node-agent/internal/history"
+)
+
+// SetHistory 设置流量历史
+func (s *LocalAPIServer) SetHistory(h *history.Store) {
+	s.history = h
+}
+
+// trafficWindow 统计接口中的最近流量
+type trafficWindow struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// recentTraffic 某条序列最近 24 小时和 30 天的流量
+func (s *LocalAPIServer) recentTraffic(kind, name string, now time.Time) map[string]trafficWindow {
+	result := make(map[string]trafficWindow, 2)
+	for label, d := range map[string]time.Duration{"last_24h": 24 * time.Hour, "last_30d": 30 * 24 * time.Hour} {
+		up, down := s.history.Total(kind, name, now.Add(-d), now)
+		result[label] = trafficWindow{Upload: up, Download: down}
+	}
+	return result
+}
+
+// handleStats 流量统计：每个用户的已用流量和限额；有历史数据时附带最近 24 小时 / 30 天的流量，
+// 以及节点合计和每个 inbound 的流量
+func (s *LocalAPIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	users := s.store.ListUsers()
+	now := time.Now()
+
+	stats := make([]map[string]any, 0, len(users))
+	for _, u := range users {
+		entry := map[string]any{
+			"uuid":          u.UUID,
+			"name":          u.Name,
+			"traffic_used":  u.TrafficUsed,
+			"traffic_limit": u.TrafficLimit,
+		}
+		if s.history != nil {
+			entry["recent"] = s.recentTraffic(history.KindUser, u.UUID, now)
+		}
+		stats = append(stats, entry)
+	}
+
+	resp := map[string]any{
+		"stats": stats,
+	}
+	if s.history != nil {
+		inbounds := make([]map[string]any, 0)
+		for _, tag := range s.history.Names(history.KindInbound) {
+			inbounds = append(inbounds, map[string]any{
+				"tag":    tag,
+				"recent": s.recentTraffic(history.KindInbound, tag, now),
+			})
+		}
+		resp["node"] = map[string]any{
+			"recent": s.recentTraffic(history.KindNode, "", now),
+		}
+		resp["inbounds"] = inbounds
+	}
+
+	s.jsonSuccess(w, resp)
+}
+
+// handleStatsHistory 查询流量历史
+// GET /api/local/stats/history?uuid=&inbound=&from=RFC3339&to=RFC3339&step=hour|day|month&format=json|csv
+// uuid 和 inbound 都为空时返回节点合计；step 为空时按 from 自动选择
+func (s *LocalAPIServer) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.history == nil {
+		s.jsonError(w, http.StatusServiceUnavailable, "traffic history not available")
+		return
+	}
+
+	values := r.URL.Query()
+	q := history.Query{Kind: history.KindNode}
+	switch uuid, inbound := values.Get("uuid"), values.Get("inbound"); {
+	case uuid != "" && inbound != "":
+		s.jsonError(w, http.StatusBadRequest, "uuid and inbound are mutually exclusive")
+		return
+	case uuid != "":
+		q.Kind, q.Name = history.KindUser, uuid
+	case inbound != "":
+		q.Kind, q.Name = history.KindInbound, inbound
+	}
+
+	step, err := history.ParseStep(values.Get("step"))
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Step = step
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := values.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				s.jsonError(w, http.StatusBadRequest, "invalid "+p.name+": expected RFC3339 time")
+				return
+			}
+			*p.dst = t
+		}
+	}
+
+	// 查询只会因为参数不合理失败（范围颠倒或时间段过多）
+	result, err := s.history.Query(q, time.Now())
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch values.Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+			"traffic-"+result.From.Format("20060102")+"-"+string(result.Step)+".csv"))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "upload", "download"})
+		for _, b := range result.Buckets {
+			cw.Write([]string{
+				b.Time.Format(time.RFC3339),
+				strconv.FormatInt(b.Upload, 10),
+				strconv.FormatInt(b.Download, 10),
+			})
+		}
+		cw.Flush()
+	case "", "json":
+		s.jsonSuccess(w, map[string]any{
+			"kind":     q.Kind,
+			"name":     q.Name,
+			"step":     result.Step,
+			"from":     result.From,
+			"to":       result.To,
+			"upload":   result.Upload,
+			"download": result.Download,
+			"buckets":  result.Buckets,
+		})
+	default:
+		s.jsonError(w, http.StatusBadRequest, "unsupported format: "+values.Get("format"))
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"otun-node-agent/internal/history"
+)
+
+func newHistoryAPI(t *testing.T) (*http.ServeMux, time.Time) {
+	t.Helper()
+	s, _, mux := newTestAPI(t)
+	h, err := history.Open(t.TempDir(), history.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetHistory(h)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	h.Add(hour, []history.Sample{{Kind: history.KindUser, Name: "u1", Upload: 100, Download: 1000}})
+	h.Add(hour.Add(time.Hour), []history.Sample{{Kind: history.KindUser, Name: "u1", Upload: 10, Download: 20}})
+	h.Add(hour.Add(time.Hour), []history.Sample{{Kind: history.KindInbound, Name: "vless-in", Upload: 7, Download: 8}})
+	return mux, hour
+}
+
+func TestStatsHistoryJSON(t *testing.T) {
+	mux, hour := newHistoryAPI(t)
+
+	q := url.Values{"uuid": {"u1"}, "step": {"hour"}, "from": {hour.Format(time.RFC3339)}}
+	rec := do(mux, testNodeKey, http.MethodGet, "/api/local/stats/history?"+q.Encode(), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Kind     string           `json:"kind"`
+		Name     string           `json:"name"`
+		Step     string           `json:"step"`
+		Upload   int64            `json:"upload"`
+		Download int64            `json:"download"`
+		Buckets  []history.Bucket `json:"buckets"`
+	}
+	decodeJSON(t, rec, &resp)
+	if resp.Kind != history.KindUser || resp.Name != "u1" || resp.Step != "hour" {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if resp.Upload != 110 || resp.Download != 1020 {
+		t.Fatalf("totals = %d/%d, want 110/1020", resp.Upload, resp.Download)
+	}
+	if len(resp.Buckets) != 3 || !resp.Buckets[0].Time.Equal(hour) || resp.Buckets[0].Upload != 100 || resp.Buckets[2].Upload != 0 {
+		t.Fatalf("buckets = %+v, want three hours starting at %s", resp.Buckets, hour)
+	}
+
+	// 不指定 uuid 和 inbound 时为节点合计（只包含用户流量）
+	q.Del("uuid")
+	rec = do(mux, testNodeKey, http.MethodGet, "/api/local/stats/history?"+q.Encode(), nil)
+	decodeJSON(t, rec, &resp)
+	if resp.Kind != history.KindNode || resp.Upload != 110 {
+		t.Fatalf("node history = %+v", resp)
+	}
+}
+
+func TestStatsHistoryCSV(t *testing.T) {
+	mux, hour := newHistoryAPI(t)
+
+	q := url.Values{"inbound": {"vless-in"}, "step": {"day"}, "format": {"csv"}, "from": {hour.Format(time.RFC3339)}}
+	rec := do(mux, testNodeKey, http.MethodGet, "/api/local/stats/history?"+q.Encode(), nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "-day.csv") {
+		t.Fatalf("content disposition = %q", rec.Header().Get("Content-Disposition"))
+	}
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var up, down string
+	for _, r := range records[1:] {
+		if r[1] != "0" {
+			up, down = r[1], r[2]
+		}
+	}
+	if strings.Join(records[0], ",") != "time,upload,download" || up != "7" || down != "8" {
+		t.Fatalf("csv = %v, want header and the inbound traffic", records)
+	}
+}
+
+func TestStatsHistoryRejectsInvalidQuery(t *testing.T) {
+	mux, _ := newHistoryAPI(t)
+	for _, q := range []string{
+		"step=week",
+		"format=xml",
+		"from=yesterday",
+		"uuid=u1&inbound=vless-in",
+		"from=2030-01-02T00:00:00Z&to=2030-01-01T00:00:00Z",
+		"step=hour&from=2000-01-01T00:00:00Z",
+	} {
+		rec := do(mux, testNodeKey, http.MethodGet, "/api/local/stats/history?"+q, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", q, rec.Code)
+		}
+	}
+}
+
+func TestStatsHistoryUnavailable(t *testing.T) {
+	_, _, mux := newTestAPI(t)
+	rec := do(mux, testNodeKey, http.MethodGet, "/api/local/stats/history", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 without history", rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"otun-node-agent/internal/local"
+)
+
+// apiKeyResponse API Key 信息（不含哈希）
+type apiKeyResponse struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Hint      string        `json:"hint"`
+	Scopes    []local.Scope `json:"scopes"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	Expired   bool          `json:"expired"`
+	CreatedAt time.Time     `json:"created_at"`
+	Key       string        `json:"key,omitempty"` // 明文，只在创建时返回
+}
+
+func toAPIKeyResponse(k *local.APIKey, now time.Time) apiKeyResponse {
+	return apiKeyResponse{
+		ID:        k.ID,
+		Name:      k.Name,
+		Hint:      k.Hint,
+		Scopes:    k.Scopes,
+		ExpiresAt: k.ExpiresAt,
+		Expired:   k.IsExpired(now),
+		CreatedAt: k.CreatedAt,
+	}
+}
+
+// handleKeys 处理 /api/local/keys
+func (s *LocalAPIServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		s.jsonError(w, http.StatusServiceUnavailable, "api key store not available")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		keys := s.keys.List()
+		response := make([]apiKeyResponse, 0, len(keys))
+		for i := range keys {
+			response = append(response, toAPIKeyResponse(&keys[i], now))
+		}
+		s.jsonSuccess(w, map[string]any{
+			"keys":  response,
+			"total": len(response),
+		})
+	case http.MethodPost:
+		s.createKey(w, r)
+	default:
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// createKey 创建 API Key
+func (s *LocalAPIServer) createKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string        `json:"name"`
+		Scopes        []local.Scope `json:"scopes"`
+		ExpiresAt     *time.Time    `json:"expires_at,omitempty"`
+		ExpiresInDays int           `json:"expires_in_days,omitempty"` // 与 expires_at 二选一
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := req.ExpiresAt
+	if req.ExpiresInDays < 0 {
+		s.jsonError(w, http.StatusBadRequest, "expires_in_days must not be negative")
+		return
+	}
+	if req.ExpiresInDays > 0 {
+		t := now.AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		s.jsonError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	key, secret, err := s.keys.Create(req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "save api keys") {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			s.jsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	s.record(r, "api_key.create", key.ID, nil, toAPIKeyResponse(key, now), nil)
+
+	resp := toAPIKeyResponse(key, now)
+	resp.Key = secret
+	s.jsonSuccess(w, resp)
+}
+
+// handleKeyByID 处理 /api/local/keys/{id}
+func (s *LocalAPIServer) handleKeyByID(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		s.jsonError(w, http.StatusServiceUnavailable, "api key store not available")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/local/keys/"), "/")
+	var before *apiKeyResponse
+	for _, k := range s.keys.List() {
+		if k.ID == id {
+			resp := toAPIKeyResponse(&k, time.Now())
+			before = &resp
+		}
+	}
+	if err := s.keys.Revoke(id); err != nil {
+		if errors.Is(err, local.ErrKeyNotFound) {
+			s.jsonError(w, http.StatusNotFound, err.Error())
+		} else {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.record(r, "api_key.revoke", id, before, nil, nil)
+	s.jsonSuccess(w, map[string]any{
+		"message": "api key revoked",
+		"id":      id,
+	})
+}
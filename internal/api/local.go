@@ -1,24 +1,41 @@
 package api
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
-	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"otun-node-agent/internal/audit"
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/history"
 	"otun-node-agent/internal/local"
 )
 
 // LocalAPIServer 本地管理 API 服务
 type LocalAPIServer struct {
-	store      *local.Store
-	apiKey     string
+	store   *local.Store
+	apiKey  string          // NODE_API_KEY，拥有全部权限
+	keys    *local.KeyStore // 带权限范围的 API Key（可为 nil）
+	audit   *audit.Log      // 修改操作审计日志（可为 nil）
+	history *history.Store  // 流量历史（可为 nil）
+	reality RealityRotator
+	enabled func() []string // 当前实际输出 inbound 的协议（可为 nil，表示按端口判断）
+
+	mu         sync.RWMutex
 	nodeConfig *NodeConfig
 }
 
+// RealityRotator Reality 密钥轮换（由 Agent 实现）
+type RealityRotator interface {
+	RealityStatus() *config.RealityStatus
+	StartRealityRotation(ctx context.Context, switchAfter, overlap time.Duration) (*config.RealityStatus, error)
+}
+
 // NodeConfig 节点配置信息
 type NodeConfig struct {
 	NodeID    string `json:"node_id"`
@@ -28,6 +45,34 @@ type NodeConfig struct {
 	VLESSPort int    `json:"vless_port"`
 	SSPort    int    `json:"ss_port"`
 	SSMethod  string `json:"ss_method"`
+
+	// 多协议（需要 TLS 证书），0 表示未启用
+	VmessPort     int    `json:"vmess_port,omitempty"`
+	TrojanPort    int    `json:"trojan_port,omitempty"`
+	Hysteria2Port int    `json:"hysteria2_port,omitempty"`
+	TuicPort      int    `json:"tuic_port,omitempty"`
+	VpnDomain     string `json:"vpn_domain,omitempty"`
+
+	SubBaseURL string `json:"sub_base_url,omitempty"` // 订阅地址前缀（对外可访问的 agent HTTP 地址）
+}
+
+// Port 获取协议端口
+func (c *NodeConfig) Port(protocol string) int {
+	switch protocol {
+	case "vless":
+		return c.VLESSPort
+	case "shadowsocks":
+		return c.SSPort
+	case "vmess":
+		return c.VmessPort
+	case "trojan":
+		return c.TrojanPort
+	case "hysteria2":
+		return c.Hysteria2Port
+	case "tuic":
+		return c.TuicPort
+	}
+	return 0
 }
 
 // NewLocalAPIServer 创建本地 API 服务
@@ -39,24 +84,102 @@ func NewLocalAPIServer(store *local.Store, apiKey string, nodeConfig *NodeConfig
 	}
 }
 
+// SetRealityRotator 设置 Reality 密钥轮换处理器
+func (s *LocalAPIServer) SetRealityRotator(r RealityRotator) {
+	s.reality = r
+}
+
+// SetEnabledProtocols 设置当前启用协议的查询函数
+// 分享链接和订阅只包含已启用的协议（例如没有有效证书时不包含 TLS 协议）
+func (s *LocalAPIServer) SetEnabledProtocols(fn func() []string) {
+	s.enabled = fn
+}
+
+// SetKeyStore 设置 API Key 存储
+func (s *LocalAPIServer) SetKeyStore(keys *local.KeyStore) {
+	s.keys = keys
+}
+
+// SetReality 密钥轮换后更新分享链接使用的公钥和 short_id
+func (s *LocalAPIServer) SetReality(publicKey, shortID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodeConfig == nil {
+		return
+	}
+	next := *s.nodeConfig
+	next.PublicKey = publicKey
+	next.ShortID = shortID
+	s.nodeConfig = &next
+}
+
+// node 返回当前节点配置（只读，轮换时整体替换）
+func (s *LocalAPIServer) node() *NodeConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nodeConfig
+}
+
 // RegisterRoutes 注册路由到 mux
+// 每个路由声明读（GET）和写（其他方法）所需的权限
 func (s *LocalAPIServer) RegisterRoutes(mux *http.ServeMux) {
 	// 用户管理
-	mux.HandleFunc("/api/local/users", s.authMiddleware(s.handleUsers))
-	mux.HandleFunc("/api/local/users/", s.authMiddleware(s.handleUserByID))
+	mux.HandleFunc("/api/local/users", s.authMiddleware(local.ScopeRead, local.ScopeUsersWrite, s.handleUsers))
+	mux.HandleFunc("/api/local/users/", s.authMiddleware(local.ScopeRead, local.ScopeUsersWrite, s.handleUserByID))
+	mux.HandleFunc("/api/local/users/export", s.authMiddleware(local.ScopeUsersWrite, local.ScopeUsersWrite, s.handleExport))
+	mux.HandleFunc("/api/local/users/import", s.authMiddleware(local.ScopeUsersWrite, local.ScopeUsersWrite, s.handleImport))
+	mux.HandleFunc("/api/local/users/batch", s.authMiddleware(local.ScopeUsersWrite, local.ScopeUsersWrite, s.handleBatch))
 
 	// 节点配置
-	mux.HandleFunc("/api/local/config", s.authMiddleware(s.handleConfig))
+	mux.HandleFunc("/api/local/config", s.authMiddleware(local.ScopeRead, local.ScopeAdmin, s.handleConfig))
 
 	// 流量统计
-	mux.HandleFunc("/api/local/stats", s.authMiddleware(s.handleStats))
+	mux.HandleFunc("/api/local/stats", s.authMiddleware(local.ScopeRead, local.ScopeAdmin, s.handleStats))
+	mux.HandleFunc("/api/local/stats/history", s.authMiddleware(local.ScopeRead, local.ScopeAdmin, s.handleStatsHistory))
 
 	// 熔断控制
-	mux.HandleFunc("/api/local/circuit-breaker", s.authMiddleware(s.handleCircuitBreaker))
+	mux.HandleFunc("/api/local/circuit-breaker", s.authMiddleware(local.ScopeRead, local.ScopeCircuitBreaker, s.handleCircuitBreaker))
+
+	// Reality 密钥轮换
+	mux.HandleFunc("/api/local/reality", s.authMiddleware(local.ScopeRead, local.ScopeAdmin, s.handleReality))
+	mux.HandleFunc("/api/local/reality/rotate", s.authMiddleware(local.ScopeAdmin, local.ScopeAdmin, s.handleRealityRotate))
+
+	// API Key 管理
+	mux.HandleFunc("/api/local/keys", s.authMiddleware(local.ScopeAdmin, local.ScopeAdmin, s.handleKeys))
+	mux.HandleFunc("/api/local/keys/", s.authMiddleware(local.ScopeAdmin, local.ScopeAdmin, s.handleKeyByID))
+
+	// 审计日志
+	mux.HandleFunc("/api/local/audit", s.authMiddleware(local.ScopeAdmin, local.ScopeAdmin, s.handleAudit))
+
+	// 用户订阅（公开访问，订阅令牌即凭证）
+	mux.HandleFunc("/sub/", s.handleSubscription)
+}
+
+// apiKeyNameCtxKey 请求上下文中认证通过的 API Key 名称
+type apiKeyNameCtxKey struct{}
+
+// APIKeyName 返回处理当前请求时使用的 API Key 名称（节点密钥为 "node"）
+func APIKeyName(ctx context.Context) string {
+	name, _ := ctx.Value(apiKeyNameCtxKey{}).(string)
+	return name
 }
 
+type credentialsCtxKey struct{}
+
+// canViewCredentials 当前请求能否查看用户凭据（SS 密码、订阅令牌和分享链接）
+// 凭据可以直接用于连接节点，只读密钥看不到
+func canViewCredentials(ctx context.Context) bool {
+	ok, _ := ctx.Value(credentialsCtxKey{}).(bool)
+	return ok
+}
+
+// nodeKeyName 使用 NODE_API_KEY 认证时的名称
+const nodeKeyName = "node"
+
 // authMiddleware Bearer Token 认证中间件
-func (s *LocalAPIServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// GET/HEAD 需要 read 权限，其他方法需要 write 权限；NODE_API_KEY 拥有全部权限
+func (s *LocalAPIServer) authMiddleware(read, write local.Scope, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
@@ -70,15 +193,43 @@ func (s *LocalAPIServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 			return
 		}
 
-		if parts[1] != s.apiKey {
+		required := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = read
+		}
+
+		name, hasScope := s.authenticate(parts[1])
+		if hasScope == nil {
 			s.jsonError(w, http.StatusUnauthorized, "invalid api key")
 			return
 		}
+		if !hasScope(required) {
+			s.jsonError(w, http.StatusForbidden, "api key lacks scope: "+string(required))
+			return
+		}
 
-		next(w, r)
+		ctx := context.WithValue(r.Context(), apiKeyNameCtxKey{}, name)
+		ctx = context.WithValue(ctx, credentialsCtxKey{}, hasScope(local.ScopeUsersWrite))
+		next(w, r.WithContext(ctx))
 	}
 }
 
+// authenticate 返回密钥名称和权限检查函数，密钥无效时权限检查函数为 nil
+func (s *LocalAPIServer) authenticate(token string) (string, func(local.Scope) bool) {
+	if s.apiKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.apiKey)) == 1 {
+		return nodeKeyName, func(local.Scope) bool { return true }
+	}
+	if s.keys == nil {
+		return "", nil
+	}
+
+	key, ok := s.keys.Authenticate(token, time.Now())
+	if !ok {
+		return "", nil
+	}
+	return key.Name, key.HasScope
+}
+
 // handleUsers 处理 /api/local/users
 func (s *LocalAPIServer) handleUsers(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -93,15 +244,20 @@ func (s *LocalAPIServer) handleUsers(w http.ResponseWriter, r *http.Request) {
 
 // handleUserByID 处理 /api/local/users/{uuid}
 func (s *LocalAPIServer) handleUserByID(w http.ResponseWriter, r *http.Request) {
-	// 提取 UUID
-	path := strings.TrimPrefix(r.URL.Path, "/api/local/users/")
-	uuid := strings.TrimSuffix(path, "/")
+	// 提取 UUID 和子资源：/api/local/users/{uuid}[/{action}]
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/local/users/"), "/")
+	uuid, action, _ := strings.Cut(path, "/")
 
 	if uuid == "" {
 		s.jsonError(w, http.StatusBadRequest, "missing user uuid")
 		return
 	}
 
+	if action != "" {
+		s.handleUserAction(w, r, uuid, action)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		s.getUser(w, r, uuid)
@@ -114,20 +270,108 @@ func (s *LocalAPIServer) handleUserByID(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// listUsers 获取用户列表
+// handleUserAction 处理 /api/local/users/{uuid}/{action}
+func (s *LocalAPIServer) handleUserAction(w http.ResponseWriter, r *http.Request, uuid, action string) {
+	switch action {
+	case "reset-sub-token":
+		if r.Method != http.MethodPost {
+			s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.resetSubToken(w, r, uuid)
+	case "reset-traffic":
+		if r.Method != http.MethodPost {
+			s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.resetTraffic(w, r, uuid)
+	default:
+		s.jsonError(w, http.StatusNotFound, "unknown action: "+action)
+	}
+}
+
+// resetSubToken 重置订阅令牌
+func (s *LocalAPIServer) resetSubToken(w http.ResponseWriter, r *http.Request, uuid string) {
+	before, _ := s.store.GetUser(uuid)
+	user, err := s.store.ResetSubToken(uuid)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			s.jsonError(w, http.StatusNotFound, err.Error())
+		} else {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.record(r, "user.reset_sub_token", uuid, before, user, nil)
+	s.jsonSuccess(w, s.toUserResponse(user))
+}
+
+// resetTraffic 手动结束当前流量周期
+func (s *LocalAPIServer) resetTraffic(w http.ResponseWriter, r *http.Request, uuid string) {
+	before, _ := s.store.GetUser(uuid)
+	user, err := s.store.ResetTraffic(uuid)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			s.jsonError(w, http.StatusNotFound, err.Error())
+		} else {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.record(r, "user.reset_traffic", uuid, before, user, nil)
+	s.jsonSuccess(w, s.toUserResponse(user))
+}
+
+// maxPageSize 用户列表单页最大数量
+const maxPageSize = 1000
+
+// listUsers 获取用户列表（支持过滤、排序、分页和字段投影）
+//
+//	?enabled=true&expired=false&over_quota=false&protocol=vless&name=abc&expiring_within=7d
+//	&sort=created_at|name|traffic_used&order=asc|desc&limit=100&cursor=...&fields=uuid,name
+//
+// 不带 limit 时返回全部匹配的用户
 func (s *LocalAPIServer) listUsers(w http.ResponseWriter, r *http.Request) {
-	users := s.store.ListUsers()
+	q, err := parseUserQuery(r.URL.Query())
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// 转换为响应格式，包含连接 URL
-	response := make([]UserResponse, 0, len(users))
-	for _, u := range users {
-		response = append(response, s.toUserResponse(&u))
+	// 查询只会因排序字段或游标无效而失败
+	page, err := s.store.QueryUsers(*q)
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	s.jsonSuccess(w, map[string]any{
-		"users": response,
-		"total": len(response),
-	})
+	fields := parseFields(r.URL.Query().Get("fields"))
+	credentials := canViewCredentials(r.Context())
+
+	// 转换为响应格式；只有需要时才生成连接 URL
+	users := make([]any, 0, len(page.Users))
+	for i := range page.Users {
+		resp := s.userResponse(&page.Users[i], credentials && fields.wantURLs())
+		if !credentials {
+			resp.redactCredentials()
+		}
+		if fields == nil {
+			users = append(users, resp)
+		} else {
+			users = append(users, fields.project(resp))
+		}
+	}
+
+	result := map[string]any{
+		"users": users,
+		"total": page.Total,
+	}
+	if page.NextCursor != "" {
+		result["next_cursor"] = page.NextCursor
+	}
+	s.jsonSuccess(w, result)
 }
 
 // createUser 创建用户
@@ -138,8 +382,8 @@ func (s *LocalAPIServer) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Name == "" {
-		s.jsonError(w, http.StatusBadRequest, "name is required")
+	if err := req.Validate(); err != nil {
+		s.jsonError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -149,6 +393,8 @@ func (s *LocalAPIServer) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.record(r, "user.create", user.UUID, nil, user, nil)
+
 	s.jsonSuccess(w, s.toUserResponse(user))
 }
 
@@ -160,7 +406,11 @@ func (s *LocalAPIServer) getUser(w http.ResponseWriter, r *http.Request, uuid st
 		return
 	}
 
-	s.jsonSuccess(w, s.toUserResponse(user))
+	resp := s.toUserResponse(user)
+	if !canViewCredentials(r.Context()) {
+		resp.redactCredentials()
+	}
+	s.jsonSuccess(w, resp)
 }
 
 // updateUser 更新用户
@@ -170,6 +420,13 @@ func (s *LocalAPIServer) updateUser(w http.ResponseWriter, r *http.Request, uuid
 		s.jsonError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
+	before, ok := s.store.GetUser(uuid)
+	if ok {
+		if err := local.ValidateUpdate(before, &req); err != nil {
+			s.jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
 	user, err := s.store.UpdateUser(uuid, &req)
 	if err != nil {
@@ -181,11 +438,13 @@ func (s *LocalAPIServer) updateUser(w http.ResponseWriter, r *http.Request, uuid
 		return
 	}
 
+	s.record(r, "user.update", uuid, before, user, nil)
 	s.jsonSuccess(w, s.toUserResponse(user))
 }
 
 // deleteUser 删除用户
 func (s *LocalAPIServer) deleteUser(w http.ResponseWriter, r *http.Request, uuid string) {
+	before, _ := s.store.GetUser(uuid)
 	if err := s.store.DeleteUser(uuid); err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			s.jsonError(w, http.StatusNotFound, err.Error())
@@ -195,6 +454,7 @@ func (s *LocalAPIServer) deleteUser(w http.ResponseWriter, r *http.Request, uuid
 		return
 	}
 
+	s.record(r, "user.delete", uuid, before, nil, nil)
 	s.jsonSuccess(w, map[string]any{
 		"message": "user deleted",
 		"uuid":    uuid,
@@ -208,31 +468,7 @@ func (s *LocalAPIServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.jsonSuccess(w, s.nodeConfig)
-}
-
-// handleStats 获取流量统计（预留接口）
-func (s *LocalAPIServer) handleStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
-
-	users := s.store.ListUsers()
-
-	stats := make([]map[string]any, 0, len(users))
-	for _, u := range users {
-		stats = append(stats, map[string]any{
-			"uuid":          u.UUID,
-			"name":          u.Name,
-			"traffic_used":  u.TrafficUsed,
-			"traffic_limit": u.TrafficLimit,
-		})
-	}
-
-	s.jsonSuccess(w, map[string]any{
-		"stats": stats,
-	})
+	s.jsonSuccess(w, s.node())
 }
 
 // handleCircuitBreaker 处理熔断控制
@@ -261,10 +497,12 @@ func (s *LocalAPIServer) handleCircuitBreaker(w http.ResponseWriter, r *http.Req
 			return
 		}
 
+		before := s.store.GetCircuitBreaker()
 		if err := s.store.SetCircuitBreaker(req.Enabled, req.Reason, req.Message); err != nil {
 			s.jsonError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		s.record(r, "circuit_breaker.update", "", before, s.store.GetCircuitBreaker(), nil)
 
 		s.jsonSuccess(w, map[string]any{
 			"message": "circuit breaker updated",
@@ -276,6 +514,67 @@ func (s *LocalAPIServer) handleCircuitBreaker(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// handleReality 获取 Reality 密钥和轮换状态
+func (s *LocalAPIServer) handleReality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.reality == nil {
+		s.jsonError(w, http.StatusNotImplemented, "reality rotation not available")
+		return
+	}
+
+	s.jsonSuccess(w, s.reality.RealityStatus())
+}
+
+// handleRealityRotate 开始 Reality 密钥轮换
+func (s *LocalAPIServer) handleRealityRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.reality == nil {
+		s.jsonError(w, http.StatusNotImplemented, "reality rotation not available")
+		return
+	}
+
+	// 时长单位为秒，0 或缺省表示使用默认值
+	var req struct {
+		SwitchAfter int64 `json:"switch_after"`
+		Overlap     int64 `json:"overlap"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.jsonError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	if req.SwitchAfter < 0 || req.Overlap < 0 {
+		s.jsonError(w, http.StatusBadRequest, "switch_after and overlap must not be negative")
+		return
+	}
+
+	status, err := s.reality.StartRealityRotation(r.Context(),
+		time.Duration(req.SwitchAfter)*time.Second,
+		time.Duration(req.Overlap)*time.Second,
+	)
+	if err != nil {
+		if errors.Is(err, config.ErrRotationInProgress) {
+			s.jsonError(w, http.StatusConflict, err.Error())
+		} else {
+			s.jsonError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.record(r, "reality.rotate", "", nil, nil, map[string]any{
+		"switch_at": status.SwitchAt,
+		"short_ids": status.ShortIDs,
+	})
+	s.jsonSuccess(w, status)
+}
+
 // UserResponse 用户响应格式
 type UserResponse struct {
 	UUID         string     `json:"uuid"`
@@ -286,15 +585,41 @@ type UserResponse struct {
 	TrafficLimit int64      `json:"traffic_limit"`
 	TrafficUsed  int64      `json:"traffic_used"`
 	ExpireAt     *time.Time `json:"expire_at"`
+	MaxIPs       int        `json:"max_ips"`
+	SubToken     string     `json:"sub_token"`
+	SubURL       string     `json:"sub_url,omitempty"` // 公开订阅地址，可直接交给终端用户
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
+	// 流量周期
+	ResetPolicy       local.ResetPolicy     `json:"reset_policy"`
+	ResetDay          int                   `json:"reset_day,omitempty"`
+	ResetIntervalDays int                   `json:"reset_interval_days,omitempty"`
+	PeriodStart       time.Time             `json:"period_start"`
+	NextResetAt       *time.Time            `json:"next_reset_at,omitempty"`
+	TrafficHistory    []local.TrafficPeriod `json:"traffic_history,omitempty"`
 	// 连接 URL
-	VLESSUrl string `json:"vless_url,omitempty"`
-	SSUrl    string `json:"ss_url,omitempty"`
+	VLESSUrl string            `json:"vless_url,omitempty"`
+	SSUrl    string            `json:"ss_url,omitempty"`
+	URLs     map[string]string `json:"urls,omitempty"` // 协议 -> 分享链接
+}
+
+// redactCredentials 清除可以直接用于连接的凭据（没有 users:write 权限的调用方）
+func (r *UserResponse) redactCredentials() {
+	r.SSPassword = ""
+	r.SubToken = ""
+	r.SubURL = ""
+	r.VLESSUrl = ""
+	r.SSUrl = ""
+	r.URLs = nil
 }
 
 // toUserResponse 转换为响应格式
 func (s *LocalAPIServer) toUserResponse(u *local.LocalUser) UserResponse {
+	return s.userResponse(u, true)
+}
+
+// userResponse 转换为响应格式，withURLs 为 false 时不生成分享链接（列表投影时节省开销）
+func (s *LocalAPIServer) userResponse(u *local.LocalUser, withURLs bool) UserResponse {
 	resp := UserResponse{
 		UUID:         u.UUID,
 		Name:         u.Name,
@@ -304,71 +629,113 @@ func (s *LocalAPIServer) toUserResponse(u *local.LocalUser) UserResponse {
 		TrafficLimit: u.TrafficLimit,
 		TrafficUsed:  u.TrafficUsed,
 		ExpireAt:     u.ExpireAt,
+		MaxIPs:       u.MaxIPs,
+		SubToken:     u.SubToken,
 		CreatedAt:    u.CreatedAt,
 		UpdatedAt:    u.UpdatedAt,
+
+		ResetPolicy:       u.ResetPolicy,
+		ResetDay:          u.ResetDay,
+		ResetIntervalDays: u.ResetIntervalDays,
+		PeriodStart:       u.CreatedAt,
+		NextResetAt:       u.NextResetAt,
+		TrafficHistory:    u.TrafficHistory,
+	}
+	if resp.ResetPolicy == "" {
+		resp.ResetPolicy = local.ResetNever
+	}
+	if u.PeriodStart != nil {
+		resp.PeriodStart = *u.PeriodStart
 	}
 
 	// 生成连接 URL
-	for _, proto := range u.Protocols {
-		switch proto {
-		case "vless":
-			resp.VLESSUrl = s.generateVLESSUrl(u)
-		case "shadowsocks":
-			resp.SSUrl = s.generateSSUrl(u)
-		}
+	if withURLs {
+		resp.URLs = s.shareURLs(u)
+		resp.VLESSUrl = resp.URLs["vless"]
+		resp.SSUrl = resp.URLs["shadowsocks"]
+	}
+	if node := s.node(); node != nil && node.SubBaseURL != "" && u.SubToken != "" {
+		resp.SubURL = strings.TrimSuffix(node.SubBaseURL, "/") + "/sub/" + u.SubToken
 	}
 
 	return resp
 }
 
-// generateVLESSUrl 生成 VLESS 连接 URL
-// 格式: vless://uuid@server:port?encryption=none&flow=xtls-rprx-vision&security=reality&sni=sni&fp=chrome&pbk=publickey&sid=shortid&type=tcp#name
-func (s *LocalAPIServer) generateVLESSUrl(u *local.LocalUser) string {
-	if s.nodeConfig == nil || s.nodeConfig.ServerIP == "" {
-		return ""
-	}
-
-	params := url.Values{}
-	params.Set("encryption", "none")
-	params.Set("flow", "xtls-rprx-vision")
-	params.Set("security", "reality")
-	params.Set("sni", "www.microsoft.com") // 默认 SNI
-	params.Set("fp", "chrome")
-	params.Set("pbk", s.nodeConfig.PublicKey)
-	params.Set("sid", s.nodeConfig.ShortID)
-	params.Set("type", "tcp")
-
-	return fmt.Sprintf("vless://%s@%s:%d?%s#%s",
-		u.UUID,
-		s.nodeConfig.ServerIP,
-		s.nodeConfig.VLESSPort,
-		params.Encode(),
-		url.PathEscape(u.Name),
-	)
+// shareURLs 通过协议模块生成用户所有协议的分享链接
+func (s *LocalAPIServer) shareURLs(u *local.LocalUser) map[string]string {
+	user := config.User{
+		UUID:       u.UUID,
+		SSPassword: u.SSPassword,
+	}
+
+	urls := make(map[string]string)
+	for _, l := range s.userLinks(u) {
+		if url := l.protocol.ShareURL(l.link, user, u.Name); url != "" {
+			urls[l.protocol.Name()] = url
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil
+	}
+	return urls
+}
+
+// userLink 用户某个协议的连接参数
+type userLink struct {
+	protocol config.Protocol
+	link     *config.ShareLink
 }
 
-// generateSSUrl 生成 Shadowsocks 连接 URL
-// 格式: ss://base64(method:password)@server:port#name
-func (s *LocalAPIServer) generateSSUrl(u *local.LocalUser) string {
-	if s.nodeConfig == nil || s.nodeConfig.ServerIP == "" {
-		return ""
+// userLinks 按用户协议顺序返回本节点已启用协议的连接参数
+// TLS 协议在没有 SERVER_IP 时使用 VPN 域名作为服务器地址
+func (s *LocalAPIServer) userLinks(u *local.LocalUser) []userLink {
+	node := s.node()
+	if node == nil {
+		return nil
 	}
 
-	method := s.nodeConfig.SSMethod
-	if method == "" {
-		method = "chacha20-ietf-poly1305"
+	var enabled map[string]bool
+	if s.enabled != nil {
+		enabled = make(map[string]bool)
+		for _, name := range s.enabled() {
+			enabled[name] = true
+		}
 	}
 
-	// base64 编码 method:password
-	userInfo := fmt.Sprintf("%s:%s", method, u.SSPassword)
-	encoded := base64.URLEncoding.EncodeToString([]byte(userInfo))
+	var links []userLink
+	for _, proto := range u.Protocols {
+		p, ok := config.GetProtocol(proto)
+		if !ok {
+			continue
+		}
+
+		port := node.Port(proto)
+		if port <= 0 || (enabled != nil && !enabled[proto]) {
+			continue
+		}
 
-	return fmt.Sprintf("ss://%s@%s:%d#%s",
-		encoded,
-		s.nodeConfig.ServerIP,
-		s.nodeConfig.SSPort,
-		url.PathEscape(u.Name),
-	)
+		server := node.ServerIP
+		if server == "" && p.RequiresTLS() {
+			server = node.VpnDomain
+		}
+		if server == "" {
+			continue
+		}
+
+		links = append(links, userLink{
+			protocol: p,
+			link: &config.ShareLink{
+				Server:     server,
+				Port:       port,
+				PublicKey:  node.PublicKey,
+				ShortID:    node.ShortID,
+				ServerName: node.VpnDomain,
+				SSMethod:   node.SSMethod,
+			},
+		})
+	}
+	return links
 }
 
 // jsonSuccess 返回成功响应
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"otun-node-agent/internal/local"
+)
+
+const testNodeKey = "node-key"
+
+// newTestAPI 创建使用临时存储的本地 API，返回注册好路由的 mux
+func newTestAPI(t *testing.T) (*LocalAPIServer, *local.Store, *http.ServeMux) {
+	t.Helper()
+	store, err := local.NewStore(t.TempDir(), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewLocalAPIServer(store, testNodeKey, &NodeConfig{NodeID: "node-1"})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	return s, store, mux
+}
+
+// do 使用给定的 API Key 发送请求
+func do(mux *http.ServeMux, key, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestListUsersPaginationAndFields(t *testing.T) {
+	_, store, mux := newTestAPI(t)
+	for i := range 5 {
+		if _, err := store.CreateUser(&local.CreateUserRequest{Name: fmt.Sprintf("user-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		q := url.Values{"sort": {"name"}, "order": {"desc"}, "limit": {"2"}, "fields": {"uuid,name"}}
+		if cursor != "" {
+			q.Set("cursor", cursor)
+		}
+		rec := do(mux, testNodeKey, http.MethodGet, "/api/local/users?"+q.Encode(), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+
+		var page struct {
+			Users      []map[string]any `json:"users"`
+			Total      int              `json:"total"`
+			NextCursor string           `json:"next_cursor"`
+		}
+		decodeJSON(t, rec, &page)
+		if page.Total != 5 {
+			t.Fatalf("total = %d, want 5", page.Total)
+		}
+		for _, u := range page.Users {
+			if len(u) != 2 || u["uuid"] == nil {
+				t.Fatalf("user = %v, want only uuid and name", u)
+			}
+			names = append(names, u["name"].(string))
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	want := []string{"user-4", "user-3", "user-2", "user-1", "user-0"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Fatalf("names = %v, want %v", names, want)
+	}
+}
+
+func TestListUsersRejectsInvalidQuery(t *testing.T) {
+	_, _, mux := newTestAPI(t)
+	for _, q := range []string{
+		"sort=uuid",
+		"order=up",
+		"limit=0",
+		"enabled=maybe",
+		"expiring_within=-1d",
+		"cursor=garbage",
+		// 游标与排序方式不一致
+		"sort=name&cursor=" + url.QueryEscape(encodeTestCursor(t, mux)),
+	} {
+		rec := do(mux, testNodeKey, http.MethodGet, "/api/local/users?"+q, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", q, rec.Code)
+		}
+	}
+}
+
+// encodeTestCursor 按默认排序取一页，返回下一页游标
+func encodeTestCursor(t *testing.T, mux *http.ServeMux) string {
+	t.Helper()
+	for range 2 {
+		do(mux, testNodeKey, http.MethodPost, "/api/local/users", strings.NewReader(`{"name":"c"}`))
+	}
+	var page struct {
+		NextCursor string `json:"next_cursor"`
+	}
+	decodeJSON(t, do(mux, testNodeKey, http.MethodGet, "/api/local/users?limit=1", nil), &page)
+	if page.NextCursor == "" {
+		t.Fatal("expected a next cursor")
+	}
+	return page.NextCursor
+}
+
+// newScopedKey 创建拥有指定权限的 API Key，返回明文
+func newScopedKey(t *testing.T, s *LocalAPIServer, scopes ...local.Scope) string {
+	t.Helper()
+	if s.keys == nil {
+		keys, err := local.NewKeyStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetKeyStore(keys)
+	}
+	_, secret, err := s.keys.Create(string(scopes[0]), scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestAuthMiddlewareEnforcesScopes(t *testing.T) {
+	s, store, mux := newTestAPI(t)
+	user, err := store.CreateUser(&local.CreateUserRequest{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := newScopedKey(t, s, local.ScopeRead)
+	users := newScopedKey(t, s, local.ScopeUsersWrite)
+	breaker := newScopedKey(t, s, local.ScopeCircuitBreaker)
+	admin := newScopedKey(t, s, local.ScopeAdmin)
+
+	tests := []struct {
+		key, method, target, body string
+		want                      int
+	}{
+		{"", http.MethodGet, "/api/local/users", "", http.StatusUnauthorized},
+		{"unknown", http.MethodGet, "/api/local/users", "", http.StatusUnauthorized},
+
+		// 任何权限都包含只读
+		{read, http.MethodGet, "/api/local/users", "", http.StatusOK},
+		{breaker, http.MethodGet, "/api/local/users/" + user.UUID, "", http.StatusOK},
+
+		// 写操作需要对应权限
+		{read, http.MethodPost, "/api/local/users", `{"name":"bob"}`, http.StatusForbidden},
+		{read, http.MethodDelete, "/api/local/users/" + user.UUID, "", http.StatusForbidden},
+		{breaker, http.MethodPost, "/api/local/users/import", `[]`, http.StatusForbidden},
+		{read, http.MethodGet, "/api/local/users/import", "", http.StatusForbidden},
+		{users, http.MethodPost, "/api/local/users", `{"name":"bob"}`, http.StatusOK},
+
+		// 导出包含全部凭据，需要 users:write
+		{read, http.MethodGet, "/api/local/users/export", "", http.StatusForbidden},
+		{users, http.MethodGet, "/api/local/users/export", "", http.StatusOK},
+		{users, http.MethodPost, "/api/local/circuit-breaker", `{"enabled":true}`, http.StatusForbidden},
+		{users, http.MethodPost, "/api/local/reality/rotate", "", http.StatusForbidden},
+
+		// 管理 API Key 和审计日志只有 admin 可以访问（包括读取）
+		{read, http.MethodGet, "/api/local/keys", "", http.StatusForbidden},
+		{users, http.MethodGet, "/api/local/audit", "", http.StatusForbidden},
+		{admin, http.MethodGet, "/api/local/keys", "", http.StatusOK},
+		{testNodeKey, http.MethodGet, "/api/local/keys", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := do(mux, tt.key, tt.method, tt.target, strings.NewReader(tt.body))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s with %q: status = %d, want %d: %s", tt.method, tt.target, tt.key, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	// 被拒绝的写操作没有生效
+	if _, ok := store.GetUser(user.UUID); !ok {
+		t.Fatal("user deleted by a read-only key")
+	}
+}
+
+func TestReadOnlyKeyCannotSeeCredentials(t *testing.T) {
+	s, store, mux := newTestAPI(t)
+	s.nodeConfig.SubBaseURL = "https://sub.example.com"
+	user, err := store.CreateUser(&local.CreateUserRequest{Name: "alice", Protocols: []string{"shadowsocks"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := newScopedKey(t, s, local.ScopeRead)
+	users := newScopedKey(t, s, local.ScopeUsersWrite)
+
+	for _, target := range []string{
+		"/api/local/users",
+		"/api/local/users?fields=uuid,ss_password,sub_token,sub_url,urls",
+		"/api/local/users/" + user.UUID,
+	} {
+		rec := do(mux, read, http.MethodGet, target, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", target, rec.Code)
+		}
+		body := rec.Body.String()
+		if strings.Contains(body, user.SSPassword) || strings.Contains(body, user.SubToken) {
+			t.Fatalf("%s: read-only response leaks credentials: %s", target, body)
+		}
+	}
+
+	rec := do(mux, users, http.MethodGet, "/api/local/users/"+user.UUID, nil)
+	var resp UserResponse
+	decodeJSON(t, rec, &resp)
+	if resp.SSPassword != user.SSPassword || resp.SubToken != user.SubToken || resp.SubURL == "" {
+		t.Fatalf("users:write response = %+v, want credentials", resp)
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"otun-node-agent/internal/local"
+)
+
+// parseUserQuery 解析用户列表查询参数
+func parseUserQuery(values url.Values) (*local.UserQuery, error) {
+	q := &local.UserQuery{
+		Protocol:     values.Get("protocol"),
+		NameContains: values.Get("name"),
+		Cursor:       values.Get("cursor"),
+	}
+
+	var err error
+	if q.Enabled, err = parseBoolParam(values, "enabled"); err != nil {
+		return nil, err
+	}
+	if q.Expired, err = parseBoolParam(values, "expired"); err != nil {
+		return nil, err
+	}
+	if q.OverQuota, err = parseBoolParam(values, "over_quota"); err != nil {
+		return nil, err
+	}
+
+	if v := values.Get("expiring_within"); v != "" {
+		d, err := parseDays(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid expiring_within: %s", v)
+		}
+		q.ExpiringWithin = d
+	}
+
+	if q.Sort, err = local.ParseUserSort(values.Get("sort")); err != nil {
+		return nil, err
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return nil, fmt.Errorf("invalid order: %s", values.Get("order"))
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
+
+// parseBoolParam 解析可选的布尔参数
+func parseBoolParam(values url.Values, name string) (*bool, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return &b, nil
+}
+
+// parseDays 解析时长，支持 "7d" 形式的天数和 Go 时长格式（如 "36h"）
+func parseDays(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// fieldSet 响应字段投影（nil 表示返回全部字段）
+type fieldSet map[string]bool
+
+// parseFields 解析 fields=uuid,name,... 参数
+func parseFields(v string) fieldSet {
+	if v == "" {
+		return nil
+	}
+	fields := make(fieldSet)
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields[f] = true
+		}
+	}
+	return fields
+}
+
+// wantURLs 是否需要生成分享链接
+func (f fieldSet) wantURLs() bool {
+	return f == nil || f["urls"] || f["vless_url"] || f["ss_url"]
+}
+
+// project 只保留请求的字段（字段名与 JSON 键一致，未知字段忽略）
+func (f fieldSet) project(resp UserResponse) map[string]json.RawMessage {
+	data, _ := json.Marshal(resp)
+	var all map[string]json.RawMessage
+	json.Unmarshal(data, &all)
+
+	out := make(map[string]json.RawMessage, len(f))
+	for name := range f {
+		if v, ok := all[name]; ok {
+			out[name] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/local"
+)
+
+// 订阅格式
+const (
+	SubFormatBase64  = "base64"  // base64 编码的分享链接列表（v2rayN/Shadowrocket 等）
+	SubFormatClash   = "clash"   // Clash/mihomo YAML
+	SubFormatSingbox = "singbox" // sing-box 客户端 JSON
+)
+
+// subUpdateIntervalHours 建议客户端的订阅更新间隔（小时）
+const subUpdateIntervalHours = 12
+
+// handleSubscription 处理 /sub/{token}
+// 不需要 API Key：订阅令牌本身就是凭证，泄露后可通过 reset-sub-token 作废
+func (s *LocalAPIServer) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sub/"), "/")
+	user, ok := s.store.GetUserBySubToken(token)
+	if !ok {
+		s.jsonError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	if !user.Enabled {
+		s.jsonError(w, http.StatusForbidden, "subscription disabled")
+		return
+	}
+
+	links := s.userLinks(user)
+	if len(links) == 0 {
+		s.jsonError(w, http.StatusServiceUnavailable, "no protocols available for this subscription")
+		return
+	}
+
+	format := subscriptionFormat(r)
+
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	switch format {
+	case SubFormatClash:
+		body = s.clashProfile(user, links)
+		contentType = "text/yaml; charset=utf-8"
+	case SubFormatSingbox:
+		body, err = s.singboxProfile(user, links)
+		contentType = "application/json; charset=utf-8"
+	default:
+		body = s.base64Profile(user, links)
+		contentType = "text/plain; charset=utf-8"
+	}
+	if err != nil {
+		s.jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := user.Name
+	if filename == "" {
+		filename = s.node().NodeID
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Subscription-Userinfo", subscriptionUserinfo(user))
+	w.Header().Set("Profile-Update-Interval", strconv.Itoa(subUpdateIntervalHours))
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+// subscriptionFormat 按查询参数（format/target）或 User-Agent 选择订阅格式
+func subscriptionFormat(r *http.Request) string {
+	q := r.URL.Query()
+	requested := q.Get("format")
+	if requested == "" {
+		requested = q.Get("target")
+	}
+
+	switch strings.ToLower(requested) {
+	case "clash", "mihomo", "clash-meta", "meta":
+		return SubFormatClash
+	case "singbox", "sing-box":
+		return SubFormatSingbox
+	case "base64", "v2ray", "uri":
+		return SubFormatBase64
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	switch {
+	case strings.Contains(ua, "clash"), strings.Contains(ua, "mihomo"), strings.Contains(ua, "stash"):
+		return SubFormatClash
+	case strings.Contains(ua, "sing-box"), strings.Contains(ua, "sfa"),
+		strings.Contains(ua, "sfi"), strings.Contains(ua, "sfm"), strings.Contains(ua, "hiddify"):
+		return SubFormatSingbox
+	}
+	return SubFormatBase64
+}
+
+// subscriptionUserinfo 生成 Subscription-Userinfo 头
+// 本地只记录总流量，全部计入 download
+func subscriptionUserinfo(u *local.LocalUser) string {
+	expire := int64(0)
+	if u.ExpireAt != nil {
+		expire = u.ExpireAt.Unix()
+	}
+	return fmt.Sprintf("upload=0; download=%d; total=%d; expire=%d", u.TrafficUsed, u.TrafficLimit, expire)
+}
+
+// proxyName 订阅中的节点名称（同一订阅内唯一）
+func (s *LocalAPIServer) proxyName(p config.Protocol) string {
+	return fmt.Sprintf("%s-%s", s.node().NodeID, p.Name())
+}
+
+// subUser 生成协议模块需要的用户信息
+func subUser(u *local.LocalUser) config.User {
+	return config.User{
+		UUID:       u.UUID,
+		SSPassword: u.SSPassword,
+	}
+}
+
+// base64Profile base64 编码的分享链接列表（每行一个）
+func (s *LocalAPIServer) base64Profile(u *local.LocalUser, links []userLink) []byte {
+	user := subUser(u)
+
+	var lines []string
+	for _, l := range links {
+		if uri := l.protocol.ShareURL(l.link, user, s.proxyName(l.protocol)); uri != "" {
+			lines = append(lines, uri)
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")))
+	return []byte(encoded)
+}
+
+// clashProfile Clash/mihomo 配置
+func (s *LocalAPIServer) clashProfile(u *local.LocalUser, links []userLink) []byte {
+	user := subUser(u)
+
+	var proxies []map[string]any
+	var names []string
+	for _, l := range links {
+		name := s.proxyName(l.protocol)
+		if proxy := l.protocol.ClashProxy(l.link, user, name); proxy != nil {
+			proxies = append(proxies, proxy)
+			names = append(names, name)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("mixed-port: 7890\n")
+	buf.WriteString("allow-lan: false\n")
+	buf.WriteString("mode: rule\n")
+	buf.WriteString("log-level: info\n")
+
+	// 每个代理/分组写成一行 flow 映射，避免引入 YAML 库
+	buf.WriteString("proxies:\n")
+	for _, p := range proxies {
+		buf.WriteString("  - ")
+		writeYAMLFlow(&buf, p)
+		buf.WriteByte('\n')
+	}
+
+	buf.WriteString("proxy-groups:\n")
+	buf.WriteString("  - ")
+	writeYAMLFlow(&buf, map[string]any{
+		"name":    "PROXY",
+		"type":    "select",
+		"proxies": names,
+	})
+	buf.WriteByte('\n')
+
+	buf.WriteString("rules:\n")
+	buf.WriteString("  - GEOIP,LAN,DIRECT,no-resolve\n")
+	buf.WriteString("  - MATCH,PROXY\n")
+
+	return buf.Bytes()
+}
+
+// singboxProfile sing-box 客户端配置（TUN 全局代理，私有地址直连）
+func (s *LocalAPIServer) singboxProfile(u *local.LocalUser, links []userLink) ([]byte, error) {
+	user := subUser(u)
+
+	var outbounds []map[string]any
+	var names []string
+	for _, l := range links {
+		name := s.proxyName(l.protocol)
+		if outbound := l.protocol.ClientOutbound(l.link, user, name); outbound != nil {
+			outbounds = append(outbounds, outbound)
+			names = append(names, name)
+		}
+	}
+
+	outbounds = append([]map[string]any{{
+		"type":      "selector",
+		"tag":       "proxy",
+		"outbounds": names,
+	}}, outbounds...)
+	outbounds = append(outbounds,
+		map[string]any{"type": "direct", "tag": "direct"},
+		map[string]any{"type": "dns", "tag": "dns-out"},
+	)
+
+	profile := map[string]any{
+		"log": map[string]any{
+			"level": "warn",
+		},
+		"dns": map[string]any{
+			"servers": []map[string]any{
+				{"tag": "remote", "address": "tls://8.8.8.8", "detour": "proxy"},
+				{"tag": "local", "address": "local", "detour": "direct"},
+			},
+			"rules": []map[string]any{
+				{"outbound": "any", "server": "local"},
+			},
+			"final": "remote",
+		},
+		"inbounds": []map[string]any{
+			{
+				"type":         "tun",
+				"tag":          "tun-in",
+				"address":      []string{"172.19.0.1/30", "fdfe:dcba:9876::1/126"},
+				"auto_route":   true,
+				"strict_route": true,
+				"sniff":        true,
+			},
+		},
+		"outbounds": outbounds,
+		"route": map[string]any{
+			"rules": []map[string]any{
+				{"protocol": "dns", "outbound": "dns-out"},
+				{"ip_is_private": true, "outbound": "direct"},
+			},
+			"final":                 "proxy",
+			"auto_detect_interface": true,
+		},
+	}
+
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal sing-box profile: %w", err)
+	}
+	return data, nil
+}
+
+// writeYAMLFlow 以 YAML flow 风格输出值（键排序，字符串使用双引号）
+func writeYAMLFlow(buf *bytes.Buffer, v any) {
+	switch val := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			writeYAMLFlow(buf, val[k])
+		}
+		buf.WriteByte('}')
+	case []string:
+		buf.WriteByte('[')
+		for i, s := range val {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeYAMLFlow(buf, s)
+		}
+		buf.WriteByte(']')
+	case string:
+		// JSON 字符串转义是 YAML 双引号字符串的子集
+		quoted, _ := json.Marshal(val)
+		buf.Write(quoted)
+	default:
+		fmt.Fprintf(buf, "%v", val)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otun-node-agent/internal/local"
+)
+
+func TestSubscriptionOnlyIncludesEnabledProtocols(t *testing.T) {
+	store, err := local.NewStore(t.TempDir(), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.CreateUser(&local.CreateUserRequest{Name: "alice", Protocols: []string{"vless", "trojan"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewLocalAPIServer(store, "node-key", &NodeConfig{
+		NodeID:     "node-1",
+		PublicKey:  "pub",
+		ShortID:    "ab",
+		VLESSPort:  443,
+		TrojanPort: 8443,
+		VpnDomain:  "vpn.example.com",
+	})
+	enabled := []string{"vless"}
+	s.SetEnabledProtocols(func() []string { return enabled })
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	subscribe := func() (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sub/"+user.SubToken+"?format=base64", nil))
+		body, _ := base64.StdEncoding.DecodeString(rec.Body.String())
+		return rec.Code, string(body)
+	}
+
+	// 没有 SERVER_IP 时 VLESS 无法生成链接；trojan 没有证书（未启用）
+	if code, _ := subscribe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503 with no usable protocol", code)
+	}
+
+	// 证书就绪后 trojan 启用，使用 VPN 域名作为服务器地址
+	enabled = []string{"vless", "trojan"}
+	code, body := subscribe()
+	if code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if !strings.Contains(body, "trojan://") || !strings.Contains(body, "@vpn.example.com:8443") || strings.Contains(body, "vless://") {
+		t.Fatalf("subscription = %q, want only the trojan link via the VPN domain", body)
+	}
+}
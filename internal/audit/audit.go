@@ -0,0 +1,272 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 默认轮转参数
+const (
+	DefaultMaxSize  = 10 << 20 // 单个文件上限
+	DefaultMaxFiles = 5        // 保留的历史文件数（audit.log.1 ... audit.log.N）
+)
+
+// redacted 敏感字段在差异中的占位值：只记录发生了变化，不记录内容
+var redacted = json.RawMessage(`"[redacted]"`)
+
+// sensitiveFields 不写入审计日志的字段
+var sensitiveFields = map[string]bool{
+	"ss_password": true,
+	"sub_token":   true,
+	"hash":        true,
+	"key":         true,
+}
+
+// ignoredFields 每次修改都会变化、没有审计价值的字段
+var ignoredFields = map[string]bool{
+	"updated_at": true,
+}
+
+// Change 单个字段的变化（新增时 Before 为空，删除时 After 为空）
+type Change struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Entry 审计记录
+type Entry struct {
+	Time     time.Time         `json:"time"`
+	Actor    string            `json:"actor"`            // API Key 名称
+	ClientIP string            `json:"client_ip"`        // 请求来源地址
+	Action   string            `json:"action"`           // 如 user.create、circuit_breaker.update
+	Target   string            `json:"target,omitempty"` // 用户 UUID、API Key ID 等
+	Changes  map[string]Change `json:"changes,omitempty"`
+	Detail   map[string]any    `json:"detail,omitempty"`
+}
+
+// Query 查询条件，零值表示不过滤
+type Query struct {
+	Since  time.Time
+	Until  time.Time
+	Target string
+	Actor  string
+	Action string
+	Limit  int // 0 = 不限制
+}
+
+// Log 追加写入的审计日志（JSON Lines），超过大小上限时轮转
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+// NewLog 创建审计日志，文件位于 dir/audit.log
+func NewLog(dir string, maxSize int64, maxFiles int) *Log {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	return &Log{
+		path:     filepath.Join(dir, "audit.log"),
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// Record 追加一条记录
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if info, err := os.Stat(l.path); err == nil && info.Size()+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return f.Sync()
+}
+
+// rotate audit.log → audit.log.1 → ... → audit.log.N，最旧的删除（调用者必须已持有锁）
+func (l *Log) rotate() error {
+	os.Remove(l.rotatedPath(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.rotatedPath(1))
+}
+
+func (l *Log) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// Query 按条件查询记录，最新的在前
+func (l *Log) Query(q Query) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var result []Entry
+	// 从最旧的轮转文件读到当前文件
+	for i := l.maxFiles; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotatedPath(i)
+		}
+		entries, err := readEntries(path, &q)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entries...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.After(result[j].Time) })
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result, nil
+}
+
+// readEntries 读取单个文件中满足条件的记录，损坏的行（例如写入时断电）跳过
+func readEntries(path string, q *Query) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if q.matches(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Target != "" && e.Target != q.Target {
+		return false
+	}
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action {
+		return false
+	}
+	return true
+}
+
+// Diff 比较两个对象的 JSON 字段，返回变化的字段（before/after 可为 nil 表示创建/删除）
+// 敏感字段只记录发生了变化
+func Diff(before, after any) map[string]Change {
+	b := toFields(before)
+	a := toFields(after)
+
+	changes := make(map[string]Change)
+	for name, bv := range b {
+		if ignoredFields[name] {
+			continue
+		}
+		av, ok := a[name]
+		if ok && bytes.Equal(bv, av) {
+			continue
+		}
+		c := Change{Before: bv}
+		if ok {
+			c.After = av
+		}
+		changes[name] = redact(name, c)
+	}
+	for name, av := range a {
+		if _, ok := b[name]; ok || ignoredFields[name] {
+			continue
+		}
+		changes[name] = redact(name, Change{After: av})
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func redact(name string, c Change) Change {
+	if !sensitiveFields[name] {
+		return c
+	}
+	if c.Before != nil {
+		c.Before = redacted
+	}
+	if c.After != nil {
+		c.After = redacted
+	}
+	return c
+}
+
+// toFields 将对象转为 字段名 -> JSON 值（null 视为不存在）
+func toFields(v any) map[string]json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	for name, value := range fields {
+		if string(value) == "null" {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestLogRotateAndQuery 测试轮转后仍能跨文件查询，超出保留数量的旧记录被删除
+func TestLogRotateAndQuery(t *testing.T) {
+	l := NewLog(t.TempDir(), 400, 2)
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		err := l.Record(Entry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Actor:  "panel",
+			Action: "user.update",
+			Target: fmt.Sprintf("user-%d", i%2),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || len(all) >= 20 {
+		t.Fatalf("Expected rotation to drop oldest entries, got %d", len(all))
+	}
+	if !all[0].Time.Equal(start.Add(19 * time.Minute)) {
+		t.Errorf("Expected newest entry first, got %s", all[0].Time)
+	}
+
+	filtered, _ := l.Query(Query{Target: "user-1", Since: start.Add(15 * time.Minute), Limit: 2})
+	if len(filtered) != 2 || filtered[0].Target != "user-1" || filtered[1].Time.Before(start.Add(15*time.Minute)) {
+		t.Errorf("Unexpected filtered result: %+v", filtered)
+	}
+}
+
+// TestDiffRedactsSecrets 测试差异只包含变化字段，敏感字段不记录内容
+func TestDiffRedactsSecrets(t *testing.T) {
+	type user struct {
+		Name       string `json:"name"`
+		Enabled    bool   `json:"enabled"`
+		SSPassword string `json:"ss_password"`
+		UpdatedAt  string `json:"updated_at"`
+	}
+
+	changes := Diff(
+		&user{Name: "a", Enabled: true, SSPassword: "old", UpdatedAt: "1"},
+		&user{Name: "a", Enabled: false, SSPassword: "new", UpdatedAt: "2"},
+	)
+	if len(changes) != 2 {
+		t.Fatalf("Expected enabled and ss_password to change, got %v", changes)
+	}
+	if string(changes["enabled"].Before) != "true" || string(changes["enabled"].After) != "false" {
+		t.Errorf("Unexpected enabled change: %+v", changes["enabled"])
+	}
+	if string(changes["ss_password"].After) != `"[redacted]"` {
+		t.Errorf("Secret leaked into audit diff: %s", changes["ss_password"].After)
+	}
+
+	var nilUser *user
+	if created := Diff(nilUser, &user{Name: "b"}); created["name"].Before != nil || string(created["name"].After) != `"b"` {
+		t.Errorf("Unexpected create diff: %+v", created)
+	}
+}
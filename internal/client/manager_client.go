@@ -1,29 +1,19 @@
 package client
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"time"
+	"context"
+
+	"otun-node-agent/internal/controlplane"
 )
 
 // ManagerClient otun-manager 客户端
 type ManagerClient struct {
-	baseURL    string
-	apiKey     string
-	httpClient *http.Client
+	client *controlplane.Client
 }
 
 // NewManagerClient 创建 Manager 客户端
-func NewManagerClient(baseURL, apiKey string) *ManagerClient {
-	return &ManagerClient{
-		baseURL: baseURL,
-		apiKey:  apiKey,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}
+func NewManagerClient(client *controlplane.Client) *ManagerClient {
+	return &ManagerClient{client: client}
 }
 
 // NodeConfigResponse 节点配置响应
@@ -42,31 +32,10 @@ type NodeConfigResponse struct {
 }
 
 // GetNodeConfig 获取节点自身配置
-func (c *ManagerClient) GetNodeConfig() (*NodeConfigResponse, error) {
-	url := fmt.Sprintf("%s/api/node/config", c.baseURL)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
-	}
-
+func (c *ManagerClient) GetNodeConfig(ctx context.Context) (*NodeConfigResponse, error) {
 	var configResp NodeConfigResponse
-	if err := json.NewDecoder(resp.Body).Decode(&configResp); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := c.client.Get(ctx, "/api/node/config", &configResp); err != nil {
+		return nil, err
 	}
 
 	return &configResp, nil
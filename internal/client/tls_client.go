@@ -1,29 +1,26 @@
 package client
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 	"time"
+
+	"otun-node-agent/internal/controlplane"
 )
 
+// TLSTimeout TLS 服务单次请求超时（证书申请可能需要较长时间）
+const TLSTimeout = 60 * time.Second
+
 // TLSClient TLS 服务客户端
 type TLSClient struct {
-	baseURL    string
-	apiKey     string
-	httpClient *http.Client
+	client *controlplane.Client
 }
 
 // NewTLSClient 创建 TLS 客户端
-func NewTLSClient(baseURL, apiKey string) *TLSClient {
-	return &TLSClient{
-		baseURL: baseURL,
-		apiKey:  apiKey,
-		httpClient: &http.Client{
-			Timeout: 60 * time.Second, // 证书申请可能需要较长时间
-		},
-	}
+func NewTLSClient(client *controlplane.Client) *TLSClient {
+	return &TLSClient{client: client}
 }
 
 // CertResponse 证书响应
@@ -37,66 +34,23 @@ type CertResponse struct {
 }
 
 // GetCertificate 获取证书（仅当已存在时）
-func (c *TLSClient) GetCertificate(domain string) (*CertResponse, error) {
-	url := fmt.Sprintf("%s/api/certs/%s", c.baseURL, domain)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("certificate not found for domain: %s", domain)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
-	}
-
+func (c *TLSClient) GetCertificate(ctx context.Context, domain string) (*CertResponse, error) {
 	var certResp CertResponse
-	if err := json.NewDecoder(resp.Body).Decode(&certResp); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := c.client.Get(ctx, "/api/certs/"+url.PathEscape(domain), &certResp); err != nil {
+		if controlplane.StatusCode(err) == http.StatusNotFound {
+			return nil, fmt.Errorf("certificate not found for domain: %s", domain)
+		}
+		return nil, err
 	}
 
 	return &certResp, nil
 }
 
-// EnsureCertificate 确保证书存在（不存在则申请）
-func (c *TLSClient) EnsureCertificate(domain string) (*CertResponse, error) {
-	url := fmt.Sprintf("%s/api/certs/%s/ensure", c.baseURL, domain)
-
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
-	}
-
+// EnsureCertificate 确保证书存在（不存在则申请），重复调用是安全的
+func (c *TLSClient) EnsureCertificate(ctx context.Context, domain string) (*CertResponse, error) {
 	var certResp CertResponse
-	if err := json.NewDecoder(resp.Body).Decode(&certResp); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := c.client.PostJSON(ctx, "/api/certs/"+url.PathEscape(domain)+"/ensure", nil, &certResp, true); err != nil {
+		return nil, err
 	}
 
 	return &certResp, nil
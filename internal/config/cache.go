@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"otun-node-agent/internal/persist"
 )
 
 // Cache 管理本地配置缓存（离线容错）
@@ -25,7 +27,7 @@ func (c *Cache) SaveUsers(resp *UsersResponse) error {
 	if err != nil {
 		return fmt.Errorf("marshal users: %w", err)
 	}
-	return os.WriteFile(path, data, 0644)
+	return persist.WriteFile(path, data, 0644)
 }
 
 // LoadUsers 从本地加载用户列表
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CertCheckOptions 证书校验参数
+type CertCheckOptions struct {
+	Domain string         // 证书必须覆盖的域名，为空时不检查
+	Now    time.Time      // 零值为当前时间
+	Roots  *x509.CertPool // 为 nil 时使用系统根证书
+}
+
+// ValidateCertificate 安装前校验证书：PEM 可解析、私钥与证书匹配、SAN 覆盖域名、
+// 处于有效期内、能通过中间证书构建到受信任根证书的链
+// certPEM 可以是单张证书或完整链（叶子证书在前），chainPEM 可为空
+func ValidateCertificate(certPEM, keyPEM, chainPEM []byte, opts CertCheckOptions) (*CertInfo, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %w", err)
+	}
+	leaf := certs[0]
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("key pair: %w", err)
+	}
+
+	if opts.Domain != "" {
+		if err := leaf.VerifyHostname(opts.Domain); err != nil {
+			return nil, fmt.Errorf("certificate does not cover %s (SAN: %v)", opts.Domain, leaf.DNSNames)
+		}
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if !now.Before(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if len(chainPEM) > 0 {
+		chain, err := parseCertificates(chainPEM)
+		if err != nil {
+			return nil, fmt.Errorf("chain: %w", err)
+		}
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+	}
+
+	roots := opts.Roots
+	if roots == nil {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("load system roots: %w", err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("verify chain: %w", err)
+	}
+
+	return &CertInfo{
+		Subject:   leaf.Subject.CommonName,
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}, nil
+}
+
+// parseCertificates 解析 PEM 中的全部证书，至少一张
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
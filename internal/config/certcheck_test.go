@@ -0,0 +1,181 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert 测试用证书和私钥
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var testSerial int64
+
+// issueTestCert 签发证书，parent 为 nil 时自签名
+func issueTestCert(t *testing.T, parent *testCert, tmpl *x509.Certificate) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl.SerialNumber = big.NewInt(testSerial)
+	if tmpl.IsCA {
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// testChain 根证书 → 中间证书 → 叶子证书
+func testChain(t *testing.T, domain string, notBefore, notAfter time.Time) (root, intermediate, leaf *testCert) {
+	t.Helper()
+
+	root = issueTestCert(t, nil, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Test Root"}, IsCA: true,
+		NotBefore: notBefore.Add(-time.Hour), NotAfter: notAfter.Add(time.Hour),
+	})
+	intermediate = issueTestCert(t, root, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Test Intermediate"}, IsCA: true,
+		NotBefore: notBefore.Add(-time.Hour), NotAfter: notAfter.Add(time.Hour),
+	})
+	leaf = issueTestCert(t, intermediate, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: domain},
+		DNSNames:  []string{domain},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	})
+	return root, intermediate, leaf
+}
+
+func TestValidateCertificate(t *testing.T) {
+	now := time.Now()
+	root, intermediate, leaf := testChain(t, "vpn.example.com", now.Add(-time.Hour), now.Add(30*24*time.Hour))
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	opts := CertCheckOptions{Domain: "vpn.example.com", Roots: roots}
+
+	if _, err := ValidateCertificate(leaf.certPEM, leaf.keyPEM, intermediate.certPEM, opts); err != nil {
+		t.Fatalf("valid chain rejected: %v", err)
+	}
+
+	// 完整链放在 cert 中
+	fullchain := append(append([]byte(nil), leaf.certPEM...), intermediate.certPEM...)
+	info, err := ValidateCertificate(fullchain, leaf.keyPEM, nil, opts)
+	if err != nil {
+		t.Fatalf("fullchain rejected: %v", err)
+	}
+	if !info.NotAfter.Equal(leaf.cert.NotAfter) {
+		t.Fatalf("NotAfter = %v, want leaf %v", info.NotAfter, leaf.cert.NotAfter)
+	}
+
+	other := issueTestCert(t, intermediate, &x509.Certificate{
+		DNSNames: []string{"vpn.example.com"}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour),
+	})
+	_, expiredIntermediate, expired := testChain(t, "vpn.example.com", now.Add(-48*time.Hour), now.Add(-time.Hour))
+
+	tests := []struct {
+		name                 string
+		cert, key, chain     []byte
+		domain, wantContains string
+	}{
+		{"garbage", []byte("not a pem"), leaf.keyPEM, nil, "vpn.example.com", "no PEM certificate"},
+		{"key mismatch", leaf.certPEM, other.keyPEM, intermediate.certPEM, "vpn.example.com", "key pair"},
+		{"wrong domain", leaf.certPEM, leaf.keyPEM, intermediate.certPEM, "other.example.com", "does not cover"},
+		{"missing intermediate", leaf.certPEM, leaf.keyPEM, nil, "vpn.example.com", "verify chain"},
+		{"expired", expired.certPEM, expired.keyPEM, expiredIntermediate.certPEM, "vpn.example.com", "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateCertificate(tt.cert, tt.key, tt.chain, CertCheckOptions{Domain: tt.domain, Roots: roots})
+			if err == nil || !strings.Contains(err.Error(), tt.wantContains) {
+				t.Fatalf("err = %v, want containing %q", err, tt.wantContains)
+			}
+		})
+	}
+}
+
+func TestCertManagerInstallRollback(t *testing.T) {
+	now := time.Now()
+	root, intermediate, first := testChain(t, "vpn.example.com", now.Add(-time.Hour), now.Add(10*24*time.Hour))
+	second := issueTestCert(t, intermediate, &x509.Certificate{
+		DNSNames: []string{"vpn.example.com"}, NotBefore: now.Add(-time.Hour), NotAfter: now.Add(20 * 24 * time.Hour),
+	})
+
+	m := NewCertManager(t.TempDir())
+	m.roots = x509.NewCertPool()
+	m.roots.AddCert(root.cert)
+
+	if _, err := m.Install(first.certPEM, first.keyPEM, intermediate.certPEM, "vpn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 校验失败时不替换当前证书
+	if _, err := m.Install(second.certPEM, first.keyPEM, intermediate.certPEM, "vpn.example.com"); err == nil {
+		t.Fatal("mismatched key accepted")
+	}
+	if data, _ := os.ReadFile(m.GetCertPath()); string(data) != string(first.certPEM) {
+		t.Fatal("rejected update replaced current certificate")
+	}
+
+	if _, err := m.Install(second.certPEM, second.keyPEM, intermediate.certPEM, "vpn.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Installed(second.certPEM, second.keyPEM) || m.Installed(first.certPEM, first.keyPEM) {
+		t.Fatal("Installed should match only the current pair")
+	}
+	if expiresAt, _ := m.ExpiresAt(); !expiresAt.Equal(second.cert.NotAfter) {
+		t.Fatalf("installed certificate expires at %v, want %v", expiresAt, second.cert.NotAfter)
+	}
+
+	if err := m.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := os.ReadFile(m.GetCertPath())
+	key, _ := os.ReadFile(m.GetKeyPath())
+	if string(cert) != string(first.certPEM) || string(key) != string(first.keyPEM) {
+		t.Fatal("rollback did not restore previous pair")
+	}
+	if !m.HasValidCert() {
+		t.Fatal("restored certificate should be valid")
+	}
+}
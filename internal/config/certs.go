@@ -1,12 +1,20 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"otun-node-agent/internal/client"
+	"otun-node-agent/internal/persist"
 )
 
 // CertManager 证书管理器
@@ -15,6 +23,7 @@ type CertManager struct {
 	certPath  string
 	keyPath   string
 	chainPath string
+	roots     *x509.CertPool // 校验证书链的根证书，nil 为系统根证书（测试时替换）
 }
 
 // NewCertManager 创建证书管理器
@@ -40,63 +49,262 @@ func (m *CertManager) GetKeyPath() string {
 	return m.keyPath
 }
 
-// HasValidCert 检查是否有有效的证书
-func (m *CertManager) HasValidCert() bool {
-	// 简单检查文件是否存在
+// CertInfo 证书基本信息
+type CertInfo struct {
+	Subject   string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// IsValidAt 证书在 now 时刻是否处于有效期内
+func (c *CertInfo) IsValidAt(now time.Time) bool {
+	return !now.Before(c.NotBefore) && now.Before(c.NotAfter)
+}
+
+// HasCertFiles 检查证书和私钥文件是否存在（不检查内容和有效期）
+func (m *CertManager) HasCertFiles() bool {
 	_, certErr := os.Stat(m.certPath)
 	_, keyErr := os.Stat(m.keyPath)
 	return certErr == nil && keyErr == nil
 }
 
-// SaveCert 保存证书
-func (m *CertManager) SaveCert(cert *client.CertResponse) error {
-	// 写入证书
-	if err := os.WriteFile(m.certPath, []byte(cert.Cert), 0644); err != nil {
-		return fmt.Errorf("write cert: %w", err)
+// HasValidCert 检查是否有可用的证书：文件存在、私钥匹配且在有效期内
+func (m *CertManager) HasValidCert() bool {
+	if !m.HasCertFiles() {
+		return false
+	}
+	if _, err := tls.LoadX509KeyPair(m.certPath, m.keyPath); err != nil {
+		log.Printf("[CertManager] Ignoring unusable certificate: %v", err)
+		return false
+	}
+	info, err := m.Info()
+	if err != nil {
+		log.Printf("[CertManager] Ignoring unreadable certificate: %v", err)
+		return false
+	}
+	if !info.IsValidAt(time.Now()) {
+		log.Printf("[CertManager] WARNING: certificate for %v is outside its validity period (%s - %s)",
+			info.DNSNames, info.NotBefore.Format(time.RFC3339), info.NotAfter.Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// Info 解析当前证书（证书链文件中的第一张）
+func (m *CertManager) Info() (*CertInfo, error) {
+	data, err := os.ReadFile(m.certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read cert: %w", err)
 	}
+	return ParseCertInfo(data)
+}
 
-	// 写入私钥 (严格权限)
-	if err := os.WriteFile(m.keyPath, []byte(cert.Key), 0600); err != nil {
-		return fmt.Errorf("write key: %w", err)
+// ParseCertInfo 解析 PEM 证书中的第一张证书
+func ParseCertInfo(pemData []byte) (*CertInfo, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
 	}
 
-	// 写入证书链 (如果有)
-	if cert.Chain != "" {
-		if err := os.WriteFile(m.chainPath, []byte(cert.Chain), 0644); err != nil {
-			return fmt.Errorf("write chain: %w", err)
-		}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse cert: %w", err)
 	}
+	return &CertInfo{
+		Subject:   cert.Subject.CommonName,
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}, nil
+}
 
-	log.Printf("[CertManager] Certificate saved, expires at: %s", cert.ExpiresAt.Format("2006-01-02"))
+// ExpiresAt 解析当前证书的过期时间
+func (m *CertManager) ExpiresAt() (time.Time, error) {
+	info, err := m.Info()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.NotAfter, nil
+}
+
+// SaveCert 校验并安装 TLS 服务返回的证书
+func (m *CertManager) SaveCert(cert *client.CertResponse, domain string) error {
+	info, err := m.Install([]byte(cert.Cert), []byte(cert.Key), []byte(cert.Chain), domain)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[CertManager] Certificate saved, expires at: %s", info.NotAfter.Format("2006-01-02"))
 	return nil
 }
 
 // FetchAndSaveCert 从 TLS 服务获取并保存证书
-func (m *CertManager) FetchAndSaveCert(tlsClient *client.TLSClient, domain string) error {
+func (m *CertManager) FetchAndSaveCert(ctx context.Context, tlsClient *client.TLSClient, domain string) error {
 	log.Printf("[CertManager] Fetching certificate for domain: %s", domain)
 
 	// 尝试确保证书存在（不存在则申请）
-	cert, err := tlsClient.EnsureCertificate(domain)
+	cert, err := tlsClient.EnsureCertificate(ctx, domain)
 	if err != nil {
 		return fmt.Errorf("ensure certificate: %w", err)
 	}
 
-	return m.SaveCert(cert)
+	return m.SaveCert(cert, domain)
 }
 
-// SaveCertFromUpdate 保存从心跳响应中收到的证书更新
-func (m *CertManager) SaveCertFromUpdate(update *CertUpdate) error {
-	// 写入证书
-	if err := os.WriteFile(m.certPath, []byte(update.Cert), 0644); err != nil {
-		return fmt.Errorf("write cert: %w", err)
+// Renew 通过 TLS 服务获取证书，比当前证书更晚过期时保存并返回 true
+// TLS 服务尚未续期时返回 false，由调用方稍后重试
+func (m *CertManager) Renew(ctx context.Context, tlsClient *client.TLSClient, domain string) (bool, error) {
+	cert, err := tlsClient.EnsureCertificate(ctx, domain)
+	if err != nil {
+		return false, fmt.Errorf("ensure certificate: %w", err)
 	}
 
-	// 写入私钥 (严格权限)
-	if err := os.WriteFile(m.keyPath, []byte(update.Key), 0600); err != nil {
-		return fmt.Errorf("write key: %w", err)
+	fetched, err := ParseCertInfo([]byte(cert.Cert))
+	if err != nil {
+		return false, fmt.Errorf("TLS service returned invalid certificate: %w", err)
+	}
+	if current, err := m.Info(); err == nil && !fetched.NotAfter.After(current.NotAfter) {
+		return false, nil
+	}
+
+	if err := m.SaveCert(cert, domain); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SaveCertFromUpdate 校验并安装从心跳响应中收到的证书更新
+// domain 为节点的 VPN 域名，为空时使用更新中的域名
+func (m *CertManager) SaveCertFromUpdate(update *CertUpdate, domain string) (*CertInfo, error) {
+	if domain == "" {
+		domain = update.Domain
+	}
+	info, err := m.Install([]byte(update.Cert), []byte(update.Key), []byte(update.Chain), domain)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Printf("[CertManager] Certificate updated from heartbeat, domain: %s, expires at: %s",
-		update.Domain, update.ExpiresAt)
+		domain, info.NotAfter.Format(time.RFC3339))
+	return info, nil
+}
+
+// prevSuffix 上一组证书的备份后缀，新证书应用失败时回滚
+const prevSuffix = ".prev"
+
+// newSuffix 待安装证书的临时后缀
+const newSuffix = ".new"
+
+// Install 校验并安装证书，当前证书保留为 .prev 供 Rollback 使用
+// 新文件全部写好后才开始替换，校验失败或写入失败时当前证书不受影响
+func (m *CertManager) Install(certPEM, keyPEM, chainPEM []byte, domain string) (*CertInfo, error) {
+	info, err := ValidateCertificate(certPEM, keyPEM, chainPEM, CertCheckOptions{Domain: domain, Roots: m.roots})
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	type certFile struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}
+	files := []certFile{
+		{m.certPath, certPEM, 0644},
+		{m.keyPath, keyPEM, 0600}, // 私钥严格权限
+	}
+	if len(chainPEM) > 0 {
+		files = append(files, certFile{m.chainPath, chainPEM, 0644})
+	}
+
+	for _, f := range files {
+		if err := persist.WriteFile(f.path+newSuffix, f.data, f.perm); err != nil {
+			m.removeStaged()
+			return nil, fmt.Errorf("write %s: %w", filepath.Base(f.path), err)
+		}
+	}
+
+	if err := m.backup(); err != nil {
+		m.removeStaged()
+		return nil, fmt.Errorf("backup current certificate: %w", err)
+	}
+
+	if len(chainPEM) == 0 {
+		// 新证书没有单独的证书链，旧链不再适用
+		os.Remove(m.chainPath)
+	}
+	for _, f := range files {
+		if err := persist.Rename(f.path+newSuffix, f.path); err != nil {
+			m.removeStaged()
+			if rbErr := m.Rollback(); rbErr != nil {
+				log.Printf("[CertManager] Rollback failed: %v", rbErr)
+			}
+			return nil, fmt.Errorf("install certificate: %w", err)
+		}
+	}
+	return info, nil
+}
+
+// Installed 当前证书和私钥是否与给定内容相同（重复下发的更新无需重新安装）
+func (m *CertManager) Installed(certPEM, keyPEM []byte) bool {
+	cert, err := os.ReadFile(m.certPath)
+	if err != nil {
+		return false
+	}
+	key, err := os.ReadFile(m.keyPath)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(cert, certPEM) && bytes.Equal(key, keyPEM)
+}
+
+// backup 将当前证书、私钥和证书链复制为 .prev（不存在的文件清除旧备份）
+func (m *CertManager) backup() error {
+	for _, path := range m.files() {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			os.Remove(path + prevSuffix)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		perm := os.FileMode(0644)
+		if path == m.keyPath {
+			perm = 0600
+		}
+		if err := persist.WriteFile(path+prevSuffix, data, perm); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Rollback 恢复 Install 之前的证书（新证书应用到 sing-box 失败时调用）
+// 安装前没有证书时删除新证书
+func (m *CertManager) Rollback() error {
+	for _, path := range m.files() {
+		prev := path + prevSuffix
+		if _, err := os.Stat(prev); err == nil {
+			if err := persist.Rename(prev, path); err != nil {
+				return err
+			}
+		} else if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	log.Println("[CertManager] Restored previous certificate")
+	return nil
+}
+
+// removeStaged 清理未安装的临时文件
+func (m *CertManager) removeStaged() {
+	for _, path := range m.files() {
+		os.Remove(path + newSuffix)
+	}
+}
+
+func (m *CertManager) files() []string {
+	return []string{m.certPath, m.keyPath, m.chainPath}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成自签名证书并写入 CertManager 的路径
+func writeTestCert(t *testing.T, m *CertManager, notBefore, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vpn.example.com"},
+		DNSNames:     []string{"vpn.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.GetCertPath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(m.GetCertPath(), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(m.GetKeyPath(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertManagerValidity(t *testing.T) {
+	now := time.Now()
+	m := NewCertManager(t.TempDir())
+
+	if m.HasValidCert() {
+		t.Fatal("no certificate should not be valid")
+	}
+
+	notAfter := now.Add(10 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, m, now.Add(-time.Hour), notAfter)
+	if !m.HasValidCert() {
+		t.Fatal("current certificate should be valid")
+	}
+	expiresAt, err := m.ExpiresAt()
+	if err != nil || !expiresAt.Equal(notAfter) {
+		t.Fatalf("ExpiresAt = %v, %v; want %v", expiresAt, err, notAfter)
+	}
+
+	writeTestCert(t, m, now.Add(-48*time.Hour), now.Add(-time.Hour))
+	if m.HasValidCert() {
+		t.Fatal("expired certificate should not be valid")
+	}
+	if !m.HasCertFiles() {
+		t.Fatal("expired certificate files should still be reported as present")
+	}
+	info, err := m.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.IsValidAt(now) || !info.IsValidAt(now.Add(-2*time.Hour)) {
+		t.Fatalf("unexpected validity for %v - %v", info.NotBefore, info.NotAfter)
+	}
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDeltaChainBroken 增量无法应用到本地版本，需要全量同步
+var ErrDeltaChainBroken = errors.New("user delta chain broken")
+
+// UsersDelta 管理服务器返回的增量用户变更（相对于 Since 版本）
+type UsersDelta struct {
+	Version string   `json:"version"`
+	Since   string   `json:"since"`
+	Added   []User   `json:"added"`
+	Updated []User   `json:"updated"`
+	Removed []string `json:"removed"` // 被删除用户的 UUID
+}
+
+// ApplyDelta 将增量应用到 base 上，返回新的完整用户列表（不修改 base）
+// 保持 base 中用户的顺序，新增用户追加在末尾
+func ApplyDelta(base *UsersResponse, delta *UsersDelta) (*UsersResponse, error) {
+	if base == nil || base.Version == "" {
+		return nil, fmt.Errorf("%w: no base version", ErrDeltaChainBroken)
+	}
+	if delta.Since != base.Version {
+		return nil, fmt.Errorf("%w: delta since %q, local version %q",
+			ErrDeltaChainBroken, delta.Since, base.Version)
+	}
+
+	removed := make(map[string]bool, len(delta.Removed))
+	for _, uuid := range delta.Removed {
+		removed[uuid] = true
+	}
+
+	// 新增和更新统一按 UUID 覆盖（更新了本地不存在的用户也视为新增）
+	changed := make(map[string]User, len(delta.Added)+len(delta.Updated))
+	var order []string
+	for _, list := range [][]User{delta.Added, delta.Updated} {
+		for _, u := range list {
+			if _, seen := changed[u.UUID]; !seen {
+				order = append(order, u.UUID)
+			}
+			changed[u.UUID] = u
+		}
+	}
+
+	result := &UsersResponse{
+		Version: delta.Version,
+		Config:  base.Config,
+		Users:   make([]User, 0, len(base.Users)+len(delta.Added)),
+	}
+
+	for _, u := range base.Users {
+		if removed[u.UUID] {
+			continue
+		}
+		if updated, ok := changed[u.UUID]; ok {
+			u = updated
+			delete(changed, u.UUID)
+		}
+		result.Users = append(result.Users, u)
+	}
+	for _, uuid := range order {
+		if u, ok := changed[uuid]; ok && !removed[uuid] {
+			result.Users = append(result.Users, u)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"otun-node-agent/internal/controlplane"
+)
+
+// TestApplyDelta 测试增量应用：保持顺序、更新、删除、追加新增用户
+func TestApplyDelta(t *testing.T) {
+	base := &UsersResponse{
+		Version: "v1",
+		Users: []User{
+			{UUID: "a", SSPassword: "a"},
+			{UUID: "b", SSPassword: "b"},
+			{UUID: "c", SSPassword: "c"},
+		},
+	}
+
+	result, err := ApplyDelta(base, &UsersDelta{
+		Version: "v2",
+		Since:   "v1",
+		Added:   []User{{UUID: "d", SSPassword: "d"}},
+		Updated: []User{{UUID: "b", SSPassword: "b2"}},
+		Removed: []string{"a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Version != "v2" || len(result.Users) != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	want := []string{"b2", "c", "d"}
+	for i, u := range result.Users {
+		if u.SSPassword != want[i] {
+			t.Errorf("User %d: expected %s, got %s", i, want[i], u.SSPassword)
+		}
+	}
+	if len(base.Users) != 3 || base.Users[1].SSPassword != "b" {
+		t.Error("Base must not be modified")
+	}
+
+	// 基准版本不匹配时要求全量同步
+	if _, err := ApplyDelta(base, &UsersDelta{Version: "v3", Since: "v2"}); !errors.Is(err, ErrDeltaChainBroken) {
+		t.Errorf("Expected ErrDeltaChainBroken, got %v", err)
+	}
+}
+
+// TestSyncUsersDeltaConfigFields 测试增量中出现的配置字段才会覆盖，null 和空字符串可以清除配置
+func TestSyncUsersDeltaConfigFields(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	syncer := NewSyncer(controlplane.New(controlplane.Options{BaseURL: srv.URL}))
+
+	base := &UsersResponse{Version: "v1", Users: []User{{UUID: "u1", Enabled: true}}}
+	base.Config.RealitySNI = "www.example.com"
+	base.Config.RoutePolicy = &RoutePolicy{BlockBitTorrent: true}
+
+	sync := func(b string) *UsersResponse {
+		t.Helper()
+		body = b
+		result, err := syncer.SyncUsers(context.Background(), base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Delta {
+			t.Fatal("expected a delta sync")
+		}
+		return result.Users
+	}
+
+	// 没有 config：保持不变
+	users := sync(`{"delta":true,"since":"v1","version":"v2","updated":[{"uuid":"u1","enabled":false}]}`)
+	if users.Config.RealitySNI != "www.example.com" || users.Config.RoutePolicy == nil {
+		t.Fatalf("config = %+v, want unchanged", users.Config)
+	}
+
+	// route_policy 为 null：清除路由策略，SNI 不变
+	users = sync(`{"delta":true,"since":"v1","version":"v2","config":{"route_policy":null}}`)
+	if users.Config.RoutePolicy != nil || users.Config.RealitySNI != "www.example.com" {
+		t.Fatalf("config = %+v, want route policy cleared", users.Config)
+	}
+
+	// reality_sni 为空字符串：清除 SNI
+	users = sync(`{"delta":true,"since":"v1","version":"v2","config":{"reality_sni":""}}`)
+	if users.Config.RealitySNI != "" || users.Config.RoutePolicy == nil {
+		t.Fatalf("config = %+v, want SNI cleared", users.Config)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"log"
 	"os"
 	"strconv"
 	"time"
@@ -18,8 +19,8 @@ func LoadFromEnv() *AgentConfig {
 		APIURL:         getEnv("OTUN_API_URL", "https://saasapi.situstechnologies.com"),
 		NodeAPIKey:     getEnv("NODE_API_KEY", ""),
 		NodeID:         getEnv("NODE_ID", "node-default"),
-		SyncInterval:   getDurationEnv("SYNC_INTERVAL", 60) * time.Second,
-		StatsInterval:  getDurationEnv("STATS_INTERVAL", 60) * time.Second,
+		SyncInterval:   getIntervalEnv("SYNC_INTERVAL", 60),
+		StatsInterval:  getIntervalEnv("STATS_INTERVAL", 60),
 		VLESSPort:      getIntEnv("VLESS_PORT", 443),
 		SSPort:         getIntEnv("SS_PORT", 8388),
 		VmessPort:      getIntEnv("VMESS_PORT", 0),     // 0 表示未启用
@@ -33,6 +34,37 @@ func LoadFromEnv() *AgentConfig {
 		ManagementMode: mode,
 		ServerIP:       getEnv("SERVER_IP", ""),            // 服务器公网 IP，用于生成连接 URL
 		TLSServiceKey:  getEnv("TLS_SERVICE_API_KEY", ""),  // TLS 服务 API Key (用于拉取证书)
+		SubBaseURL:     getEnv("SUB_BASE_URL", ""),         // 订阅地址前缀（反向代理/HTTPS 时设置）
+		MetricsPerUser: getBoolEnv("METRICS_PER_USER", false),
+		MetricsAddr:    getEnv("METRICS_ADDR", "127.0.0.1:9100"),
+		MetricsToken:   getEnv("METRICS_TOKEN", ""),
+
+		IPLimitInterval: getIntervalEnv("IP_LIMIT_INTERVAL", 15),
+		IPLimitGrace:    getDurationEnv("IP_LIMIT_GRACE", 60) * time.Second,
+
+		PushEnabled: getBoolEnv("PUSH_ENABLED", false),
+		PushURL:     getEnv("PUSH_URL", ""),
+
+		CertRenewBefore: getDurationEnv("CERT_RENEW_BEFORE_DAYS", 30) * 24 * time.Hour,
+
+		StatsJournalMaxSize: int64(getIntEnv("STATS_JOURNAL_MAX_MB", 16)) << 20,
+		StatsJournalPolicy:  getEnv("STATS_JOURNAL_FULL_POLICY", "coalesce"),
+
+		StatsPerProtocol: getBoolEnv("STATS_PER_PROTOCOL", false),
+
+		HistoryHourlyRetention: getDurationEnv("HISTORY_HOURLY_DAYS", 7) * 24 * time.Hour,
+		HistoryDailyRetention:  getDurationEnv("HISTORY_DAILY_DAYS", 90) * 24 * time.Hour,
+		HistoryMonthlyMonths:   getIntEnv("HISTORY_MONTHLY_MONTHS", 24),
+
+		RoutePolicy: RoutePolicy{
+			AllowPrivate:    !getBoolEnv("ROUTE_BLOCK_PRIVATE", true),
+			BlockBitTorrent: getBoolEnv("ROUTE_BLOCK_BITTORRENT", false),
+			Sniff:           getBoolEnv("ROUTE_SNIFF", false),
+			BlockDomains:    SplitList(getEnv("ROUTE_BLOCK_DOMAINS", "")),
+			BlockIPs:        SplitList(getEnv("ROUTE_BLOCK_IPS", "")),
+			RuleSets:        SplitList(getEnv("ROUTE_RULE_SETS", "")),
+		},
+		RoutePolicyFile: getEnv("ROUTE_POLICY_FILE", ""),
 	}
 }
 
@@ -52,6 +84,25 @@ func getIntEnv(key string, defaultVal int) int {
 	return defaultVal
 }
 
+func getBoolEnv(key string, defaultVal bool) bool {
+	if val := os.Getenv(key); val != "" {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return defaultVal
+}
+
 func getDurationEnv(key string, defaultVal int) time.Duration {
 	return time.Duration(getIntEnv(key, defaultVal))
 }
+
+// getIntervalEnv 读取定时任务间隔（秒），必须为正数，否则使用默认值
+func getIntervalEnv(key string, defaultSeconds int) time.Duration {
+	seconds := getIntEnv(key, defaultSeconds)
+	if seconds <= 0 {
+		log.Printf("WARNING: %s=%d is not a positive number of seconds, using default %d", key, seconds, defaultSeconds)
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
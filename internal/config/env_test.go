@@ -0,0 +1,20 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadFromEnvRejectsNonPositiveIntervals(t *testing.T) {
+	t.Setenv("IP_LIMIT_INTERVAL", "0")
+	t.Setenv("SYNC_INTERVAL", "-5")
+	t.Setenv("STATS_INTERVAL", "30")
+
+	cfg := LoadFromEnv()
+	if cfg.IPLimitInterval != 15*time.Second || cfg.SyncInterval != 60*time.Second {
+		t.Fatalf("intervals = %v / %v, want defaults", cfg.IPLimitInterval, cfg.SyncInterval)
+	}
+	if cfg.StatsInterval != 30*time.Second {
+		t.Fatalf("stats interval = %v, want 30s", cfg.StatsInterval)
+	}
+}
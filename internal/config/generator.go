@@ -3,32 +3,163 @@ package config
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"maps"
+	"reflect"
+	"sync"
+
+	"otun-node-agent/internal/persist"
 )
 
-// Generator 生成 sing-box 配置
+// GeneratorOptions 配置生成器参数
+type GeneratorOptions struct {
+	Ports      map[string]int // 协议名 -> 端口，0 或缺失表示不启用
+	PrivateKey string         // Reality 私钥
+	ShortIDs   []string       // Reality short_id 列表
+	VpnDomain  string         // TLS 域名
+	CertPath   string         // TLS 证书路径
+	KeyPath    string         // TLS 私钥路径
+
+	// PerProtocolStats 按协议统计用户流量：sing-box 用户名为 uuid@protocol
+	PerProtocolStats bool
+
+	Route RoutePolicy // 路由策略（零值阻止内网/本机地址）
+}
+
+// Generator 生成 sing-box 配置（local / remote / hybrid 模式共用）
+// 每个协议的具体结构由已注册的 Protocol 模块负责
 type Generator struct {
-	vlessPort  int
-	ssPort     int
-	privateKey string
-	shortIDs   []string
+	mu   sync.RWMutex
+	opts GeneratorOptions
 }
 
-// NewGenerator 创建配置生成器
+// NewGenerator 创建配置生成器（仅 VLESS + Shadowsocks）
 func NewGenerator(vlessPort, ssPort int, privateKey string, shortIDs []string) *Generator {
-	return &Generator{
-		vlessPort:  vlessPort,
-		ssPort:     ssPort,
-		privateKey: privateKey,
-		shortIDs:   shortIDs,
+	return NewGeneratorWithOptions(GeneratorOptions{
+		Ports: map[string]int{
+			"vless":       vlessPort,
+			"shadowsocks": ssPort,
+		},
+		PrivateKey: privateKey,
+		ShortIDs:   shortIDs,
+	})
+}
+
+// NewGeneratorWithOptions 使用完整参数创建配置生成器
+func NewGeneratorWithOptions(opts GeneratorOptions) *Generator {
+	ports := make(map[string]int, len(opts.Ports))
+	for name, port := range opts.Ports {
+		ports[name] = port
+	}
+	opts.Ports = ports
+	return &Generator{opts: opts}
+}
+
+// SetPort 设置协议端口（0 表示禁用该协议）
+func (g *Generator) SetPort(protocol string, port int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.opts.Ports[protocol] = port
+}
+
+// Port 获取协议端口
+func (g *Generator) Port(protocol string) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.opts.Ports[protocol]
+}
+
+// SetTLS 设置 TLS 证书（certPath 或 keyPath 为空时禁用所有 TLS 协议）
+func (g *Generator) SetTLS(domain, certPath, keyPath string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.opts.VpnDomain = domain
+	g.opts.CertPath = certPath
+	g.opts.KeyPath = keyPath
+}
+
+// TLSEnabled 是否已设置 TLS 证书
+func (g *Generator) TLSEnabled() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.opts.CertPath != "" && g.opts.KeyPath != ""
+}
+
+// WantsTLS 是否配置了需要 TLS 证书的协议（端口 > 0）
+func (g *Generator) WantsTLS() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, p := range Protocols() {
+		if p.RequiresTLS() && g.opts.Ports[p.Name()] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRoutePolicy 设置路由策略，返回策略是否变化
+func (g *Generator) SetRoutePolicy(p RoutePolicy) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	changed := !reflect.DeepEqual(g.opts.Route, p)
+	g.opts.Route = p
+	return changed
+}
+
+// SetReality 设置 Reality 私钥和 short_id 列表（密钥轮换）
+func (g *Generator) SetReality(privateKey string, shortIDs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.opts.PrivateKey = privateKey
+	g.opts.ShortIDs = append([]string(nil), shortIDs...)
+}
+
+// EnabledProtocols 返回当前会生成 inbound 的协议（按注册顺序）
+func (g *Generator) EnabledProtocols() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var names []string
+	for _, p := range g.enabledLocked() {
+		names = append(names, p.Name())
 	}
+	return names
+}
+
+// enabledLocked 端口 > 0 且满足 TLS 条件的协议（调用方需持有锁）
+func (g *Generator) enabledLocked() []Protocol {
+	hasTLSCert := g.opts.CertPath != "" && g.opts.KeyPath != ""
+
+	var result []Protocol
+	for _, p := range Protocols() {
+		if g.opts.Ports[p.Name()] <= 0 {
+			continue
+		}
+		if p.RequiresTLS() && !hasTLSCert {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
 }
 
 // Generate 根据用户列表生成 sing-box 配置
 // circuitBreakerEnabled: 如果为 true，则禁用所有用户（熔断状态）
 func (g *Generator) Generate(users []User, realitySNI string, circuitBreakerEnabled bool) map[string]any {
-	var vlessUsers []map[string]any
-	var ssUsers []map[string]any
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if realitySNI == "" {
+		realitySNI = DefaultRealitySNI
+	}
+
+	enabled := g.enabledLocked()
+	enabledByName := make(map[string]Protocol, len(enabled))
+	for _, p := range enabled {
+		enabledByName[p.Name()] = p
+	}
+
+	// 按协议分类用户
+	protoUsers := make(map[string][]map[string]any)
 	var statsUsers []string
 
 	for _, u := range users {
@@ -38,23 +169,25 @@ func (g *Generator) Generate(users []User, realitySNI string, circuitBreakerEnab
 		}
 
 		// 关键修复：无论用户使用哪些协议，都加入统计列表
-		// 这样可以确保 sing-box V2Ray API 统计该用户的所有流量（VLESS + Shadowsocks）
+		// 这样可以确保 sing-box V2Ray API 统计该用户的所有流量
 		// 从而实现跨协议的统一流量限制
-		statsUsers = append(statsUsers, u.UUID)
+		if !g.opts.PerProtocolStats {
+			statsUsers = append(statsUsers, u.UUID)
+		}
 
 		for _, proto := range u.Protocols {
-			switch proto {
-			case "vless":
-				vlessUsers = append(vlessUsers, map[string]any{
-					"name": u.UUID, // name 用于 V2Ray API 用户流量统计
-					"uuid": u.UUID,
-					"flow": "xtls-rprx-vision",
-				})
-			case "shadowsocks":
-				ssUsers = append(ssUsers, map[string]any{
-					"name":     u.UUID,
-					"password": u.SSPassword,
-				})
+			p, ok := enabledByName[proto]
+			if !ok {
+				continue
+			}
+			if entry := p.BuildUser(u); entry != nil {
+				// 按协议统计：每个协议使用不同的用户名，收集时再按 UUID 汇总
+				if g.opts.PerProtocolStats {
+					name := StatsUserName(u.UUID, proto)
+					entry["name"] = name
+					statsUsers = append(statsUsers, name)
+				}
+				protoUsers[proto] = append(protoUsers[proto], entry)
 			}
 		}
 	}
@@ -65,53 +198,29 @@ func (g *Generator) Generate(users []User, realitySNI string, circuitBreakerEnab
 			"timestamp": true,
 		},
 		"outbounds": []map[string]any{
-			{"type": "direct", "tag": "direct"},
+			{"type": "direct", "tag": OutboundDirect},
+			{"type": "block", "tag": OutboundBlock},
 		},
+		"route": g.opts.Route.buildRoute(),
 	}
 
-	var inbounds []map[string]any
+	inboundOpts := g.opts.Route.inboundOptions()
 
-	// VLESS + Reality inbound - 始终创建，即使没有用户
-	// 这样 sing-box 可以启动并监听端口，等待用户添加
-	vlessInbound := map[string]any{
-		"type":        "vless",
-		"tag":         "vless-in",
-		"listen":      "::",
-		"listen_port": g.vlessPort,
-		"tls": map[string]any{
-			"enabled":     true,
-			"server_name": realitySNI,
-			"reality": map[string]any{
-				"enabled": true,
-				"handshake": map[string]any{
-					"server":      realitySNI,
-					"server_port": 443,
-				},
-				"private_key": g.privateKey,
-				"short_id":    g.shortIDs,
-			},
-		},
-	}
-	if len(vlessUsers) > 0 {
-		vlessInbound["users"] = vlessUsers
-	} else {
-		// 空用户列表，sing-box 需要这个字段
-		vlessInbound["users"] = []map[string]any{}
-	}
-	inbounds = append(inbounds, vlessInbound)
-
-	// Shadowsocks inbound - 只在有用户时创建
-	// sing-box 的 Shadowsocks 要求必须有密码，空 users 数组会导致启动失败
-	if len(ssUsers) > 0 {
-		ssInbound := map[string]any{
-			"type":        "shadowsocks",
-			"tag":         "ss-in",
-			"listen":      "::",
-			"listen_port": g.ssPort,
-			"method":      "chacha20-ietf-poly1305",
-			"users":       ssUsers,
+	var inbounds []map[string]any
+	for _, p := range enabled {
+		ctx := &InboundContext{
+			Port:       g.opts.Ports[p.Name()],
+			RealitySNI: realitySNI,
+			PrivateKey: g.opts.PrivateKey,
+			ShortIDs:   g.opts.ShortIDs,
+			ServerName: g.opts.VpnDomain,
+			CertPath:   g.opts.CertPath,
+			KeyPath:    g.opts.KeyPath,
+		}
+		if inbound := p.BuildInbound(ctx, protoUsers[p.Name()]); inbound != nil {
+			maps.Copy(inbound, inboundOpts)
+			inbounds = append(inbounds, inbound)
 		}
-		inbounds = append(inbounds, ssInbound)
 	}
 
 	config["inbounds"] = inbounds
@@ -130,9 +239,10 @@ func (g *Generator) Generate(users []User, realitySNI string, circuitBreakerEnab
 		"v2ray_api": map[string]any{
 			"listen": "127.0.0.1:10085",
 			"stats": map[string]any{
-				"enabled":  true,
-				"inbounds": statsInbounds,
-				"users":    statsUsers,
+				"enabled":   true,
+				"inbounds":  statsInbounds,
+				"outbounds": []string{OutboundDirect, OutboundBlock},
+				"users":     statsUsers,
 			},
 		},
 	}
@@ -140,14 +250,23 @@ func (g *Generator) Generate(users []User, realitySNI string, circuitBreakerEnab
 	return config
 }
 
+// Marshal 将配置序列化为 JSON
+func (g *Generator) Marshal(config map[string]any) ([]byte, error) {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return data, nil
+}
+
 // WriteToFile 将配置写入文件
 func (g *Generator) WriteToFile(config map[string]any, path string) error {
-	data, err := json.MarshalIndent(config, "", "  ")
+	data, err := g.Marshal(config)
 	if err != nil {
-		return fmt.Errorf("marshal config: %w", err)
+		return err
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := persist.WriteFile(path, data, 0644); err != nil {
 		return fmt.Errorf("write file: %w", err)
 	}
 
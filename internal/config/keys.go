@@ -3,14 +3,15 @@ package config
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
 
 	"golang.org/x/crypto/curve25519"
+
+	"otun-node-agent/internal/persist"
 )
 
 // NodeSecrets 存储节点密钥和端口配置
@@ -19,6 +20,8 @@ type NodeSecrets struct {
 	PublicKey  string   `json:"public_key"`
 	ShortIDs   []string `json:"short_ids"`
 	SSPort     int      `json:"ss_port"` // 随机生成的 SS 端口
+
+	Rotation *RealityRotation `json:"rotation,omitempty"` // 进行中的密钥轮换
 }
 
 // GenerateKeyPair 生成新的 Reality 密钥对
@@ -34,9 +37,9 @@ func GenerateKeyPair() (*NodeSecrets, error) {
 	curve25519.ScalarBaseMult(&publicKey, &privateKey)
 
 	// 生成 short_id
-	shortID := make([]byte, 8)
-	if _, err := rand.Read(shortID); err != nil {
-		return nil, fmt.Errorf("generate short_id: %w", err)
+	shortID, err := generateShortID()
+	if err != nil {
+		return nil, err
 	}
 
 	// 生成随机 SS 端口 (10000-60000)
@@ -48,7 +51,7 @@ func GenerateKeyPair() (*NodeSecrets, error) {
 	return &NodeSecrets{
 		PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey[:]),
 		PublicKey:  base64.RawURLEncoding.EncodeToString(publicKey[:]),
-		ShortIDs:   []string{hex.EncodeToString(shortID)},
+		ShortIDs:   []string{shortID},
 		SSPort:     ssPort,
 	}, nil
 }
@@ -63,38 +66,41 @@ func randomPort(min, max int) (int, error) {
 }
 
 // LoadOrGenerateSecrets 加载或生成节点密钥
+// 密钥文件损坏时返回错误：重新生成会让所有客户端失效，必须人工处理
 func LoadOrGenerateSecrets(cacheDir string) (*NodeSecrets, error) {
 	path := filepath.Join(cacheDir, "secrets.json")
 
 	// 尝试加载现有密钥
-	if data, err := os.ReadFile(path); err == nil {
-		var secrets NodeSecrets
-		if err := json.Unmarshal(data, &secrets); err == nil {
-			// 兼容旧版本：如果没有 SS 端口，生成一个
-			if secrets.SSPort == 0 {
-				secrets.SSPort, _ = randomPort(10000, 60000)
-				// 保存更新
-				data, _ := json.MarshalIndent(secrets, "", "  ")
-				os.WriteFile(path, data, 0600)
+	var secrets NodeSecrets
+	err := persist.ReadJSON(path, &secrets)
+	if err == nil {
+		// 兼容旧版本：如果没有 SS 端口，生成一个
+		if secrets.SSPort == 0 {
+			secrets.SSPort, _ = randomPort(10000, 60000)
+			// 保存更新
+			if err := persist.WriteJSON(path, &secrets, 0600); err != nil {
+				return nil, fmt.Errorf("save secrets: %w", err)
 			}
-			return &secrets, nil
 		}
+		return &secrets, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load secrets: %w", err)
 	}
 
 	// 生成新密钥
-	secrets, err := GenerateKeyPair()
+	newSecrets, err := GenerateKeyPair()
 	if err != nil {
 		return nil, err
 	}
 
 	// 保存到文件
-	data, _ := json.MarshalIndent(secrets, "", "  ")
 	os.MkdirAll(cacheDir, 0755)
-	if err := os.WriteFile(path, data, 0600); err != nil {
+	if err := persist.WriteJSON(path, newSecrets, 0600); err != nil {
 		return nil, fmt.Errorf("save secrets: %w", err)
 	}
 
-	return secrets, nil
+	return newSecrets, nil
 }
 
 // 兼容旧接口
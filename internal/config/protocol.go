@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultRealitySNI 默认 Reality 握手目标
+const DefaultRealitySNI = "www.microsoft.com"
+
+// SSMethod Shadowsocks 加密方式
+const SSMethod = "chacha20-ietf-poly1305"
+
+// Protocol 协议模块：负责某一协议的用户条目、inbound 以及分享链接
+// 新增协议只需实现此接口并在 init 中调用 RegisterProtocol
+type Protocol interface {
+	// Name 协议名称，与 User.Protocols 中的取值一致
+	Name() string
+	// Tag inbound 标签（同时用于 V2Ray API 统计）
+	Tag() string
+	// RequiresTLS 是否需要 TLS 证书（VMess/Trojan/Hysteria2/TUIC）
+	RequiresTLS() bool
+	// BuildUser 生成 inbound 中的用户条目，返回 nil 表示跳过该用户
+	BuildUser(u User) map[string]any
+	// BuildInbound 生成 inbound 配置，返回 nil 表示不创建该 inbound
+	BuildInbound(ctx *InboundContext, users []map[string]any) map[string]any
+	// ShareURL 生成客户端分享链接，无法生成时返回空字符串
+	ShareURL(link *ShareLink, u User, name string) string
+	// ClientOutbound 生成 sing-box 客户端 outbound，无法生成时返回 nil
+	ClientOutbound(link *ShareLink, u User, tag string) map[string]any
+	// ClashProxy 生成 Clash/mihomo 代理条目，无法生成时返回 nil
+	ClashProxy(link *ShareLink, u User, name string) map[string]any
+}
+
+// InboundContext 生成 inbound 所需的节点参数
+type InboundContext struct {
+	Port       int
+	RealitySNI string
+	PrivateKey string
+	ShortIDs   []string
+	ServerName string // TLS 域名
+	CertPath   string
+	KeyPath    string
+}
+
+// ShareLink 生成分享链接所需的节点参数
+type ShareLink struct {
+	Server     string // 服务器地址（IP）
+	Port       int
+	RealitySNI string
+	PublicKey  string
+	ShortID    string
+	ServerName string // TLS 域名，TLS 协议优先使用它作为连接地址
+	SSMethod   string
+}
+
+var (
+	protocolsMu    sync.RWMutex
+	protocolOrder  []string
+	protocolByName = make(map[string]Protocol)
+)
+
+// RegisterProtocol 注册协议模块（重复注册会 panic）
+func RegisterProtocol(p Protocol) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+
+	if _, exists := protocolByName[p.Name()]; exists {
+		panic(fmt.Sprintf("protocol already registered: %s", p.Name()))
+	}
+	protocolByName[p.Name()] = p
+	protocolOrder = append(protocolOrder, p.Name())
+}
+
+// GetProtocol 按名称获取协议模块
+func GetProtocol(name string) (Protocol, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	p, ok := protocolByName[name]
+	return p, ok
+}
+
+// Protocols 按注册顺序返回所有协议模块
+func Protocols() []Protocol {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	result := make([]Protocol, 0, len(protocolOrder))
+	for _, name := range protocolOrder {
+		result = append(result, protocolByName[name])
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"otun-node-agent/internal/persist"
+)
+
+// 默认轮换时间
+const (
+	DefaultRealitySwitchAfter = 24 * time.Hour // 新公钥下发到客户端后再切换私钥
+	DefaultRealityOverlap     = 72 * time.Hour // 切换后旧 short_id 继续有效的时间
+)
+
+// ErrRotationInProgress 已有轮换在进行中
+var ErrRotationInProgress = errors.New("reality rotation already in progress")
+
+// RealityRotation Reality 密钥轮换状态
+// 流程：开始 → 新 short_id 立即生效（与旧的并存），新公钥提前通知管理端
+//
+//	→ SwitchAt 切换私钥，旧 short_id 进入退役期
+//	→ RetireAt 移除旧 short_id，轮换结束
+type RealityRotation struct {
+	StartedAt         time.Time `json:"started_at"`
+	PendingPrivateKey string    `json:"pending_private_key,omitempty"` // 切换前的新私钥
+	PendingPublicKey  string    `json:"pending_public_key,omitempty"`
+	SwitchAt          time.Time `json:"switch_at"`
+	Overlap           Duration  `json:"overlap"`
+	RetiringShortIDs  []string  `json:"retiring_short_ids"` // 轮换前的 short_id
+	RetireAt          time.Time `json:"retire_at"`          // 切换后才确定
+}
+
+// Switched 私钥是否已切换
+func (r *RealityRotation) Switched() bool {
+	return r.PendingPrivateKey == ""
+}
+
+// Duration 以秒为单位序列化的时长
+type Duration int64
+
+// Std 转换为 time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d) * time.Second
+}
+
+// RealityStatus Reality 密钥状态（对外展示，不含私钥）
+type RealityStatus struct {
+	PublicKey        string     `json:"public_key"`
+	ShortIDs         []string   `json:"short_ids"`
+	Rotating         bool       `json:"rotating"`
+	PendingPublicKey string     `json:"pending_public_key,omitempty"`
+	SwitchAt         *time.Time `json:"switch_at,omitempty"`
+	RetiringShortIDs []string   `json:"retiring_short_ids,omitempty"`
+	RetireAt         *time.Time `json:"retire_at,omitempty"`
+}
+
+// Status 返回当前密钥和轮换状态
+func (s *NodeSecrets) Status() *RealityStatus {
+	status := &RealityStatus{
+		PublicKey: s.PublicKey,
+		ShortIDs:  append([]string(nil), s.ShortIDs...),
+	}
+	if r := s.Rotation; r != nil {
+		status.Rotating = true
+		status.PendingPublicKey = r.PendingPublicKey
+		status.RetiringShortIDs = append([]string(nil), r.RetiringShortIDs...)
+		if !r.Switched() {
+			switchAt := r.SwitchAt
+			status.SwitchAt = &switchAt
+		} else if !r.RetireAt.IsZero() {
+			retireAt := r.RetireAt
+			status.RetireAt = &retireAt
+		}
+	}
+	return status
+}
+
+// StartRotation 开始轮换：生成新密钥对和新 short_id
+// 新 short_id 放在列表最前面并立即生效（分享链接使用 ShortIDs[0]），
+// 新私钥在 switchAfter 后启用，之后旧 short_id 再保留 overlap
+func (s *NodeSecrets) StartRotation(now time.Time, switchAfter, overlap time.Duration) error {
+	if s.Rotation != nil {
+		return ErrRotationInProgress
+	}
+
+	next, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+
+	shortID, err := generateShortID()
+	if err != nil {
+		return err
+	}
+
+	s.Rotation = &RealityRotation{
+		StartedAt:         now,
+		PendingPrivateKey: next.PrivateKey,
+		PendingPublicKey:  next.PublicKey,
+		SwitchAt:          now.Add(switchAfter),
+		Overlap:           Duration(overlap / time.Second),
+		RetiringShortIDs:  append([]string(nil), s.ShortIDs...),
+	}
+	s.ShortIDs = append([]string{shortID}, s.ShortIDs...)
+	return nil
+}
+
+// AdvanceRotation 推进轮换到期的步骤，返回密钥或 short_id 是否有变化
+func (s *NodeSecrets) AdvanceRotation(now time.Time) bool {
+	r := s.Rotation
+	if r == nil {
+		return false
+	}
+
+	changed := false
+
+	// 切换私钥
+	if !r.Switched() && !now.Before(r.SwitchAt) {
+		s.PrivateKey = r.PendingPrivateKey
+		s.PublicKey = r.PendingPublicKey
+		r.PendingPrivateKey = ""
+		r.RetireAt = now.Add(r.Overlap.Std())
+		changed = true
+	}
+
+	// 退役旧 short_id
+	if r.Switched() && !now.Before(r.RetireAt) {
+		retiring := make(map[string]bool, len(r.RetiringShortIDs))
+		for _, id := range r.RetiringShortIDs {
+			retiring[id] = true
+		}
+		kept := s.ShortIDs[:0:0]
+		for _, id := range s.ShortIDs {
+			if !retiring[id] {
+				kept = append(kept, id)
+			}
+		}
+		s.ShortIDs = kept
+		s.Rotation = nil
+		changed = true
+	}
+
+	return changed
+}
+
+// SaveSecrets 保存节点密钥
+func SaveSecrets(cacheDir string, secrets *NodeSecrets) error {
+	path := filepath.Join(cacheDir, "secrets.json")
+	if err := persist.WriteJSON(path, secrets, 0600); err != nil {
+		return fmt.Errorf("save secrets: %w", err)
+	}
+	return nil
+}
+
+// generateShortID 生成 8 字节 short_id
+func generateShortID() (string, error) {
+	shortID := make([]byte, 8)
+	if _, err := rand.Read(shortID); err != nil {
+		return "", fmt.Errorf("generate short_id: %w", err)
+	}
+	return hex.EncodeToString(shortID), nil
+}
+
+// Clone 深拷贝（修改副本、保存成功后再替换，避免保存失败时内存与文件不一致）
+func (s *NodeSecrets) Clone() *NodeSecrets {
+	c := *s
+	c.ShortIDs = append([]string(nil), s.ShortIDs...)
+	if s.Rotation != nil {
+		r := *s.Rotation
+		r.RetiringShortIDs = append([]string(nil), s.Rotation.RetiringShortIDs...)
+		c.Rotation = &r
+	}
+	return &c
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRealityRotation 测试轮换各阶段的公钥和 short_id 变化
+func TestRealityRotation(t *testing.T) {
+	secrets, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := secrets.PublicKey
+	oldShortID := secrets.ShortIDs[0]
+
+	start := time.Now()
+	if err := secrets.StartRotation(start, time.Hour, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.StartRotation(start, time.Hour, 2*time.Hour); err != ErrRotationInProgress {
+		t.Errorf("Expected ErrRotationInProgress, got %v", err)
+	}
+
+	// 开始后：新旧 short_id 并存，公钥不变
+	newShortID := secrets.ShortIDs[0]
+	if len(secrets.ShortIDs) != 2 || secrets.ShortIDs[1] != oldShortID {
+		t.Fatalf("Expected new short_id prepended, got %v", secrets.ShortIDs)
+	}
+	if secrets.PublicKey != oldKey || secrets.Rotation.PendingPublicKey == "" {
+		t.Fatal("Key must not switch before SwitchAt")
+	}
+	if secrets.AdvanceRotation(start.Add(30 * time.Minute)) {
+		t.Error("Nothing should change before SwitchAt")
+	}
+
+	// 切换私钥：旧 short_id 仍然有效
+	newKey := secrets.Rotation.PendingPublicKey
+	if !secrets.AdvanceRotation(start.Add(time.Hour)) {
+		t.Fatal("Expected key switch at SwitchAt")
+	}
+	if secrets.PublicKey != newKey || len(secrets.ShortIDs) != 2 {
+		t.Fatalf("Unexpected state after switch: key=%s short_ids=%v", secrets.PublicKey, secrets.ShortIDs)
+	}
+
+	// 退役旧 short_id
+	if !secrets.AdvanceRotation(start.Add(3 * time.Hour)) {
+		t.Fatal("Expected old short_ids to retire")
+	}
+	if secrets.Rotation != nil || len(secrets.ShortIDs) != 1 || secrets.ShortIDs[0] != newShortID {
+		t.Errorf("Unexpected state after retire: rotation=%v short_ids=%v", secrets.Rotation, secrets.ShortIDs)
+	}
+}
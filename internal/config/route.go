@@ -0,0 +1,199 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"otun-node-agent/internal/persist"
+)
+
+// 出站标签
+const (
+	OutboundDirect = "direct"
+	OutboundBlock  = "block"
+)
+
+// privateCIDRs 默认阻止的目标地址：本机、内网、链路本地（含云厂商元数据 169.254.169.254）、
+// 运营商级 NAT、组播等非公网地址，防止用户通过代理访问节点本机服务（V2Ray API、Agent API）和内网
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// privateDomains 解析到本机的域名（后缀匹配）
+var privateDomains = []string{"localhost"}
+
+// RoutePolicy sing-box 路由策略：阻止用户访问哪些目标
+// 零值即默认策略：阻止内网/本机地址，不嗅探
+type RoutePolicy struct {
+	AllowPrivate    bool     `json:"allow_private,omitempty"`    // 允许访问内网、本机、链路本地地址
+	BlockBitTorrent bool     `json:"block_bittorrent,omitempty"` // 阻止 BitTorrent（自动开启嗅探）
+	Sniff           bool     `json:"sniff,omitempty"`            // 在 inbound 上开启协议嗅探
+	BlockDomains    []string `json:"block_domains,omitempty"`    // 阻止的域名（后缀匹配）
+	BlockIPs        []string `json:"block_ips,omitempty"`        // 阻止的 IP 或 CIDR
+	RuleSets        []string `json:"rule_sets,omitempty"`        // 本地 rule-set 文件（.srs 二进制或 .json 源格式），匹配的目标被阻止
+}
+
+// LoadRoutePolicy 从 JSON 文件读取路由策略
+func LoadRoutePolicy(path string) (*RoutePolicy, error) {
+	var p RoutePolicy
+	if err := persist.ReadJSON(path, &p); err != nil {
+		return nil, fmt.Errorf("read route policy: %w", err)
+	}
+	return &p, nil
+}
+
+// Validate 检查 IP 格式和 rule-set 文件，避免生成 sing-box 无法启动的配置
+func (p *RoutePolicy) Validate() error {
+	for _, s := range p.BlockIPs {
+		if _, err := parsePrefix(s); err != nil {
+			return fmt.Errorf("invalid block_ips entry %q", s)
+		}
+	}
+	for _, d := range p.BlockDomains {
+		if strings.TrimSpace(d) == "" {
+			return errors.New("empty block_domains entry")
+		}
+	}
+	for _, path := range p.RuleSets {
+		if _, err := ruleSetFormat(path); err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("rule-set %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// sniffEnabled 是否需要在 inbound 上开启嗅探
+func (p *RoutePolicy) sniffEnabled() bool {
+	return p.Sniff || p.BlockBitTorrent
+}
+
+// inboundOptions 需要加到每个 inbound 上的字段
+func (p *RoutePolicy) inboundOptions() map[string]any {
+	opts := make(map[string]any)
+	if p.sniffEnabled() {
+		opts["sniff"] = true
+	}
+	if !p.AllowPrivate {
+		// 路由前先解析域名，否则解析到内网地址的域名（如 localtest.me）不会匹配 IP 规则
+		opts["domain_strategy"] = "prefer_ipv4"
+	}
+	return opts
+}
+
+// buildRoute 生成 route 段：命中规则的流量走 block 出站，其余直连
+func (p *RoutePolicy) buildRoute() map[string]any {
+	var rules []map[string]any
+	block := func(rule map[string]any) {
+		rule["outbound"] = OutboundBlock
+		rules = append(rules, rule)
+	}
+
+	if !p.AllowPrivate {
+		block(map[string]any{"ip_cidr": privateCIDRs})
+		block(map[string]any{"domain_suffix": privateDomains})
+	}
+	if p.BlockBitTorrent {
+		block(map[string]any{"protocol": []string{"bittorrent"}})
+	}
+	if len(p.BlockDomains) > 0 {
+		block(map[string]any{"domain_suffix": p.BlockDomains})
+	}
+	if len(p.BlockIPs) > 0 {
+		cidrs := make([]string, 0, len(p.BlockIPs))
+		for _, s := range p.BlockIPs {
+			if prefix, err := parsePrefix(s); err == nil {
+				cidrs = append(cidrs, prefix.String())
+			}
+		}
+		block(map[string]any{"ip_cidr": cidrs})
+	}
+
+	route := map[string]any{
+		"final": OutboundDirect,
+	}
+	if len(p.RuleSets) > 0 {
+		var ruleSets []map[string]any
+		var tags []string
+		for i, path := range p.RuleSets {
+			format, err := ruleSetFormat(path)
+			if err != nil {
+				continue
+			}
+			tag := fmt.Sprintf("block-%d", i)
+			ruleSets = append(ruleSets, map[string]any{
+				"type":   "local",
+				"tag":    tag,
+				"format": format,
+				"path":   path,
+			})
+			tags = append(tags, tag)
+		}
+		if len(tags) > 0 {
+			route["rule_set"] = ruleSets
+			block(map[string]any{"rule_set": tags})
+		}
+	}
+	if len(rules) > 0 {
+		route["rules"] = rules
+	}
+	return route
+}
+
+// parsePrefix 解析 IP 或 CIDR，单个 IP 视为 /32 或 /128
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ruleSetFormat 根据扩展名确定 rule-set 格式
+func ruleSetFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".srs":
+		return "binary", nil
+	case ".json":
+		return "source", nil
+	}
+	return "", fmt.Errorf("rule-set %s: expected .srs or .json file", path)
+}
+
+// SplitList 解析逗号分隔的列表（环境变量），忽略空项
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// blockRules 返回 route 中走 block 出站的规则
+func blockRules(t *testing.T, cfg map[string]any) []map[string]any {
+	t.Helper()
+	route, ok := cfg["route"].(map[string]any)
+	if !ok || route["final"] != OutboundDirect {
+		t.Fatalf("route section missing or final not direct: %v", cfg["route"])
+	}
+	rules, _ := route["rules"].([]map[string]any)
+	for _, r := range rules {
+		if r["outbound"] != OutboundBlock {
+			t.Fatalf("unexpected rule %v", r)
+		}
+	}
+	return rules
+}
+
+func TestRoutePolicyDefaultBlocksPrivate(t *testing.T) {
+	gen := NewGenerator(443, 8388, "key", []string{"sid"})
+	cfg := gen.Generate([]User{{UUID: "u1", Protocols: []string{"vless"}, Enabled: true}}, "", false)
+
+	rules := blockRules(t, cfg)
+	if len(rules) != 2 {
+		t.Fatalf("default policy should have private ip and localhost rules, got %v", rules)
+	}
+	cidrs := rules[0]["ip_cidr"].([]string)
+	for _, want := range []string{"127.0.0.0/8", "10.0.0.0/8", "169.254.0.0/16", "fc00::/7", "::1/128"} {
+		if !slices.Contains(cidrs, want) {
+			t.Errorf("private CIDR %s not blocked", want)
+		}
+	}
+
+	for _, inbound := range cfg["inbounds"].([]map[string]any) {
+		if inbound["domain_strategy"] != "prefer_ipv4" {
+			t.Errorf("inbound %s should resolve domains before routing", inbound["tag"])
+		}
+		if _, ok := inbound["sniff"]; ok {
+			t.Errorf("inbound %s should not sniff by default", inbound["tag"])
+		}
+	}
+}
+
+func TestRoutePolicyOptions(t *testing.T) {
+	dir := t.TempDir()
+	ruleSet := filepath.Join(dir, "ads.srs")
+	os.WriteFile(ruleSet, []byte("srs"), 0644)
+
+	policy := RoutePolicy{
+		AllowPrivate:    true,
+		BlockBitTorrent: true,
+		BlockDomains:    []string{"example.com"},
+		BlockIPs:        []string{"203.0.113.7", "198.51.100.0/24"},
+		RuleSets:        []string{ruleSet},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	gen := NewGeneratorWithOptions(GeneratorOptions{Ports: map[string]int{"vless": 443}, Route: policy})
+	cfg := gen.Generate([]User{{UUID: "u1", Protocols: []string{"vless"}, Enabled: true}}, "", false)
+
+	rules := blockRules(t, cfg)
+	if len(rules) != 4 {
+		t.Fatalf("expected bittorrent, domain, ip and rule-set rules, got %v", rules)
+	}
+	if ips := rules[2]["ip_cidr"].([]string); !slices.Equal(ips, []string{"203.0.113.7/32", "198.51.100.0/24"}) {
+		t.Errorf("block ips = %v", ips)
+	}
+	ruleSets := cfg["route"].(map[string]any)["rule_set"].([]map[string]any)
+	if len(ruleSets) != 1 || ruleSets[0]["format"] != "binary" || ruleSets[0]["path"] != ruleSet {
+		t.Errorf("rule_set = %v", ruleSets)
+	}
+
+	inbound := cfg["inbounds"].([]map[string]any)[0]
+	if inbound["sniff"] != true {
+		t.Error("blocking bittorrent requires sniffing")
+	}
+	if _, ok := inbound["domain_strategy"]; ok {
+		t.Error("domain_strategy is only needed when private networks are blocked")
+	}
+
+	for _, bad := range []RoutePolicy{
+		{BlockIPs: []string{"not-an-ip"}},
+		{RuleSets: []string{filepath.Join(dir, "missing.srs")}},
+		{RuleSets: []string{filepath.Join(dir, "ads.txt")}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", bad)
+		}
+	}
+}
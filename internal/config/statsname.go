@@ -0,0 +1,20 @@
+package config
+
+import "strings"
+
+// statsNameSep 按协议统计时 sing-box 用户名中 UUID 与协议名的分隔符（UUID 中不会出现）
+const statsNameSep = "@"
+
+// StatsUserName 按协议统计时写入 sing-box 的用户名：uuid@protocol
+// V2Ray API 按用户名统计流量，同一用户在每个协议下使用不同的名字才能分开统计
+func StatsUserName(uuid, protocol string) string {
+	return uuid + statsNameSep + protocol
+}
+
+// ParseStatsUserName 从 sing-box 用户名解析 UUID 和协议（未按协议统计时协议为空）
+func ParseStatsUserName(name string) (uuid, protocol string) {
+	if i := strings.LastIndex(name, statsNameSep); i >= 0 {
+		return name[:i], name[i+len(statsNameSep):]
+	}
+	return name, ""
+}
@@ -1,31 +1,28 @@
 package config
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
+
+	"otun-node-agent/internal/controlplane"
 )
 
 // Syncer 负责从管理服务器同步用户配置
 type Syncer struct {
-	apiURL      string
-	apiKey      string
-	httpClient  *http.Client
+	client      *controlplane.Client
 	lastVersion string
 }
 
 // NewSyncer 创建配置同步器
-func NewSyncer(apiURL, apiKey string) *Syncer {
-	return &Syncer{
-		apiURL: apiURL,
-		apiKey: apiKey,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}
+func NewSyncer(client *controlplane.Client) *Syncer {
+	return &Syncer{client: client}
 }
 
 // RegisterRequest 节点注册请求
@@ -35,6 +32,10 @@ type RegisterRequest struct {
 	PublicKey string         `json:"public_key"`
 	ShortIDs  []string       `json:"short_ids"`
 	Protocols map[string]any `json:"protocols"`
+
+	// Reality 密钥轮换中：切换时间之后客户端需使用新公钥
+	NextPublicKey string     `json:"next_public_key,omitempty"`
+	KeySwitchAt   *time.Time `json:"key_switch_at,omitempty"`
 }
 
 // RegisterConfig 注册配置参数
@@ -49,11 +50,14 @@ type RegisterConfig struct {
 	Hysteria2Port int    // 可选：Hysteria2 端口
 	TuicPort      int    // 可选：TUIC 端口
 	VpnDomain     string // 可选：VPN TLS 域名
+
+	NextPublicKey string     // 可选：轮换中的新 Reality 公钥
+	KeySwitchAt   *time.Time // 可选：新公钥生效时间
 }
 
 // Register 向管理服务器注册节点 (兼容旧接口)
-func (s *Syncer) Register(nodeID, publicKey string, shortIDs []string, vlessPort, ssPort int) error {
-	return s.RegisterWithConfig(&RegisterConfig{
+func (s *Syncer) Register(ctx context.Context, nodeID, publicKey string, shortIDs []string, vlessPort, ssPort int) error {
+	return s.RegisterWithConfig(ctx, &RegisterConfig{
 		NodeID:    nodeID,
 		PublicKey: publicKey,
 		ShortIDs:  shortIDs,
@@ -63,9 +67,7 @@ func (s *Syncer) Register(nodeID, publicKey string, shortIDs []string, vlessPort
 }
 
 // RegisterWithConfig 向管理服务器注册节点 (支持多协议)
-func (s *Syncer) RegisterWithConfig(cfg *RegisterConfig) error {
-	url := fmt.Sprintf("%s/api/node/register", s.apiURL)
-
+func (s *Syncer) RegisterWithConfig(ctx context.Context, cfg *RegisterConfig) error {
 	// 构建协议配置
 	protocols := map[string]any{
 		"vless_reality": map[string]any{
@@ -109,17 +111,19 @@ func (s *Syncer) RegisterWithConfig(cfg *RegisterConfig) error {
 		PublicKey: cfg.PublicKey,
 		ShortIDs:  cfg.ShortIDs,
 		Protocols: protocols,
+
+		NextPublicKey: cfg.NextPublicKey,
+		KeySwitchAt:   cfg.KeySwitchAt,
 	}
 
-	return s.postJSON(url, req, nil)
+	// 注册是幂等的（按 node_id 覆盖）
+	return s.client.PostJSON(ctx, "/api/node/register", req, nil, true)
 }
 
-// Heartbeat 发送心跳
-func (s *Syncer) Heartbeat(req *HeartbeatRequest) (*HeartbeatResponse, error) {
-	url := fmt.Sprintf("%s/api/node/heartbeat", s.apiURL)
-
+// Heartbeat 发送心跳（不重试：响应中的指令只应处理一次，下一次心跳很快就会到来）
+func (s *Syncer) Heartbeat(ctx context.Context, req *HeartbeatRequest) (*HeartbeatResponse, error) {
 	var resp HeartbeatResponse
-	if err := s.postJSON(url, req, &resp); err != nil {
+	if err := s.client.PostJSON(ctx, "/api/node/heartbeat", req, &resp, false); err != nil {
 		return nil, err
 	}
 
@@ -127,11 +131,9 @@ func (s *Syncer) Heartbeat(req *HeartbeatRequest) (*HeartbeatResponse, error) {
 }
 
 // ReportConnections 上报活跃连接
-func (s *Syncer) ReportConnections(report *ConnectionsReport) (*HeartbeatResponse, error) {
-	url := fmt.Sprintf("%s/api/node/connections", s.apiURL)
-
+func (s *Syncer) ReportConnections(ctx context.Context, report *ConnectionsReport) (*HeartbeatResponse, error) {
 	var resp HeartbeatResponse
-	if err := s.postJSON(url, report, &resp); err != nil {
+	if err := s.client.PostJSON(ctx, "/api/node/connections", report, &resp, false); err != nil {
 		return nil, err
 	}
 
@@ -139,84 +141,142 @@ func (s *Syncer) ReportConnections(report *ConnectionsReport) (*HeartbeatRespons
 }
 
 // FetchUsers 从管理服务器获取用户列表
-func (s *Syncer) FetchUsers() (*UsersResponse, error) {
-	url := fmt.Sprintf("%s/api/node/users", s.apiURL)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+s.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
-	}
-
+func (s *Syncer) FetchUsers(ctx context.Context) (*UsersResponse, error) {
 	var result UsersResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := s.client.Get(ctx, "/api/node/users", &result); err != nil {
+		return nil, err
 	}
 
 	s.lastVersion = result.Version
 	return &result, nil
 }
 
-// HasNewVersion 检查是否有新版本配置
-func (s *Syncer) HasNewVersion(version string) bool {
-	return s.lastVersion != version
+// UsersSyncResult 增量同步结果
+type UsersSyncResult struct {
+	Users       *UsersResponse // 同步后的完整用户列表
+	NotModified bool           // 服务器返回 304，Users 即 base
+	Delta       bool           // 通过增量得到
 }
 
-// AckCertUpdate 确认证书更新
-func (s *Syncer) AckCertUpdate(nodeID string) error {
-	url := fmt.Sprintf("%s/api/node/cert-ack", s.apiURL)
+// usersSyncPayload 用户同步响应：全量（users）或增量（delta=true）
+type usersSyncPayload struct {
+	UsersResponse
+	Delta   bool     `json:"delta"`
+	Since   string   `json:"since"`
+	Added   []User   `json:"added"`
+	Updated []User   `json:"updated"`
+	Removed []string `json:"removed"`
+
+	// configFields 响应中出现的 config 字段，增量据此区分"未变化"和"清除"
+	configFields map[string]json.RawMessage
+}
 
-	req := map[string]string{
-		"node_id": nodeID,
+func (p *usersSyncPayload) UnmarshalJSON(data []byte) error {
+	type plain usersSyncPayload
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
 	}
-
-	return s.postJSON(url, req, nil)
+	var present struct {
+		Config map[string]json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(data, &present); err != nil {
+		return err
+	}
+	p.configFields = present.Config
+	return nil
 }
 
-// postJSON 发送 JSON POST 请求
-func (s *Syncer) postJSON(url string, reqBody any, respBody any) error {
-	data, err := json.Marshal(reqBody)
+// SyncUsers 基于本地版本 base 同步用户
+// 有 base 时带 If-None-Match 和 since 请求：未变化返回 304，否则服务器可返回增量；
+// 增量无法衔接（版本不匹配、410 Gone）时自动退回全量同步
+func (s *Syncer) SyncUsers(ctx context.Context, base *UsersResponse) (*UsersSyncResult, error) {
+	if base != nil && base.Version != "" {
+		result, err := s.fetchUsersSince(ctx, base)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, ErrDeltaChainBroken) {
+			return nil, err
+		}
+		log.Printf("Delta sync unavailable (%v), falling back to full sync", err)
+	}
+
+	full, err := s.FetchUsers(ctx)
 	if err != nil {
-		return fmt.Errorf("marshal request: %w", err)
+		return nil, err
 	}
+	return &UsersSyncResult{Users: full}, nil
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+// fetchUsersSince 条件请求 + 增量同步
+func (s *Syncer) fetchUsersSince(ctx context.Context, base *UsersResponse) (*UsersSyncResult, error) {
+	var payload usersSyncPayload
+	resp, err := s.client.Do(ctx, controlplane.Request{
+		Method: http.MethodGet,
+		Path:   "/api/node/users?since=" + url.QueryEscape(base.Version),
+		Header: http.Header{"If-None-Match": {strconv.Quote(base.Version)}},
+	}, &payload)
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		// 服务器已不保留该版本之后的变更
+		if code := controlplane.StatusCode(err); code == http.StatusGone || code == http.StatusConflict {
+			return nil, fmt.Errorf("%w: server returned %d", ErrDeltaChainBroken, code)
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		s.lastVersion = base.Version
+		return &UsersSyncResult{Users: base, NotModified: true}, nil
 	}
 
-	req.Header.Set("Authorization", "Bearer "+s.apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	// 不支持增量的服务器直接返回全量
+	if !payload.Delta {
+		s.lastVersion = payload.UsersResponse.Version
+		return &UsersSyncResult{Users: &payload.UsersResponse}, nil
+	}
 
-	resp, err := s.httpClient.Do(req)
+	users, err := ApplyDelta(base, &UsersDelta{
+		Version: payload.Version,
+		Since:   payload.Since,
+		Added:   payload.Added,
+		Updated: payload.Updated,
+		Removed: payload.Removed,
+	})
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	// 增量响应只在配置变化时带上对应字段；字段存在即覆盖，空字符串或 null 表示清除
+	if _, ok := payload.configFields["reality_sni"]; ok {
+		users.Config.RealitySNI = payload.Config.RealitySNI
+	}
+	if _, ok := payload.configFields["route_policy"]; ok {
+		users.Config.RoutePolicy = payload.Config.RoutePolicy
+	}
+
+	s.lastVersion = users.Version
+	return &UsersSyncResult{Users: users, Delta: true}, nil
+}
+
+// HasNewVersion 检查是否有新版本配置
+func (s *Syncer) HasNewVersion(version string) bool {
+	return s.lastVersion != version
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+// AckCertUpdate 确认证书更新
+func (s *Syncer) AckCertUpdate(ctx context.Context, nodeID string) error {
+	req := map[string]string{
+		"node_id": nodeID,
 	}
 
-	if respBody != nil {
-		if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
-			return fmt.Errorf("decode response: %w", err)
-		}
+	return s.client.PostJSON(ctx, "/api/node/cert-ack", req, nil, true)
+}
+
+// ReportCertFailure 报告证书更新未能安装，管理端据此重新下发或告警
+func (s *Syncer) ReportCertFailure(ctx context.Context, nodeID, domain, reason string) error {
+	req := map[string]string{
+		"node_id": nodeID,
+		"domain":  domain,
+		"error":   reason,
 	}
 
-	return nil
+	return s.client.PostJSON(ctx, "/api/node/cert-failure", req, nil, true)
 }
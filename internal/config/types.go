@@ -33,8 +33,39 @@ type AgentConfig struct {
 	LogLevel       string
 	ManagementMode ManagementMode // 管理模式
 	ServerIP       string         // 服务器公网 IP（用于生成连接 URL）
+	SubBaseURL     string         // 订阅地址前缀（默认 http://SERVER_IP:8080）
+	MetricsPerUser bool           // /metrics 是否输出按用户区分的指标（标签值为用户 UUID，即连接凭证）
+	MetricsAddr    string         // /metrics 监听地址（独立于对外提供订阅的 :8080，默认只监听本机）
+	MetricsToken   string         // /metrics 的 Bearer Token（为空时不校验）
 	SingboxAPIAddr string         // sing-box V2Ray API 地址（本地统计端口）
 
+	// 并发 IP 限制
+	IPLimitInterval time.Duration // 扫描间隔
+	IPLimitGrace    time.Duration // 超限宽限期（移动网络切换 IP 时旧连接尚未断开）
+
+	// 管理端推送通道（SSE），断开时回退到心跳轮询
+	PushEnabled bool
+	PushURL     string // 默认 APIURL/api/node/push
+
+	// 证书在过期前多久开始续期
+	CertRenewBefore time.Duration
+
+	// 待上报统计日志
+	StatsJournalMaxSize int64  // 文件大小上限
+	StatsJournalPolicy  string // 写满时的策略：coalesce / drop_oldest / drop_newest
+
+	// 按协议统计用户流量（sing-box 用户名变为 uuid@protocol）
+	StatsPerProtocol bool
+
+	// 本地流量历史的保留时间（小时 / 天 / 月粒度）
+	HistoryHourlyRetention time.Duration
+	HistoryDailyRetention  time.Duration
+	HistoryMonthlyMonths   int
+
+	// 路由策略：环境变量组成的默认策略，设置了文件时使用文件内容；管理端下发的策略优先
+	RoutePolicy     RoutePolicy
+	RoutePolicyFile string
+
 	// 多协议模式 (remote 模式动态获取)
 	TLSServiceURL  string // TLS 服务地址 (从 manager 获取)
 	TLSServiceKey  string // TLS 服务 API Key
@@ -50,6 +81,7 @@ type User struct {
 	TrafficUsed   int64      `json:"traffic_used"`
 	ExpireAt      *time.Time `json:"expire_at"`
 	DeviceID      string     `json:"device_id"`       // 绑定的设备指纹
+	MaxIPs        int        `json:"max_ips"`         // 最大同时在线 IP 数，0=不限制
 }
 
 // UsersResponse 是管理服务器返回的用户列表
@@ -57,7 +89,8 @@ type UsersResponse struct {
 	Version string `json:"version"`
 	Users   []User `json:"users"`
 	Config  struct {
-		RealitySNI string `json:"reality_sni"`
+		RealitySNI  string       `json:"reality_sni"`
+		RoutePolicy *RoutePolicy `json:"route_policy,omitempty"` // 管理端下发的路由策略，覆盖本地配置
 	} `json:"config"`
 }
 
@@ -96,6 +129,15 @@ type HeartbeatRequest struct {
 	Timestamp time.Time `json:"timestamp"`
 	Load      NodeLoad  `json:"load"`
 	PublicIP  string    `json:"public_ip,omitempty"` // 公网 IPv4 地址
+
+	// 最近一次配置应用失败信息
+	ConfigError      string `json:"config_error,omitempty"`
+	ConfigRolledBack bool   `json:"config_rolled_back,omitempty"`
+
+	// TLS 证书状态（没有证书时为空）
+	CertExpiresAt    *time.Time `json:"cert_expires_at,omitempty"`
+	CertExpired      bool       `json:"cert_expired,omitempty"`       // 已过期，TLS 协议已停用
+	CertRenewalError string     `json:"cert_renewal_error,omitempty"` // 最近一次续期失败原因
 }
 
 // NodeLoad 节点负载信息
@@ -113,12 +155,21 @@ type HeartbeatResponse struct {
 	KickUsers   []string    `json:"kick_users"`             // 需要踢掉的用户
 	ReloadUsers bool        `json:"reload_users"`           // 是否需要重新拉取用户列表
 	CertUpdate  *CertUpdate `json:"cert_update,omitempty"`  // 证书更新 (如果有)
+
+	RotateReality *RealityRotateCommand `json:"rotate_reality,omitempty"` // 开始 Reality 密钥轮换
+}
+
+// RealityRotateCommand 管理端下发的密钥轮换指令（时长为秒，0 表示使用默认值）
+type RealityRotateCommand struct {
+	SwitchAfter int64 `json:"switch_after"`
+	Overlap     int64 `json:"overlap"`
 }
 
 // CertUpdate 证书更新信息
 type CertUpdate struct {
-	Domain    string `json:"domain"`     // 域名
-	Cert      string `json:"cert"`       // 证书内容 (PEM)
-	Key       string `json:"key"`        // 私钥内容 (PEM)
-	ExpiresAt string `json:"expires_at"` // 过期时间 (ISO8601)
+	Domain    string `json:"domain"`          // 域名
+	Cert      string `json:"cert"`            // 证书内容 (PEM)
+	Key       string `json:"key"`             // 私钥内容 (PEM)
+	Chain     string `json:"chain,omitempty"` // 中间证书链 (PEM，可为空或已包含在 cert 中)
+	ExpiresAt string `json:"expires_at"`      // 过期时间 (ISO8601)
 }
@@ -0,0 +1,90 @@
+package controlplane
+
+import (
+	"sync"
+	"time"
+)
+
+// 熔断默认参数
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// Breaker 熔断器：连续 threshold 次临时错误后打开，cooldown 内直接失败；
+// 冷却结束后放行一个探测请求，成功则关闭，失败则重新打开
+// 同一服务的多个 Client 共用一个 Breaker，管理端宕机时不会每个任务各自超时重试
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// NewBreaker 创建熔断器，参数 <= 0 时使用默认值
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow 是否允许发出请求
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	// 半开：只放行一个探测请求
+	b.probing = true
+	return true
+}
+
+// Success 记录成功（包括认证失败等非临时错误：服务端是可达的）
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure 记录临时错误
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// Abort 请求被调用方取消，结果未知：不计入成功或失败，只释放探测名额，
+// 否则被取消的探测会让熔断永远停在半开状态
+func (b *Breaker) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Open 熔断是否处于打开状态（用于指标）
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
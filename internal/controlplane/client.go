@@ -0,0 +1,360 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 默认参数
+const (
+	DefaultTimeout    = 30 * time.Second
+	DefaultMaxRetries = 2
+	DefaultBaseDelay  = 500 * time.Millisecond
+	DefaultMaxDelay   = 30 * time.Second
+)
+
+// maxErrorBody 错误响应最多读取的字节数
+const maxErrorBody = 4096
+
+// Options 客户端参数，零值字段使用默认值
+type Options struct {
+	BaseURL string
+	APIKey  string
+	NodeID  string // 写入 User-Agent，便于管理端定位节点
+	Version string // Agent 版本，写入 User-Agent
+
+	Timeout    time.Duration // 单次请求超时
+	MaxRetries int           // 可重试请求的最大重试次数，<0 表示不重试
+	BaseDelay  time.Duration // 第一次重试前的等待，之后指数增长
+	MaxDelay   time.Duration // 单次等待上限；Retry-After 超过该值时不再重试
+
+	Breaker    *Breaker     // 同一服务的多个 Client 可共用；nil 时单独创建
+	HTTPClient *http.Client // nil 时按 Timeout 创建
+}
+
+// Client 管理端 / TLS 服务共用的 HTTP 客户端：
+// 统一认证头和 User-Agent，幂等请求自动重试，服务不可用时熔断
+type Client struct {
+	baseURL      string
+	apiKey       string
+	userAgent    string
+	maxRetries   int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	breaker      *Breaker
+	httpClient   *http.Client
+	streamClient *http.Client // 长连接不设置整体超时
+}
+
+// New 创建客户端
+func New(opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = DefaultBaseDelay
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = DefaultMaxDelay
+	}
+	if opts.Breaker == nil {
+		opts.Breaker = NewBreaker(0, 0)
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: opts.Timeout}
+	}
+
+	version := opts.Version
+	if version == "" {
+		version = "dev"
+	}
+	userAgent := "otun-node-agent/" + version
+	if opts.NodeID != "" {
+		userAgent += " (node " + opts.NodeID + ")"
+	}
+
+	return &Client{
+		baseURL:      strings.TrimRight(opts.BaseURL, "/"),
+		apiKey:       opts.APIKey,
+		userAgent:    userAgent,
+		maxRetries:   max(opts.MaxRetries, 0),
+		baseDelay:    opts.BaseDelay,
+		maxDelay:     opts.MaxDelay,
+		breaker:      opts.Breaker,
+		httpClient:   opts.HTTPClient,
+		streamClient: &http.Client{Transport: opts.HTTPClient.Transport},
+	}
+}
+
+// BaseURL 服务地址
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Breaker 熔断器（用于指标）
+func (c *Client) Breaker() *Breaker {
+	return c.breaker
+}
+
+// Request 请求参数
+type Request struct {
+	Method     string
+	Path       string // 相对 BaseURL，可带查询参数
+	Body       any    // JSON 请求体，nil 表示没有
+	Header     http.Header
+	Idempotent bool // POST 是否可以安全重试（GET/HEAD/PUT/DELETE 总是可以）
+}
+
+// retryable 请求失败后是否可以重发
+func (r *Request) retryable() bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return r.Idempotent
+}
+
+// Response 成功响应（2xx 或 304）的状态
+type Response struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// Get 发送 GET 请求并解析 JSON 响应
+func (c *Client) Get(ctx context.Context, path string, out any) error {
+	_, err := c.Do(ctx, Request{Method: http.MethodGet, Path: path}, out)
+	return err
+}
+
+// PostJSON 发送 JSON POST 请求，idempotent 为 true 时失败会重试
+func (c *Client) PostJSON(ctx context.Context, path string, body, out any, idempotent bool) error {
+	_, err := c.Do(ctx, Request{Method: http.MethodPost, Path: path, Body: body, Idempotent: idempotent}, out)
+	return err
+}
+
+// Do 发送请求，2xx 时将 JSON 响应解析到 out（可为 nil）
+// 2xx 和 304 返回 Response，其余返回 *Error
+func (c *Client) Do(ctx context.Context, req Request, out any) (*Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = json.Marshal(req.Body); err != nil {
+			return nil, fmt.Errorf("marshal request: %w", err)
+		}
+	}
+
+	attempts := 1
+	if req.retryable() {
+		attempts += c.maxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !c.breaker.Allow() {
+			return nil, &Error{
+				Kind:   KindTransient,
+				Method: req.Method,
+				Path:   pathOnly(req.Path),
+				Err:    ErrCircuitOpen,
+			}
+		}
+
+		resp, err := c.once(ctx, &req, body, out)
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			// 成功，或响应解析失败（服务端可达）
+			c.breaker.Success()
+			return resp, err
+		}
+		if ctx.Err() != nil {
+			// 调用方取消，不计入熔断（但要释放探测名额）
+			c.breaker.Abort()
+			return nil, err
+		}
+		if apiErr.Kind != KindTransient {
+			c.breaker.Success()
+			return nil, err
+		}
+		c.breaker.Failure()
+
+		if attempt+1 >= attempts {
+			return nil, err
+		}
+		delay := c.backoff(attempt)
+		if apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > c.maxDelay {
+				return nil, err
+			}
+			delay = max(delay, apiErr.RetryAfter)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// once 发送一次请求
+func (c *Client) once(ctx context.Context, req *Request, body []byte, out any) (*Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	httpReq, err := c.newRequest(ctx, req, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &Error{
+			Kind:   KindTransient,
+			Method: req.Method,
+			Path:   pathOnly(req.Path),
+			Err:    err,
+		}
+	}
+	defer resp.Body.Close()
+
+	result := &Response{StatusCode: resp.StatusCode, Header: resp.Header}
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return result, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if out != nil && resp.StatusCode != http.StatusNoContent {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("decode response: %w", err)
+			}
+		}
+		return result, nil
+	}
+
+	return nil, responseError(req, resp)
+}
+
+// newRequest 创建带认证头和 User-Agent 的请求，req.Header 中的字段优先
+func (c *Client) newRequest(ctx context.Context, req *Request, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, c.baseURL+req.Path, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("User-Agent", c.userAgent)
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+	return httpReq, nil
+}
+
+// responseError 将非 2xx 响应转换为 *Error
+func responseError(req *Request, resp *http.Response) *Error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &Error{
+		Kind:       kindOf(resp.StatusCode),
+		Method:     req.Method,
+		Path:       pathOnly(req.Path),
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(data)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// Stream 打开长连接（如推送通道），2xx 时返回响应，由调用方读取并关闭 Body
+// 与 Do 共用认证头、User-Agent 和熔断器；不重试（重连退避由调用方负责），也没有整体超时
+func (c *Client) Stream(ctx context.Context, req Request) (*http.Response, error) {
+	if !c.breaker.Allow() {
+		return nil, &Error{
+			Kind:   KindTransient,
+			Method: req.Method,
+			Path:   pathOnly(req.Path),
+			Err:    ErrCircuitOpen,
+		}
+	}
+
+	httpReq, err := c.newRequest(ctx, &req, nil)
+	if err != nil {
+		c.breaker.Abort()
+		return nil, err
+	}
+
+	resp, err := c.streamClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			c.breaker.Abort()
+		} else {
+			c.breaker.Failure()
+		}
+		return nil, &Error{
+			Kind:   KindTransient,
+			Method: req.Method,
+			Path:   pathOnly(req.Path),
+			Err:    err,
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := responseError(&req, resp)
+		if apiErr.Kind == KindTransient {
+			c.breaker.Failure()
+		} else {
+			c.breaker.Success()
+		}
+		return nil, apiErr
+	}
+
+	c.breaker.Success()
+	return resp, nil
+}
+
+// backoff 第 attempt 次失败后的等待：指数增长，取 [d/2, d) 的随机值避免节点同时重试
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.baseDelay << min(attempt, 16)
+	if d <= 0 || d > c.maxDelay {
+		d = c.maxDelay
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// parseRetryAfter 解析 Retry-After（秒数或 HTTP 日期）
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// pathOnly 去掉查询参数，用于错误信息
+func pathOnly(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
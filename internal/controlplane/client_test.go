@@ -0,0 +1,201 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string, breaker *Breaker) *Client {
+	return New(Options{
+		BaseURL:   url,
+		APIKey:    "secret",
+		NodeID:    "node-1",
+		Version:   "1.2.3",
+		BaseDelay: time.Millisecond,
+		MaxDelay:  50 * time.Millisecond,
+		Breaker:   breaker,
+	})
+}
+
+func TestClientRetriesIdempotent(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing auth header")
+		}
+		if ua := r.Header.Get("User-Agent"); ua != "otun-node-agent/1.2.3 (node node-1)" {
+			t.Errorf("User-Agent = %q", ua)
+		}
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	var out struct{ OK bool }
+	if err := newTestClient(srv.URL, nil).Get(context.Background(), "/x", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.OK || calls.Load() != 3 {
+		t.Fatalf("ok=%v calls=%d, want success after 3 calls", out.OK, calls.Load())
+	}
+}
+
+func TestClientDoesNotRetryNonIdempotent(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	err := newTestClient(srv.URL, nil).PostJSON(context.Background(), "/stats", map[string]int{"a": 1}, nil, false)
+	if !IsTransient(err) || StatusCode(err) != http.StatusBadGateway {
+		t.Fatalf("err = %v, want transient 502", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestClientErrorKinds(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/bad":
+			http.Error(w, "invalid node_id", http.StatusBadRequest)
+		case "/same":
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+	defer srv.Close()
+	c := newTestClient(srv.URL, nil)
+	ctx := context.Background()
+
+	if err := c.Get(ctx, "/auth", nil); !IsAuth(err) {
+		t.Fatalf("401: err = %v, want auth error", err)
+	}
+	err := c.Get(ctx, "/bad", nil)
+	if !IsBadRequest(err) || !strings.Contains(err.Error(), "invalid node_id") {
+		t.Fatalf("400: err = %v, want bad request with body", err)
+	}
+	resp, err := c.Do(ctx, Request{Method: http.MethodGet, Path: "/same"}, nil)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("304: resp = %v, err = %v", resp, err)
+	}
+}
+
+func TestClientRetryAfterTooLong(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	err := newTestClient(srv.URL, nil).Get(context.Background(), "/x", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != 120*time.Second {
+		t.Fatalf("err = %v, want Retry-After 120s", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want no retry beyond MaxDelay", calls.Load())
+	}
+}
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	breaker := NewBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+	c := New(Options{BaseURL: srv.URL, MaxRetries: -1, Breaker: breaker})
+	ctx := context.Background()
+
+	for range 3 {
+		c.Get(ctx, "/", nil)
+	}
+	if !breaker.Open() {
+		t.Fatal("breaker should open after 3 failures")
+	}
+	if err := c.Get(ctx, "/", nil); !errors.Is(err, ErrCircuitOpen) || !IsTransient(err) {
+		t.Fatalf("err = %v, want circuit open", err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("calls = %d, request should not be sent while open", calls.Load())
+	}
+
+	// 冷却结束后放行探测请求，成功后关闭
+	healthy.Store(true)
+	now = now.Add(2 * time.Minute)
+	if err := c.Get(ctx, "/", nil); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if breaker.Open() {
+		t.Fatal("breaker should close after successful probe")
+	}
+}
+
+func TestBreakerCancelledProbeReleasesSlot(t *testing.T) {
+	var slow, healthy atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			// 慢响应：探测请求在返回前被调用方取消
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	breaker := NewBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+	c := New(Options{BaseURL: srv.URL, MaxRetries: -1, Breaker: breaker})
+
+	c.Get(context.Background(), "/", nil)
+	if !breaker.Open() {
+		t.Fatal("breaker should open after a failure")
+	}
+
+	now = now.Add(2 * time.Minute)
+	slow.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Get(ctx, "/", nil); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("probe err = %v, want cancelled request", err)
+	}
+
+	// 被取消的探测不能占住名额，下一次请求仍可探测并关闭熔断
+	slow.Store(false)
+	healthy.Store(true)
+	if err := c.Get(context.Background(), "/", nil); err != nil {
+		t.Fatalf("second probe: %v", err)
+	}
+	if breaker.Open() {
+		t.Fatal("breaker should close after successful probe")
+	}
+}
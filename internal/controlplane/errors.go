@@ -0,0 +1,92 @@
+package controlplane
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrorKind 错误类别，调用方据此决定重试、告警还是放弃
+type ErrorKind int
+
+const (
+	KindTransient  ErrorKind = iota // 网络错误、超时、5xx、429、熔断：稍后重试可能成功
+	KindAuth                        // 401/403：API Key 无效或被吊销，重试无意义
+	KindBadRequest                  // 其他 4xx：请求本身有问题
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindAuth:
+		return "auth"
+	case KindBadRequest:
+		return "bad_request"
+	default:
+		return "transient"
+	}
+}
+
+// ErrCircuitOpen 熔断中，请求未发出
+var ErrCircuitOpen = errors.New("control plane circuit open")
+
+// Error 管理端/TLS 服务请求错误
+type Error struct {
+	Kind       ErrorKind
+	Method     string
+	Path       string
+	StatusCode int           // 0 表示没有收到响应
+	Body       string        // 响应内容（截断）
+	RetryAfter time.Duration // 服务器要求的等待时间（Retry-After）
+	Err        error         // 网络错误或 ErrCircuitOpen
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s %s: %v", e.Method, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s %s: API error %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// kindOf 按状态码分类
+func kindOf(status int) ErrorKind {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return KindAuth
+	case status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500:
+		return KindTransient
+	default:
+		return KindBadRequest
+	}
+}
+
+// IsAuth 是否为认证失败
+func IsAuth(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Kind == KindAuth
+}
+
+// IsTransient 是否为临时错误（网络、服务端错误、熔断）
+func IsTransient(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Kind == KindTransient
+}
+
+// IsBadRequest 是否为请求错误（4xx，认证失败除外）
+func IsBadRequest(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Kind == KindBadRequest
+}
+
+// StatusCode 错误对应的 HTTP 状态码，没有响应时为 0
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,426 @@
+package history
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"otun-node-agent/internal/persist"
+)
+
+// historyFile 历史数据文件名（gob 编码）
+const historyFile = "history.gob"
+
+// fileVersion 文件格式版本，不兼容的修改需要递增
+const fileVersion = 1
+
+// 默认保留时间
+const (
+	DefaultHourlyRetention = 7 * 24 * time.Hour
+	DefaultDailyRetention  = 90 * 24 * time.Hour
+	DefaultMonthlyMonths   = 24
+)
+
+// Step 时间粒度
+type Step string
+
+const (
+	StepHour  Step = "hour"
+	StepDay   Step = "day"
+	StepMonth Step = "month"
+)
+
+// ParseStep 解析时间粒度，空字符串表示按查询范围自动选择
+func ParseStep(s string) (Step, error) {
+	switch Step(s) {
+	case "", StepHour, StepDay, StepMonth:
+		return Step(s), nil
+	}
+	return "", fmt.Errorf("invalid step %q (expected hour, day or month)", s)
+}
+
+// Truncate 返回 t 所在时间段的起点（UTC）
+func (s Step) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	switch s {
+	case StepDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case StepMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// Next 下一个时间段的起点
+func (s Step) Next(t time.Time) time.Time {
+	switch s {
+	case StepDay:
+		return t.AddDate(0, 0, 1)
+	case StepMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.Add(time.Hour)
+}
+
+// 序列类型
+const (
+	KindUser    = "user"    // 单个用户（名称为 UUID）
+	KindInbound = "inbound" // 单个 inbound（名称为标签）
+	KindNode    = "node"    // 节点所有用户合计（名称为空）
+)
+
+// Sample 一次收集的流量
+type Sample struct {
+	Kind     string
+	Name     string
+	Upload   int64
+	Download int64
+}
+
+// Bucket 查询结果中的一个时间段
+type Bucket struct {
+	Time     time.Time `json:"time"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+// Retention 各粒度的保留时间，零值使用默认值
+type Retention struct {
+	Hourly  time.Duration
+	Daily   time.Duration
+	Monthly int // 月数
+}
+
+// point 存储的时间段（Start 为 Unix 秒）
+type point struct {
+	Start    int64
+	Upload   int64
+	Download int64
+}
+
+// series 一条序列的三种粒度，各自按时间升序
+type series struct {
+	Hourly  []point
+	Daily   []point
+	Monthly []point
+}
+
+// fileData 文件内容
+type fileData struct {
+	Version int
+	Series  map[string]*series
+}
+
+// Store 流量历史：每次收集同时计入小时、天、月三个粒度，
+// 各粒度按保留时间清理（小时数据过期后仍可从天/月数据查询）
+// 数据只在 Flush 时写盘，崩溃最多丢失上次 Flush 之后的历史（不影响计费）
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	retention Retention
+	series    map[string]*series
+	dirty     bool
+}
+
+// Open 打开 dir 下的历史数据；文件损坏时改名保留并从空数据开始
+func Open(dir string, retention Retention) (*Store, error) {
+	if retention.Hourly <= 0 {
+		retention.Hourly = DefaultHourlyRetention
+	}
+	if retention.Daily <= 0 {
+		retention.Daily = DefaultDailyRetention
+	}
+	if retention.Monthly <= 0 {
+		retention.Monthly = DefaultMonthlyMonths
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create history dir: %w", err)
+	}
+
+	s := &Store{
+		path:      filepath.Join(dir, historyFile),
+		retention: retention,
+		series:    make(map[string]*series),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+
+	var file fileData
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil || file.Version != fileVersion {
+		if err == nil {
+			err = fmt.Errorf("unsupported version %d", file.Version)
+		}
+		// 历史数据不是计费依据，损坏时保留原文件便于排查，从空数据开始
+		corrupt := fmt.Sprintf("%s.corrupt-%d", s.path, time.Now().Unix())
+		log.Printf("[History] %v, moving it to %s and starting empty", &persist.CorruptError{Path: s.path, Err: err}, corrupt)
+		if err := os.Rename(s.path, corrupt); err != nil {
+			return nil, fmt.Errorf("move corrupt history: %w", err)
+		}
+		return s, nil
+	}
+	for key, sr := range file.Series {
+		s.series[key] = sr
+	}
+	return s, nil
+}
+
+// seriesKey 序列在文件中的键
+func seriesKey(kind, name string) string {
+	if kind == KindNode {
+		return KindNode
+	}
+	return kind + ":" + name
+}
+
+// Add 记录一次收集的流量，用户流量同时计入节点合计
+func (s *Store) Add(ts time.Time, samples []Sample) {
+	var nodeUp, nodeDown int64
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sm := range samples {
+		if sm.Upload <= 0 && sm.Download <= 0 {
+			continue
+		}
+		s.addLocked(seriesKey(sm.Kind, sm.Name), ts, sm.Upload, sm.Download)
+		if sm.Kind == KindUser {
+			nodeUp += sm.Upload
+			nodeDown += sm.Download
+		}
+	}
+	if nodeUp > 0 || nodeDown > 0 {
+		s.addLocked(seriesKey(KindNode, ""), ts, nodeUp, nodeDown)
+	}
+	s.pruneLocked(ts)
+}
+
+func (s *Store) addLocked(key string, ts time.Time, up, down int64) {
+	sr, ok := s.series[key]
+	if !ok {
+		sr = &series{}
+		s.series[key] = sr
+	}
+	sr.Hourly = addPoint(sr.Hourly, StepHour.Truncate(ts).Unix(), up, down)
+	sr.Daily = addPoint(sr.Daily, StepDay.Truncate(ts).Unix(), up, down)
+	sr.Monthly = addPoint(sr.Monthly, StepMonth.Truncate(ts).Unix(), up, down)
+	s.dirty = true
+}
+
+// addPoint 累加到 start 对应的时间段，不存在时按顺序插入
+func addPoint(points []point, start, up, down int64) []point {
+	// 通常是最后一个时间段
+	if n := len(points); n > 0 && points[n-1].Start == start {
+		points[n-1].Upload += up
+		points[n-1].Download += down
+		return points
+	}
+	i := sort.Search(len(points), func(i int) bool { return points[i].Start >= start })
+	if i < len(points) && points[i].Start == start {
+		points[i].Upload += up
+		points[i].Download += down
+		return points
+	}
+	points = append(points, point{})
+	copy(points[i+1:], points[i:])
+	points[i] = point{Start: start, Upload: up, Download: down}
+	return points
+}
+
+// pruneLocked 删除超过保留时间的数据和空序列
+func (s *Store) pruneLocked(now time.Time) {
+	hourly := StepHour.Truncate(now.Add(-s.retention.Hourly)).Unix()
+	daily := StepDay.Truncate(now.Add(-s.retention.Daily)).Unix()
+	monthly := StepMonth.Truncate(now.AddDate(0, -s.retention.Monthly, 0)).Unix()
+
+	for key, sr := range s.series {
+		sr.Hourly = dropBefore(sr.Hourly, hourly)
+		sr.Daily = dropBefore(sr.Daily, daily)
+		sr.Monthly = dropBefore(sr.Monthly, monthly)
+		if len(sr.Hourly) == 0 && len(sr.Daily) == 0 && len(sr.Monthly) == 0 {
+			delete(s.series, key)
+			s.dirty = true
+		}
+	}
+}
+
+func dropBefore(points []point, cutoff int64) []point {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Start >= cutoff })
+	if i == 0 {
+		return points
+	}
+	return append(points[:0:0], points[i:]...)
+}
+
+// Flush 有变化时写盘（原子写入）
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(fileData{Version: fileVersion, Series: s.series}); err != nil {
+		return fmt.Errorf("encode history: %w", err)
+	}
+	if err := persist.WriteFile(s.path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Query 查询条件
+type Query struct {
+	Kind string
+	Name string
+	From time.Time
+	To   time.Time
+	Step Step // 空表示自动选择：能覆盖 From 的最细粒度
+}
+
+// Result 查询结果，Buckets 覆盖 [From, To] 内的每个时间段（没有流量的为 0）
+type Result struct {
+	Step     Step      `json:"step"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Buckets  []Bucket  `json:"buckets"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+// MaxBuckets 单次查询最多返回的时间段数
+const MaxBuckets = 5000
+
+// ErrTooManyBuckets 查询范围相对粒度过大
+var ErrTooManyBuckets = fmt.Errorf("query range too large (more than %d buckets), use a coarser step", MaxBuckets)
+
+// Query 查询一条序列，参数不合理时返回错误
+func (s *Store) Query(q Query, now time.Time) (*Result, error) {
+	if q.To.IsZero() {
+		q.To = now
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-24 * time.Hour)
+	}
+	if q.From.After(q.To) {
+		return nil, errors.New("from must not be after to")
+	}
+	if q.Step == "" {
+		q.Step = s.autoStep(q.From, now)
+	}
+
+	from := q.Step.Truncate(q.From)
+	to := q.To.UTC()
+
+	var buckets []Bucket
+	for t := from; !t.After(to); t = q.Step.Next(t) {
+		if len(buckets) >= MaxBuckets {
+			return nil, ErrTooManyBuckets
+		}
+		buckets = append(buckets, Bucket{Time: t})
+	}
+
+	result := &Result{Step: q.Step, From: from, To: to, Buckets: buckets}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sr, ok := s.series[seriesKey(q.Kind, q.Name)]
+	if !ok {
+		return result, nil
+	}
+	points := sr.Hourly
+	switch q.Step {
+	case StepDay:
+		points = sr.Daily
+	case StepMonth:
+		points = sr.Monthly
+	}
+
+	// 时间段按时间升序，与 points 一起顺序合并
+	i := sort.Search(len(points), func(i int) bool { return points[i].Start >= from.Unix() })
+	for b := range buckets {
+		start := buckets[b].Time.Unix()
+		for i < len(points) && points[i].Start < start {
+			i++
+		}
+		if i < len(points) && points[i].Start == start {
+			buckets[b].Upload = points[i].Upload
+			buckets[b].Download = points[i].Download
+			result.Upload += points[i].Upload
+			result.Download += points[i].Download
+		}
+	}
+	return result, nil
+}
+
+// Total 一条序列在 [from, now] 内的合计（按小时数据计算，from 超出小时保留时间时按天）
+func (s *Store) Total(kind, name string, from, now time.Time) (upload, download int64) {
+	step := s.autoStep(from, now)
+	start := step.Truncate(from).Unix()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sr, ok := s.series[seriesKey(kind, name)]
+	if !ok {
+		return 0, 0
+	}
+	points := sr.Hourly
+	switch step {
+	case StepDay:
+		points = sr.Daily
+	case StepMonth:
+		points = sr.Monthly
+	}
+	for _, p := range points {
+		if p.Start >= start {
+			upload += p.Upload
+			download += p.Download
+		}
+	}
+	return upload, download
+}
+
+// Names 返回某类序列的所有名称（例如所有有历史的 inbound）
+func (s *Store) Names(kind string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := kind + ":"
+	var names []string
+	for key := range s.series {
+		if name, ok := strings.CutPrefix(key, prefix); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// autoStep 能覆盖 from 的最细粒度
+func (s *Store) autoStep(from, now time.Time) Step {
+	switch {
+	case !from.Before(now.Add(-s.retention.Hourly)):
+		return StepHour
+	case !from.Before(now.Add(-s.retention.Daily)):
+		return StepDay
+	}
+	return StepMonth
+}
@@ -0,0 +1,93 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreRollupAndQuery(t *testing.T) {
+	s, err := Open(t.TempDir(), Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 3, 31, 22, 10, 0, 0, time.UTC)
+
+	s.Add(base, []Sample{{Kind: KindUser, Name: "a", Upload: 10, Download: 100}, {Kind: KindInbound, Name: "vless-in", Upload: 10}})
+	s.Add(base.Add(20*time.Minute), []Sample{{Kind: KindUser, Name: "a", Upload: 5}, {Kind: KindUser, Name: "b", Download: 7}})
+	s.Add(base.Add(2*time.Hour), []Sample{{Kind: KindUser, Name: "a", Upload: 1}}) // 4 月 1 日
+
+	now := base.Add(3 * time.Hour)
+	hourly, err := s.Query(Query{Kind: KindUser, Name: "a", From: base, To: now, Step: StepHour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly.Buckets) != 4 || hourly.Buckets[0].Upload != 15 || hourly.Buckets[1].Upload != 0 || hourly.Buckets[2].Upload != 1 {
+		t.Fatalf("hourly buckets = %+v", hourly.Buckets)
+	}
+	if hourly.Upload != 16 || hourly.Download != 100 {
+		t.Fatalf("hourly total = %d/%d", hourly.Upload, hourly.Download)
+	}
+
+	monthly, _ := s.Query(Query{Kind: KindUser, Name: "a", From: base, To: now, Step: StepMonth}, now)
+	if len(monthly.Buckets) != 2 || monthly.Buckets[0].Upload != 15 || monthly.Buckets[1].Upload != 1 {
+		t.Fatalf("monthly buckets = %+v", monthly.Buckets)
+	}
+
+	node, _ := s.Query(Query{Kind: KindNode, From: base, To: now, Step: StepDay}, now)
+	if node.Upload != 16 || node.Download != 107 {
+		t.Fatalf("node total = %d/%d, want users summed (inbounds excluded)", node.Upload, node.Download)
+	}
+
+	if _, err := s.Query(Query{Kind: KindNode, From: base.AddDate(-2, 0, 0), To: now, Step: StepHour}, now); !errors.Is(err, ErrTooManyBuckets) {
+		t.Fatalf("err = %v, want ErrTooManyBuckets", err)
+	}
+}
+
+func TestStoreRetentionAndPersistence(t *testing.T) {
+	dir := t.TempDir()
+	retention := Retention{Hourly: 48 * time.Hour, Daily: 10 * 24 * time.Hour, Monthly: 12}
+	s, _ := Open(dir, retention)
+
+	old := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.Add(old, []Sample{{Kind: KindUser, Name: "a", Upload: 1}})
+	now := old.AddDate(0, 0, 20)
+	s.Add(now, []Sample{{Kind: KindUser, Name: "a", Upload: 2}})
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 小时和天数据已过期，月数据仍在
+	sr := s.series[seriesKey(KindUser, "a")]
+	if len(sr.Hourly) != 1 || len(sr.Daily) != 1 || len(sr.Monthly) != 1 {
+		t.Fatalf("after retention: hourly=%d daily=%d monthly=%d", len(sr.Hourly), len(sr.Daily), len(sr.Monthly))
+	}
+	if up, _ := s.Total(KindUser, "a", old, now); up != 3 {
+		t.Fatalf("total since old = %d, want 3 from monthly data", up)
+	}
+	if s.autoStep(old, now) != StepMonth || s.autoStep(now.Add(-time.Hour), now) != StepHour {
+		t.Fatal("auto step should pick the finest resolution that covers from")
+	}
+}
+
+func TestStoreCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, historyFile), []byte("garbage"), 0644)
+
+	s, err := Open(dir, Retention{})
+	if err != nil || len(s.series) != 0 {
+		t.Fatalf("corrupt history should start empty, err = %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), historyFile+".corrupt-") {
+		t.Fatalf("corrupt file not kept aside: %v", entries)
+	}
+}
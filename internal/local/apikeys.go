@@ -0,0 +1,214 @@
+package local
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"otun-node-agent/internal/persist"
+)
+
+// Scope API Key 权限范围
+type Scope string
+
+const (
+	ScopeRead           Scope = "read"            // 只读：用户列表、统计、配置
+	ScopeUsersWrite     Scope = "users:write"     // 创建/修改/删除用户
+	ScopeCircuitBreaker Scope = "circuit-breaker" // 开关熔断
+	ScopeAdmin          Scope = "admin"           // 全部权限，包括管理 API Key 和密钥轮换
+)
+
+// keyPrefix API Key 明文前缀，便于在日志和密钥扫描中识别
+const keyPrefix = "otun_"
+
+// ErrKeyNotFound API Key 不存在
+var ErrKeyNotFound = errors.New("api key not found")
+
+// APIKey 本地管理 API 的访问密钥（只保存哈希，明文只在创建时返回一次）
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hint      string     `json:"hint"` // 明文的前几位，用于辨认
+	Hash      string     `json:"hash"` // SHA-256(明文)，hex
+	Scopes    []Scope    `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// IsExpired 检查密钥是否已过期
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// HasScope 检查密钥是否拥有权限：admin 拥有全部权限，任何权限都包含只读
+func (k *APIKey) HasScope(required Scope) bool {
+	if slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, required) {
+		return true
+	}
+	return required == ScopeRead && len(k.Scopes) > 0
+}
+
+// ValidateScopes 校验权限列表
+func ValidateScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		switch s {
+		case ScopeRead, ScopeUsersWrite, ScopeCircuitBreaker, ScopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope: %s", s)
+		}
+	}
+	return nil
+}
+
+// KeyStore API Key 存储
+type KeyStore struct {
+	mu      sync.RWMutex
+	dataDir string
+	keys    map[string]*APIKey // id -> key
+}
+
+// NewKeyStore 创建 API Key 存储
+func NewKeyStore(dataDir string) (*KeyStore, error) {
+	ks := &KeyStore{
+		dataDir: dataDir,
+		keys:    make(map[string]*APIKey),
+	}
+
+	var keys []APIKey
+	if err := persist.ReadJSON(ks.dataPath(), &keys); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load api keys: %w", err)
+	}
+	for i := range keys {
+		ks.keys[keys[i].ID] = &keys[i]
+	}
+	return ks, nil
+}
+
+// dataPath API Key 文件路径
+func (ks *KeyStore) dataPath() string {
+	return filepath.Join(ks.dataDir, "api_keys.json")
+}
+
+// save 保存到文件（调用者必须已持有锁）
+func (ks *KeyStore) save() error {
+	keys := make([]APIKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return persist.WriteJSON(ks.dataPath(), keys, 0600)
+}
+
+// Create 创建 API Key，返回密钥信息和明文（明文不保存，之后无法再次获取）
+func (ks *KeyStore) Create(name string, scopes []Scope, expiresAt *time.Time) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", fmt.Errorf("generate key: %w", err)
+	}
+	secret := keyPrefix + base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", fmt.Errorf("generate key id: %w", err)
+	}
+
+	key := &APIKey{
+		ID:        hex.EncodeToString(idBytes),
+		Name:      name,
+		Hint:      secret[:len(keyPrefix)+4],
+		Hash:      hashKey(secret),
+		Scopes:    slices.Clone(scopes),
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys[key.ID] = key
+	if err := ks.save(); err != nil {
+		delete(ks.keys, key.ID)
+		return nil, "", fmt.Errorf("save api keys: %w", err)
+	}
+
+	copy := *key
+	return &copy, secret, nil
+}
+
+// List 列出所有 API Key（按创建时间排序）
+func (ks *KeyStore) List() []APIKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Revoke 删除 API Key，立即失效
+func (ks *KeyStore) Revoke(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	delete(ks.keys, id)
+	if err := ks.save(); err != nil {
+		ks.keys[id] = key
+		return fmt.Errorf("save api keys: %w", err)
+	}
+	return nil
+}
+
+// Authenticate 查找与明文匹配且未过期的 API Key
+// 逐个做常量时间比较，不因匹配位置不同而泄露时间差
+func (ks *KeyStore) Authenticate(secret string, now time.Time) (*APIKey, bool) {
+	hash := []byte(hashKey(secret))
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	var found *APIKey
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), hash) == 1 {
+			found = k
+		}
+	}
+	if found == nil || found.IsExpired(now) {
+		return nil, false
+	}
+
+	copy := *found
+	return &copy, true
+}
+
+// hashKey 计算 API Key 哈希（密钥为 256 位随机数，不需要慢哈希）
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package local
+
+import (
+	"testing"
+	"time"
+)
+
+// TestKeyStoreAuthenticate 测试权限范围、过期和吊销
+func TestKeyStoreAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, readSecret, err := ks.Create("support", []Scope{ScopeRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	writer, writeSecret, err := ks.Create("panel", []Scope{ScopeUsersWrite}, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ks.Create("bad", []Scope{"superuser"}, nil); err == nil {
+		t.Error("Expected unknown scope to be rejected")
+	}
+
+	// 重新加载：只保存了哈希，仍可认证
+	ks, err = NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, ok := ks.Authenticate(readSecret, time.Now())
+	if !ok || !key.HasScope(ScopeRead) || key.HasScope(ScopeUsersWrite) {
+		t.Errorf("Read-only key: ok=%v key=%+v", ok, key)
+	}
+	key, ok = ks.Authenticate(writeSecret, time.Now())
+	if !ok || !key.HasScope(ScopeRead) || !key.HasScope(ScopeUsersWrite) || key.HasScope(ScopeAdmin) {
+		t.Errorf("Write key: ok=%v key=%+v", ok, key)
+	}
+
+	if _, ok := ks.Authenticate(writeSecret, expiresAt); ok {
+		t.Error("Expired key must not authenticate")
+	}
+	if _, ok := ks.Authenticate("otun_wrong", time.Now()); ok {
+		t.Error("Unknown key must not authenticate")
+	}
+
+	if err := ks.Revoke(writer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ks.Authenticate(writeSecret, time.Now()); ok {
+		t.Error("Revoked key must not authenticate")
+	}
+}
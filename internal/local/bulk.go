@@ -0,0 +1,484 @@
+package local
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 批量操作类型
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// BatchOp 批量操作中的一项
+type BatchOp struct {
+	Op     string             `json:"op"`               // create/update/delete
+	UUID   string             `json:"uuid,omitempty"`   // update/delete
+	Create *CreateUserRequest `json:"create,omitempty"` // create
+	Update *UpdateUserRequest `json:"update,omitempty"` // update
+}
+
+// BatchResult 批量操作结果，Users 与操作一一对应（delete 为 nil）
+type BatchResult struct {
+	Users []*LocalUser
+}
+
+// BatchError 批量操作中某一项失败，整个批次不生效
+type BatchError struct {
+	Index int
+	Op    string
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s): %v", e.Index, e.Op, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictPolicy 导入时 UUID 已存在的处理方式
+type ConflictPolicy string
+
+const (
+	ConflictError     ConflictPolicy = "error"     // 整个导入失败
+	ConflictSkip      ConflictPolicy = "skip"      // 保留现有用户
+	ConflictOverwrite ConflictPolicy = "overwrite" // 用导入数据覆盖
+)
+
+// ImportResult 导入结果
+type ImportResult struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+
+	// Changes 每个新建或覆盖的用户修改前后的状态（用于审计，新建时 Before 为 nil）
+	Changes []ImportChange `json:"-"`
+}
+
+// ImportChange 导入对单个用户的修改
+type ImportChange struct {
+	Before *LocalUser
+	After  *LocalUser
+}
+
+// Validate 校验创建请求
+func (r *CreateUserRequest) Validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.MaxIPs < 0 {
+		return errors.New("max_ips must not be negative")
+	}
+	return ValidateResetPolicy(r.ResetPolicy, r.ResetDay, r.ResetIntervalDays)
+}
+
+// ValidateUpdate 校验更新请求（重置策略与用户现有设置合并后校验，例如只修改 reset_day）
+func ValidateUpdate(current *LocalUser, req *UpdateUserRequest) error {
+	if req.MaxIPs != nil && *req.MaxIPs < 0 {
+		return errors.New("max_ips must not be negative")
+	}
+	if req.ResetPolicy == nil && req.ResetDay == nil && req.ResetIntervalDays == nil {
+		return nil
+	}
+
+	policy, day, interval := current.ResetPolicy, current.ResetDay, current.ResetIntervalDays
+	if req.ResetPolicy != nil {
+		policy = *req.ResetPolicy
+	}
+	if req.ResetDay != nil {
+		day = *req.ResetDay
+	}
+	if req.ResetIntervalDays != nil {
+		interval = *req.ResetIntervalDays
+	}
+	return ValidateResetPolicy(policy, day, interval)
+}
+
+// Batch 在一个事务中执行多项创建/更新/删除：任一项失败则全部不生效，
+// 成功时只写一次文件、只触发一次变更回调（一次配置重新生成）
+func (s *Store) Batch(ops []BatchOp) (*BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.cloneUsers()
+	now := time.Now()
+	result := &BatchResult{Users: make([]*LocalUser, len(ops))}
+
+	for i, op := range ops {
+		fail := func(err error) (*BatchResult, error) {
+			return nil, &BatchError{Index: i, Op: op.Op, Err: err}
+		}
+
+		switch op.Op {
+		case OpCreate:
+			if op.Create == nil {
+				return fail(errors.New("missing create"))
+			}
+			if err := op.Create.Validate(); err != nil {
+				return fail(err)
+			}
+			user, err := newUser(op.Create, now)
+			if err != nil {
+				return fail(err)
+			}
+			next[user.UUID] = user
+			result.Users[i] = user
+
+		case OpUpdate:
+			if op.Update == nil {
+				return fail(errors.New("missing update"))
+			}
+			user, ok := next[op.UUID]
+			if !ok {
+				return fail(fmt.Errorf("user not found: %s", op.UUID))
+			}
+			if err := ValidateUpdate(user, op.Update); err != nil {
+				return fail(err)
+			}
+			applyUpdate(user, op.Update, now)
+			result.Users[i] = user
+
+		case OpDelete:
+			if _, ok := next[op.UUID]; !ok {
+				return fail(fmt.Errorf("user not found: %s", op.UUID))
+			}
+			delete(next, op.UUID)
+
+		default:
+			return fail(fmt.Errorf("unknown op: %q", op.Op))
+		}
+	}
+
+	if err := s.commit(next); err != nil {
+		return nil, err
+	}
+
+	// 返回副本；同一用户被多次操作时反映最终状态
+	for i, u := range result.Users {
+		if u != nil {
+			copy := *u
+			result.Users[i] = &copy
+		}
+	}
+	return result, nil
+}
+
+// ImportUsers 导入用户（保留 UUID、SS 密码和订阅令牌），在一个事务中生效
+// 缺少的 UUID/密码/令牌会自动生成
+func (s *Store) ImportUsers(users []LocalUser, onConflict ConflictPolicy) (*ImportResult, error) {
+	switch onConflict {
+	case "":
+		onConflict = ConflictError
+	case ConflictError, ConflictSkip, ConflictOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy: %s", onConflict)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.cloneUsers()
+	now := time.Now()
+	result := &ImportResult{}
+	seen := make(map[string]bool, len(users))
+
+	for i := range users {
+		user := users[i]
+		if err := normalizeImported(&user, now); err != nil {
+			return nil, fmt.Errorf("user %d (%s): %w", i, user.Name, err)
+		}
+		if seen[user.UUID] {
+			return nil, fmt.Errorf("user %d (%s): duplicate uuid %s", i, user.Name, user.UUID)
+		}
+		seen[user.UUID] = true
+
+		existing, ok := next[user.UUID]
+		if ok {
+			switch onConflict {
+			case ConflictSkip:
+				result.Skipped++
+				continue
+			case ConflictError:
+				return nil, fmt.Errorf("user %d (%s): uuid %s already exists", i, user.Name, user.UUID)
+			}
+			// 覆盖时导入数据未提供的凭据沿用现有值，已分发的链接和订阅不失效
+			if users[i].SSPassword == "" {
+				user.SSPassword = existing.SSPassword
+			}
+			if users[i].SubToken == "" {
+				user.SubToken = existing.SubToken
+			}
+			result.Updated++
+		} else {
+			result.Created++
+		}
+		next[user.UUID] = &user
+
+		after := user
+		result.Changes = append(result.Changes, ImportChange{Before: existing, After: &after})
+	}
+
+	// 订阅令牌必须唯一，否则两个用户会共用一个订阅地址
+	tokens := make(map[string]string, len(next))
+	for _, u := range next {
+		if other, dup := tokens[u.SubToken]; dup {
+			return nil, fmt.Errorf("users %s and %s share a sub_token", other, u.UUID)
+		}
+		tokens[u.SubToken] = u.UUID
+	}
+
+	if result.Created+result.Updated == 0 {
+		return result, nil
+	}
+	if err := s.commit(next); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// normalizeImported 校验导入的用户并补齐缺省字段
+func normalizeImported(u *LocalUser, now time.Time) error {
+	if u.Name == "" {
+		return errors.New("name is required")
+	}
+	if u.MaxIPs < 0 {
+		return errors.New("max_ips must not be negative")
+	}
+	if err := ValidateResetPolicy(u.ResetPolicy, u.ResetDay, u.ResetIntervalDays); err != nil {
+		return err
+	}
+
+	if u.UUID == "" {
+		u.UUID = uuid.New().String()
+	} else {
+		parsed, err := uuid.Parse(u.UUID)
+		if err != nil {
+			return fmt.Errorf("invalid uuid %q", u.UUID)
+		}
+		u.UUID = parsed.String()
+	}
+
+	if u.SSPassword == "" {
+		password, err := generatePassword(16)
+		if err != nil {
+			return fmt.Errorf("generate password: %w", err)
+		}
+		u.SSPassword = password
+	}
+	if u.SubToken == "" {
+		token, err := generateSubToken()
+		if err != nil {
+			return fmt.Errorf("generate sub token: %w", err)
+		}
+		u.SubToken = token
+	}
+	if len(u.Protocols) == 0 {
+		u.Protocols = []string{"vless", "shadowsocks"}
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now
+	}
+	if u.NextResetAt == nil {
+		u.NextResetAt = u.nextResetAfter(now)
+	}
+	u.UpdatedAt = now
+	return nil
+}
+
+// cloneUsers 复制用户表，事务在副本上修改（调用者必须已持有锁）
+func (s *Store) cloneUsers() map[string]*LocalUser {
+	next := make(map[string]*LocalUser, len(s.users))
+	for uuid, u := range s.users {
+		copy := *u
+		next[uuid] = &copy
+	}
+	return next
+}
+
+// commit 用事务结果替换用户表并保存，失败时保持原状（调用者必须已持有锁）
+func (s *Store) commit(next map[string]*LocalUser) error {
+	prev := s.users
+	s.users = next
+	if err := s.save(); err != nil {
+		s.users = prev
+		return fmt.Errorf("save users: %w", err)
+	}
+
+	if s.onChange != nil {
+		go s.onChange()
+	}
+	return nil
+}
+
+// csvColumns CSV 导入导出的列（流量历史只在 JSON 中导出）
+var csvColumns = []string{
+	"uuid", "name", "protocols", "ss_password", "enabled",
+	"traffic_limit", "traffic_used", "expire_at", "max_ips", "sub_token",
+	"reset_policy", "reset_day", "reset_interval_days", "created_at",
+}
+
+// WriteUsersCSV 以 CSV 格式导出用户，协议之间用 "|" 分隔
+func WriteUsersCSV(w io.Writer, users []LocalUser) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		expireAt := ""
+		if u.ExpireAt != nil {
+			expireAt = u.ExpireAt.UTC().Format(time.RFC3339)
+		}
+		record := []string{
+			u.UUID,
+			u.Name,
+			strings.Join(u.Protocols, "|"),
+			u.SSPassword,
+			strconv.FormatBool(u.Enabled),
+			strconv.FormatInt(u.TrafficLimit, 10),
+			strconv.FormatInt(u.TrafficUsed, 10),
+			expireAt,
+			strconv.Itoa(u.MaxIPs),
+			u.SubToken,
+			string(u.ResetPolicy),
+			strconv.Itoa(u.ResetDay),
+			strconv.Itoa(u.ResetIntervalDays),
+			u.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadUsersCSV 解析 CSV 用户列表：第一行为列名，未知列忽略，缺少的列使用默认值
+// （enabled 默认 true，uuid/ss_password/sub_token 为空时导入时生成）
+func ReadUsersCSV(r io.Reader) ([]LocalUser, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := index["name"]; !ok {
+		return nil, errors.New("missing name column")
+	}
+
+	var users []LocalUser
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := parseCSVUser(record, index)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+// parseCSVUser 解析一行 CSV
+func parseCSVUser(record []string, index map[string]int) (LocalUser, error) {
+	get := func(name string) string {
+		if i, ok := index[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	u := LocalUser{
+		UUID:        get("uuid"),
+		Name:        get("name"),
+		SSPassword:  get("ss_password"),
+		SubToken:    get("sub_token"),
+		ResetPolicy: ResetPolicy(get("reset_policy")),
+		Enabled:     true,
+	}
+	if v := get("protocols"); v != "" {
+		for _, p := range strings.Split(v, "|") {
+			if p = strings.TrimSpace(p); p != "" {
+				u.Protocols = append(u.Protocols, p)
+			}
+		}
+	}
+
+	var err error
+	if v := get("enabled"); v != "" {
+		if u.Enabled, err = strconv.ParseBool(v); err != nil {
+			return u, fmt.Errorf("invalid enabled: %s", v)
+		}
+	}
+
+	ints := []struct {
+		name string
+		dst  *int64
+	}{
+		{"traffic_limit", &u.TrafficLimit},
+		{"traffic_used", &u.TrafficUsed},
+	}
+	for _, f := range ints {
+		if v := get(f.name); v != "" {
+			if *f.dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return u, fmt.Errorf("invalid %s: %s", f.name, v)
+			}
+		}
+	}
+
+	smallInts := []struct {
+		name string
+		dst  *int
+	}{
+		{"max_ips", &u.MaxIPs},
+		{"reset_day", &u.ResetDay},
+		{"reset_interval_days", &u.ResetIntervalDays},
+	}
+	for _, f := range smallInts {
+		if v := get(f.name); v != "" {
+			if *f.dst, err = strconv.Atoi(v); err != nil {
+				return u, fmt.Errorf("invalid %s: %s", f.name, v)
+			}
+		}
+	}
+
+	if v := get("expire_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return u, fmt.Errorf("invalid expire_at: %s", v)
+		}
+		u.ExpireAt = &t
+	}
+	if v := get("created_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return u, fmt.Errorf("invalid created_at: %s", v)
+		}
+		u.CreatedAt = t
+	}
+
+	return u, nil
+}
@@ -0,0 +1,97 @@
+package local
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBatchIsAtomic 测试批量操作要么全部生效（只触发一次回调），要么全部不生效
+func TestBatchIsAtomic(t *testing.T) {
+	var changes atomic.Int32
+	store, err := NewStore(t.TempDir(), func() { changes.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, _ := store.CreateUser(&CreateUserRequest{Name: "existing"})
+	time.Sleep(10 * time.Millisecond)
+	changes.Store(0)
+
+	disabled := false
+	_, err = store.Batch([]BatchOp{
+		{Op: OpCreate, Create: &CreateUserRequest{Name: "a"}},
+		{Op: OpUpdate, UUID: existing.UUID, Update: &UpdateUserRequest{Enabled: &disabled}},
+		{Op: OpDelete, UUID: "missing"},
+	})
+	if _, ok := err.(*BatchError); !ok {
+		t.Fatalf("Expected BatchError, got %v", err)
+	}
+	if got, _ := store.GetUser(existing.UUID); store.GetUserCount() != 1 || !got.Enabled {
+		t.Fatal("Failed batch must not change the store")
+	}
+
+	result, err := store.Batch([]BatchOp{
+		{Op: OpCreate, Create: &CreateUserRequest{Name: "a"}},
+		{Op: OpCreate, Create: &CreateUserRequest{Name: "b"}},
+		{Op: OpUpdate, UUID: existing.UUID, Update: &UpdateUserRequest{Enabled: &disabled}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if store.GetUserCount() != 3 || result.Users[2].Enabled {
+		t.Errorf("Unexpected result: count=%d", store.GetUserCount())
+	}
+	if changes.Load() != 1 {
+		t.Errorf("Expected exactly one onChange, got %d", changes.Load())
+	}
+}
+
+// TestImportCSVPreservesCredentials 测试 CSV 导出后导入到新节点保留 UUID、密码和订阅令牌
+func TestImportCSVPreservesCredentials(t *testing.T) {
+	src, _ := NewStore(t.TempDir(), nil)
+	user, _ := src.CreateUser(&CreateUserRequest{Name: "alice, \"the\" first", Protocols: []string{"vless", "trojan"}, MaxIPs: 2})
+
+	page, _ := src.QueryUsers(UserQuery{})
+	var buf bytes.Buffer
+	if err := WriteUsersCSV(&buf, page.Users); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ReadUsersCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, _ := NewStore(t.TempDir(), nil)
+	result, err := dst.ImportUsers(users, ConflictError)
+	if err != nil || result.Created != 1 {
+		t.Fatalf("Import failed: %+v %v", result, err)
+	}
+
+	got, ok := dst.GetUser(user.UUID)
+	if !ok || got.SSPassword != user.SSPassword || got.SubToken != user.SubToken ||
+		got.Name != user.Name || len(got.Protocols) != 2 || got.MaxIPs != 2 {
+		t.Errorf("Imported user differs: %+v", got)
+	}
+
+	// 再次导入：默认冲突报错，skip 跳过
+	if _, err := dst.ImportUsers(users, ConflictError); err == nil {
+		t.Error("Expected conflict error")
+	}
+	if result, err := dst.ImportUsers(users, ConflictSkip); err != nil || result.Skipped != 1 {
+		t.Errorf("Expected 1 skipped, got %+v %v", result, err)
+	}
+
+	// 覆盖时记录修改前后的用户（用于审计）
+	users[0].Name = "renamed"
+	result, err = dst.ImportUsers(users, ConflictOverwrite)
+	if err != nil || result.Updated != 1 || len(result.Changes) != 1 {
+		t.Fatalf("Overwrite failed: %+v %v", result, err)
+	}
+	if c := result.Changes[0]; c.Before == nil || c.Before.Name != user.Name || c.After.Name != "renamed" {
+		t.Errorf("Overwrite change = %+v", c)
+	}
+}
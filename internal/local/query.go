@@ -0,0 +1,213 @@
+package local
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// UserSort 用户列表排序字段
+type UserSort string
+
+const (
+	SortCreatedAt   UserSort = "created_at"
+	SortName        UserSort = "name"
+	SortTrafficUsed UserSort = "traffic_used"
+)
+
+// ErrInvalidCursor 分页游标无法解析或与查询的排序方式不一致
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UserQuery 用户查询条件，零值表示不过滤、按创建时间升序返回全部
+type UserQuery struct {
+	Enabled        *bool
+	Expired        *bool
+	OverQuota      *bool
+	Protocol       string
+	NameContains   string        // 名称子串，不区分大小写
+	ExpiringWithin time.Duration // >0 时只返回将在该时间内过期（尚未过期）的用户
+
+	Sort   UserSort
+	Desc   bool
+	Limit  int    // 0 = 不分页
+	Cursor string // 上一页返回的 NextCursor
+
+	Now time.Time // 判断过期的时间，零值为当前时间
+}
+
+// UserPage 查询结果
+type UserPage struct {
+	Users      []LocalUser
+	Total      int    // 满足过滤条件的用户总数
+	NextCursor string // 为空表示没有下一页
+}
+
+// userKey 排序键（keyset 分页：游标记录上一页最后一个用户的排序键）
+type userKey struct {
+	Int  int64  `json:"i,omitempty"`
+	Str  string `json:"s,omitempty"`
+	UUID string `json:"u"`
+}
+
+// cursorData 游标内容
+type cursorData struct {
+	Sort UserSort `json:"o"`
+	Desc bool     `json:"d,omitempty"`
+	Key  userKey  `json:"k"`
+}
+
+// ParseUserSort 解析排序字段，空字符串为默认的创建时间
+func ParseUserSort(s string) (UserSort, error) {
+	switch UserSort(s) {
+	case "":
+		return SortCreatedAt, nil
+	case SortCreatedAt, SortName, SortTrafficUsed:
+		return UserSort(s), nil
+	}
+	return "", fmt.Errorf("unknown sort field: %s", s)
+}
+
+// QueryUsers 过滤、排序并分页返回用户
+// 只在持有读锁时遍历指针，最后复制当前页，用户量大时不会复制全部数据
+func (s *Store) QueryUsers(q UserQuery) (*UserPage, error) {
+	sortBy, err := ParseUserSort(string(q.Sort))
+	if err != nil {
+		return nil, err
+	}
+
+	var after *userKey
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != sortBy || c.Desc != q.Desc {
+			return nil, ErrInvalidCursor
+		}
+		after = &c.Key
+	}
+
+	now := q.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	name := strings.ToLower(q.NameContains)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := make([]*LocalUser, 0, len(s.users))
+	for _, u := range s.users {
+		if q.matches(u, now, name) {
+			matched = append(matched, u)
+		}
+	}
+
+	compare := func(a, b *LocalUser) int {
+		c := compareKeys(keyOf(a, sortBy), keyOf(b, sortBy))
+		if q.Desc {
+			return -c
+		}
+		return c
+	}
+	slices.SortFunc(matched, compare)
+
+	page := &UserPage{Total: len(matched)}
+
+	start := 0
+	if after != nil {
+		start, _ = slices.BinarySearchFunc(matched, *after, func(u *LocalUser, k userKey) int {
+			c := compareKeys(keyOf(u, sortBy), k)
+			if q.Desc {
+				return -c
+			}
+			return c
+		})
+		// 跳过游标本身对应的用户
+		if start < len(matched) && matched[start].UUID == after.UUID {
+			start++
+		}
+	}
+
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+		page.NextCursor = encodeCursor(cursorData{
+			Sort: sortBy,
+			Desc: q.Desc,
+			Key:  keyOf(matched[end-1], sortBy),
+		})
+	}
+
+	page.Users = make([]LocalUser, 0, end-start)
+	for _, u := range matched[start:end] {
+		page.Users = append(page.Users, *u)
+	}
+	return page, nil
+}
+
+// matches 检查用户是否满足过滤条件
+func (q *UserQuery) matches(u *LocalUser, now time.Time, name string) bool {
+	if q.Enabled != nil && u.Enabled != *q.Enabled {
+		return false
+	}
+	if q.Expired != nil && u.IsExpired(now) != *q.Expired {
+		return false
+	}
+	if q.OverQuota != nil && u.IsOverQuota() != *q.OverQuota {
+		return false
+	}
+	if q.Protocol != "" && !slices.Contains(u.Protocols, q.Protocol) {
+		return false
+	}
+	if name != "" && !strings.Contains(strings.ToLower(u.Name), name) {
+		return false
+	}
+	if q.ExpiringWithin > 0 {
+		if u.ExpireAt == nil || u.IsExpired(now) || u.ExpireAt.After(now.Add(q.ExpiringWithin)) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyOf 用户的排序键，UUID 保证顺序稳定
+func keyOf(u *LocalUser, sortBy UserSort) userKey {
+	switch sortBy {
+	case SortName:
+		return userKey{Str: u.Name, UUID: u.UUID}
+	case SortTrafficUsed:
+		return userKey{Int: u.TrafficUsed, UUID: u.UUID}
+	default:
+		return userKey{Int: u.CreatedAt.UnixNano(), UUID: u.UUID}
+	}
+}
+
+func compareKeys(a, b userKey) int {
+	if c := cmp.Compare(a.Int, b.Int); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Str, b.Str); c != 0 {
+		return c
+	}
+	return strings.Compare(a.UUID, b.UUID)
+}
+
+func encodeCursor(c cursorData) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*cursorData, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c cursorData
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,68 @@
+package local
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestQueryUsersPagination 测试过滤后按游标分页遍历，结果不重复不遗漏
+func TestQueryUsersPagination(t *testing.T) {
+	store, err := NewStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traffic := make(map[string]int64)
+	for i := 0; i < 25; i++ {
+		protocols := []string{"vless"}
+		if i%5 == 0 {
+			protocols = []string{"shadowsocks"}
+		}
+		u, err := store.CreateUser(&CreateUserRequest{Name: fmt.Sprintf("user-%02d", i), Protocols: protocols})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 制造相同的流量值，验证 UUID 作为次级排序键
+		traffic[u.UUID] = int64(i%3 + 1)
+	}
+	store.AddTraffic(traffic)
+
+	q := UserQuery{Protocol: "vless", Sort: SortTrafficUsed, Desc: true, Limit: 7}
+	seen := make(map[string]bool)
+	last := int64(1 << 62)
+	pages := 0
+	for {
+		page, err := store.QueryUsers(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		if page.Total != 20 {
+			t.Fatalf("Expected 20 matching users, got %d", page.Total)
+		}
+		for _, u := range page.Users {
+			if seen[u.UUID] {
+				t.Fatalf("User %s returned twice", u.Name)
+			}
+			if u.TrafficUsed > last {
+				t.Fatalf("Users not sorted by traffic desc")
+			}
+			seen[u.UUID] = true
+			last = u.TrafficUsed
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	if len(seen) != 20 || pages != 3 {
+		t.Errorf("Expected 20 users in 3 pages, got %d in %d", len(seen), pages)
+	}
+
+	// 游标与排序方式不一致
+	q.Sort = SortName
+	if _, err := store.QueryUsers(q); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
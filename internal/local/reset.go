@@ -0,0 +1,105 @@
+package local
+
+import (
+	"fmt"
+	"time"
+)
+
+// ResetPolicy 流量重置策略
+type ResetPolicy string
+
+const (
+	ResetNever    ResetPolicy = "never"    // 不重置（累计流量）
+	ResetMonthly  ResetPolicy = "monthly"  // 每月 ResetDay 日 0 点重置（服务器本地时区）
+	ResetInterval ResetPolicy = "interval" // 从创建时间起每 ResetIntervalDays 天重置
+)
+
+// maxTrafficHistory 每个用户保留的历史周期数
+const maxTrafficHistory = 12
+
+// TrafficPeriod 已结束的流量周期
+type TrafficPeriod struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Used   int64     `json:"used"`
+	Manual bool      `json:"manual,omitempty"` // 通过 API 手动重置
+}
+
+// ValidateResetPolicy 校验重置策略参数
+func ValidateResetPolicy(policy ResetPolicy, day, intervalDays int) error {
+	switch policy {
+	case "", ResetNever:
+	case ResetMonthly:
+		if day < 1 || day > 31 {
+			return fmt.Errorf("reset_day must be between 1 and 31")
+		}
+	case ResetInterval:
+		if intervalDays < 1 {
+			return fmt.Errorf("reset_interval_days must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown reset_policy: %s", policy)
+	}
+	return nil
+}
+
+// nextResetAfter 计算 after 之后的下一次重置时间，不重置时返回 nil
+func (u *LocalUser) nextResetAfter(after time.Time) *time.Time {
+	var next time.Time
+
+	switch u.ResetPolicy {
+	case ResetMonthly:
+		after = after.In(time.Local)
+		next = monthlyResetAt(after.Year(), after.Month(), u.ResetDay)
+		if !next.After(after) {
+			next = monthlyResetAt(after.Year(), after.Month()+1, u.ResetDay)
+		}
+	case ResetInterval:
+		if u.ResetIntervalDays < 1 {
+			return nil
+		}
+		// 先按整天数估算已经过的周期数，再用 AddDate 修正（跨夏令时时一天不一定是 24 小时）
+		periods := int(after.Sub(u.CreatedAt)/(24*time.Hour)) / u.ResetIntervalDays
+		periods = max(periods, 0)
+		next = u.CreatedAt.AddDate(0, 0, periods*u.ResetIntervalDays)
+		for !next.After(after) {
+			next = next.AddDate(0, 0, u.ResetIntervalDays)
+		}
+	default:
+		return nil
+	}
+
+	return &next
+}
+
+// monthlyResetAt 某月的重置时间，重置日超过当月天数时取月末
+func monthlyResetAt(year int, month time.Month, day int) time.Time {
+	// time.Date 会规范化越界的月份
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, lastDay)-1)
+}
+
+// rollPeriod 归档当前周期并清零已用流量
+// boundary 为本周期结束时间（定时重置为计划的重置时间，手动重置为当前时间）
+func (u *LocalUser) rollPeriod(boundary, now time.Time, manual bool) {
+	start := u.CreatedAt
+	if u.PeriodStart != nil {
+		start = *u.PeriodStart
+	}
+
+	u.TrafficHistory = append(u.TrafficHistory, TrafficPeriod{
+		Start:  start,
+		End:    boundary,
+		Used:   u.TrafficUsed,
+		Manual: manual,
+	})
+	if len(u.TrafficHistory) > maxTrafficHistory {
+		u.TrafficHistory = append([]TrafficPeriod(nil), u.TrafficHistory[len(u.TrafficHistory)-maxTrafficHistory:]...)
+	}
+
+	u.TrafficUsed = 0
+	u.PeriodStart = &boundary
+	u.NextResetAt = u.nextResetAfter(now)
+	u.UpdatedAt = now
+}
@@ -0,0 +1,57 @@
+package local
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNextResetMonthly 测试每月重置日超过当月天数时取月末
+func TestNextResetMonthly(t *testing.T) {
+	u := &LocalUser{ResetPolicy: ResetMonthly, ResetDay: 31}
+
+	next := u.nextResetAfter(time.Date(2025, time.January, 31, 12, 0, 0, 0, time.Local))
+	want := time.Date(2025, time.February, 28, 0, 0, 0, 0, time.Local)
+	if next == nil || !next.Equal(want) {
+		t.Fatalf("Expected %s, got %v", want, next)
+	}
+
+	// 正好在重置时间点时取下一个月
+	next = u.nextResetAfter(want)
+	want = time.Date(2025, time.March, 31, 0, 0, 0, 0, time.Local)
+	if next == nil || !next.Equal(want) {
+		t.Fatalf("Expected %s, got %v", want, next)
+	}
+}
+
+// TestResetDueTraffic 测试到期重置归档上一周期并清零
+func TestResetDueTraffic(t *testing.T) {
+	store, err := NewStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := store.CreateUser(&CreateUserRequest{Name: "u", ResetPolicy: ResetInterval, ResetIntervalDays: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddTraffic(map[string]int64{user.UUID: 1000})
+	firstReset := *user.NextResetAt
+
+	if reset, _ := store.ResetDueTraffic(time.Now()); len(reset) != 0 {
+		t.Fatalf("Nothing should be due yet, reset %v", reset)
+	}
+
+	due := firstReset.Add(time.Minute)
+	reset, err := store.ResetDueTraffic(due)
+	if err != nil || len(reset) != 1 {
+		t.Fatalf("Expected 1 reset, got %v (err %v)", reset, err)
+	}
+
+	got, _ := store.GetUser(user.UUID)
+	if got.TrafficUsed != 0 || len(got.TrafficHistory) != 1 || got.TrafficHistory[0].Used != 1000 {
+		t.Errorf("Unexpected state after reset: used=%d history=%+v", got.TrafficUsed, got.TrafficHistory)
+	}
+	if !got.PeriodStart.Equal(firstReset) || !got.NextResetAt.After(due) {
+		t.Errorf("Unexpected period: start=%v next=%v", got.PeriodStart, got.NextResetAt)
+	}
+}
@@ -2,8 +2,10 @@ package local
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,6 +13,8 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+
+	"otun-node-agent/internal/persist"
 )
 
 // LocalUser 本地管理的用户
@@ -23,8 +27,28 @@ type LocalUser struct {
 	TrafficLimit int64      `json:"traffic_limit"` // 字节，0=无限
 	TrafficUsed  int64      `json:"traffic_used"`
 	ExpireAt     *time.Time `json:"expire_at"`
+	MaxIPs       int        `json:"max_ips"`   // 最大同时在线 IP 数，0=不限制
+	SubToken     string     `json:"sub_token"` // 订阅令牌（公开订阅地址 /sub/{token}）
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// 流量周期重置
+	ResetPolicy       ResetPolicy     `json:"reset_policy,omitempty"`        // 空 = never
+	ResetDay          int             `json:"reset_day,omitempty"`           // monthly：每月重置日 1-31
+	ResetIntervalDays int             `json:"reset_interval_days,omitempty"` // interval：重置间隔天数
+	PeriodStart       *time.Time      `json:"period_start,omitempty"`        // 当前周期开始时间，nil = 创建时间
+	NextResetAt       *time.Time      `json:"next_reset_at,omitempty"`
+	TrafficHistory    []TrafficPeriod `json:"traffic_history,omitempty"` // 最近的已结束周期
+}
+
+// IsExpired 检查用户是否已过期
+func (u *LocalUser) IsExpired(now time.Time) bool {
+	return u.ExpireAt != nil && now.After(*u.ExpireAt)
+}
+
+// IsOverQuota 检查用户是否已用完流量（0 = 无限制）
+func (u *LocalUser) IsOverQuota() bool {
+	return u.TrafficLimit > 0 && u.TrafficUsed >= u.TrafficLimit
 }
 
 // LocalUsersData 本地用户数据文件结构
@@ -52,43 +76,61 @@ type Store struct {
 }
 
 // NewStore 创建本地用户存储
-func NewStore(dataDir string, onChange func()) *Store {
+// 数据文件损坏时返回错误，而不是以空用户启动并在下次修改时覆盖原文件
+func NewStore(dataDir string, onChange func()) (*Store, error) {
 	s := &Store{
 		dataDir:  dataDir,
 		users:    make(map[string]*LocalUser),
 		onChange: onChange,
 	}
-	s.load()
-	return s
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load local users: %w", err)
+	}
+	return s, nil
+}
+
+// dataPath 用户数据文件路径
+func (s *Store) dataPath() string {
+	return filepath.Join(s.dataDir, "local_users.json")
 }
 
 // load 从文件加载用户
 func (s *Store) load() error {
-	path := filepath.Join(s.dataDir, "local_users.json")
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
+	var usersData LocalUsersData
+	if err := persist.ReadJSON(s.dataPath(), &usersData); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
 			return nil // 文件不存在，正常情况
 		}
 		return err
 	}
 
-	var usersData LocalUsersData
-	if err := json.Unmarshal(data, &usersData); err != nil {
-		return err
-	}
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	backfilled := 0
 	for i := range usersData.Users {
 		user := usersData.Users[i]
+		// 旧版本数据没有订阅令牌，补齐
+		if user.SubToken == "" {
+			token, err := generateSubToken()
+			if err != nil {
+				return fmt.Errorf("generate sub token: %w", err)
+			}
+			user.SubToken = token
+			backfilled++
+		}
 		s.users[user.UUID] = &user
 	}
 
 	// 加载熔断状态
 	s.circuitBreaker = usersData.CircuitBreaker
 
+	if backfilled > 0 {
+		if err := s.save(); err != nil {
+			return fmt.Errorf("save backfilled sub tokens: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -107,13 +149,7 @@ func (s *Store) save() error {
 		CircuitBreaker: s.circuitBreaker,
 	}
 
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	path := filepath.Join(s.dataDir, "local_users.json")
-	return os.WriteFile(path, jsonData, 0644)
+	return persist.WriteJSON(s.dataPath(), data, 0644)
 }
 
 // CreateUser 创建新用户
@@ -121,15 +157,39 @@ func (s *Store) CreateUser(req *CreateUserRequest) (*LocalUser, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// 生成 UUID
-	userUUID := uuid.New().String()
+	user, err := newUser(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	s.users[user.UUID] = user
 
+	if err := s.save(); err != nil {
+		delete(s.users, user.UUID)
+		return nil, fmt.Errorf("save users: %w", err)
+	}
+
+	// 触发回调
+	if s.onChange != nil {
+		go s.onChange()
+	}
+
+	return user, nil
+}
+
+// newUser 根据创建请求生成用户（UUID、SS 密码、订阅令牌随机生成）
+func newUser(req *CreateUserRequest, now time.Time) (*LocalUser, error) {
 	// 生成 SS 密码
 	ssPassword, err := generatePassword(16)
 	if err != nil {
 		return nil, fmt.Errorf("generate password: %w", err)
 	}
 
+	subToken, err := generateSubToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate sub token: %w", err)
+	}
+
 	// 默认协议
 	protocols := req.Protocols
 	if len(protocols) == 0 {
@@ -139,13 +199,12 @@ func (s *Store) CreateUser(req *CreateUserRequest) (*LocalUser, error) {
 	// 计算过期时间
 	var expireAt *time.Time
 	if req.ExpireDays > 0 {
-		t := time.Now().AddDate(0, 0, req.ExpireDays)
+		t := now.AddDate(0, 0, req.ExpireDays)
 		expireAt = &t
 	}
 
-	now := time.Now()
 	user := &LocalUser{
-		UUID:         userUUID,
+		UUID:         uuid.New().String(),
 		Name:         req.Name,
 		Protocols:    protocols,
 		SSPassword:   ssPassword,
@@ -153,22 +212,16 @@ func (s *Store) CreateUser(req *CreateUserRequest) (*LocalUser, error) {
 		TrafficLimit: req.TrafficLimit,
 		TrafficUsed:  0,
 		ExpireAt:     expireAt,
+		MaxIPs:       req.MaxIPs,
+		SubToken:     subToken,
 		CreatedAt:    now,
 		UpdatedAt:    now,
-	}
-
-	s.users[userUUID] = user
 
-	if err := s.save(); err != nil {
-		delete(s.users, userUUID)
-		return nil, fmt.Errorf("save users: %w", err)
+		ResetPolicy:       req.ResetPolicy,
+		ResetDay:          req.ResetDay,
+		ResetIntervalDays: req.ResetIntervalDays,
 	}
-
-	// 触发回调
-	if s.onChange != nil {
-		go s.onChange()
-	}
-
+	user.NextResetAt = user.nextResetAfter(now)
 	return user, nil
 }
 
@@ -186,6 +239,52 @@ func (s *Store) GetUser(uuid string) (*LocalUser, bool) {
 	return &copy, true
 }
 
+// GetUserBySubToken 通过订阅令牌获取用户
+func (s *Store) GetUserBySubToken(token string) (*LocalUser, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if subtle.ConstantTimeCompare([]byte(u.SubToken), []byte(token)) == 1 {
+			copy := *u
+			return &copy, true
+		}
+	}
+	return nil, false
+}
+
+// ResetSubToken 重新生成用户的订阅令牌，旧订阅地址立即失效
+func (s *Store) ResetSubToken(uuid string) (*LocalUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[uuid]
+	if !ok {
+		return nil, fmt.Errorf("user not found: %s", uuid)
+	}
+
+	token, err := generateSubToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate sub token: %w", err)
+	}
+
+	oldToken := user.SubToken
+	user.SubToken = token
+	user.UpdatedAt = time.Now()
+
+	if err := s.save(); err != nil {
+		user.SubToken = oldToken
+		return nil, fmt.Errorf("save users: %w", err)
+	}
+
+	copy := *user
+	return &copy, nil
+}
+
 // ListUsers 获取所有用户
 func (s *Store) ListUsers() []LocalUser {
 	s.mu.RLock()
@@ -208,6 +307,23 @@ func (s *Store) UpdateUser(uuid string, req *UpdateUserRequest) (*LocalUser, err
 		return nil, fmt.Errorf("user not found: %s", uuid)
 	}
 
+	applyUpdate(user, req, time.Now())
+
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("save users: %w", err)
+	}
+
+	// 触发回调
+	if s.onChange != nil {
+		go s.onChange()
+	}
+
+	copy := *user
+	return &copy, nil
+}
+
+// applyUpdate 将更新请求应用到用户
+func applyUpdate(user *LocalUser, req *UpdateUserRequest, now time.Time) {
 	// 更新字段
 	if req.Name != nil {
 		user.Name = *req.Name
@@ -220,7 +336,7 @@ func (s *Store) UpdateUser(uuid string, req *UpdateUserRequest) (*LocalUser, err
 	}
 	if req.ExpireDays != nil {
 		if *req.ExpireDays > 0 {
-			t := time.Now().AddDate(0, 0, *req.ExpireDays)
+			t := now.AddDate(0, 0, *req.ExpireDays)
 			user.ExpireAt = &t
 		} else {
 			user.ExpireAt = nil
@@ -229,20 +345,25 @@ func (s *Store) UpdateUser(uuid string, req *UpdateUserRequest) (*LocalUser, err
 	if req.Protocols != nil && len(req.Protocols) > 0 {
 		user.Protocols = req.Protocols
 	}
-
-	user.UpdatedAt = time.Now()
-
-	if err := s.save(); err != nil {
-		return nil, fmt.Errorf("save users: %w", err)
+	if req.MaxIPs != nil {
+		user.MaxIPs = *req.MaxIPs
 	}
 
-	// 触发回调
-	if s.onChange != nil {
-		go s.onChange()
+	// 修改重置策略只影响下一次重置时间，当前周期已用流量保持不变
+	if req.ResetPolicy != nil || req.ResetDay != nil || req.ResetIntervalDays != nil {
+		if req.ResetPolicy != nil {
+			user.ResetPolicy = *req.ResetPolicy
+		}
+		if req.ResetDay != nil {
+			user.ResetDay = *req.ResetDay
+		}
+		if req.ResetIntervalDays != nil {
+			user.ResetIntervalDays = *req.ResetIntervalDays
+		}
+		user.NextResetAt = user.nextResetAfter(now)
 	}
 
-	copy := *user
-	return &copy, nil
+	user.UpdatedAt = now
 }
 
 // DeleteUser 删除用户
@@ -279,6 +400,88 @@ func (s *Store) UpdateTraffic(uuid string, upload, download int64) {
 	}
 }
 
+// AddTraffic 批量累加用户流量（uuid -> 字节数），只写一次文件
+// 返回本次涉及的本地用户累加后的已用流量，非本地用户会被忽略
+func (s *Store) AddTraffic(traffic map[string]int64) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	totals := make(map[string]int64)
+	for uuid, bytes := range traffic {
+		user, ok := s.users[uuid]
+		if !ok || bytes <= 0 {
+			continue
+		}
+		user.TrafficUsed += bytes
+		totals[uuid] = user.TrafficUsed
+	}
+
+	if len(totals) == 0 {
+		return totals, nil
+	}
+
+	if err := s.save(); err != nil {
+		return totals, fmt.Errorf("save traffic: %w", err)
+	}
+	return totals, nil
+}
+
+// ResetTraffic 手动结束当前流量周期：归档已用流量并清零，重置计划不变
+func (s *Store) ResetTraffic(uuid string) (*LocalUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[uuid]
+	if !ok {
+		return nil, fmt.Errorf("user not found: %s", uuid)
+	}
+
+	before := *user
+	now := time.Now()
+	user.rollPeriod(now, now, true)
+
+	if err := s.save(); err != nil {
+		*user = before
+		return nil, fmt.Errorf("save users: %w", err)
+	}
+
+	// 超额被停用的用户需要重新加入配置
+	if s.onChange != nil {
+		go s.onChange()
+	}
+
+	copy := *user
+	return &copy, nil
+}
+
+// ResetDueTraffic 重置所有到期用户的流量周期，返回被重置的用户 UUID
+func (s *Store) ResetDueTraffic(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reset []string
+	for uuid, user := range s.users {
+		if user.NextResetAt == nil || user.NextResetAt.After(now) {
+			continue
+		}
+		user.rollPeriod(*user.NextResetAt, now, false)
+		reset = append(reset, uuid)
+	}
+
+	if len(reset) == 0 {
+		return nil, nil
+	}
+
+	if err := s.save(); err != nil {
+		return reset, fmt.Errorf("save users: %w", err)
+	}
+
+	if s.onChange != nil {
+		go s.onChange()
+	}
+	return reset, nil
+}
+
 // GetUserCount 获取用户数量
 func (s *Store) GetUserCount() int {
 	s.mu.RLock()
@@ -292,6 +495,11 @@ type CreateUserRequest struct {
 	Protocols    []string `json:"protocols"`     // 可选，默认 ["vless", "shadowsocks"]
 	TrafficLimit int64    `json:"traffic_limit"` // 字节，0=无限
 	ExpireDays   int      `json:"expire_days"`   // 天数，0=永不过期
+	MaxIPs       int      `json:"max_ips"`       // 最大同时在线 IP 数，0=不限制
+
+	ResetPolicy       ResetPolicy `json:"reset_policy"`        // never/monthly/interval，默认 never
+	ResetDay          int         `json:"reset_day"`           // monthly：每月重置日 1-31（超过当月天数取月末）
+	ResetIntervalDays int         `json:"reset_interval_days"` // interval：重置间隔天数
 }
 
 // UpdateUserRequest 更新用户请求
@@ -301,6 +509,20 @@ type UpdateUserRequest struct {
 	TrafficLimit *int64   `json:"traffic_limit,omitempty"`
 	ExpireDays   *int     `json:"expire_days,omitempty"`
 	Protocols    []string `json:"protocols,omitempty"`
+	MaxIPs       *int     `json:"max_ips,omitempty"`
+
+	ResetPolicy       *ResetPolicy `json:"reset_policy,omitempty"`
+	ResetDay          *int         `json:"reset_day,omitempty"`
+	ResetIntervalDays *int         `json:"reset_interval_days,omitempty"`
+}
+
+// generateSubToken 生成不可猜测的订阅令牌（256 位随机数）
+func generateSubToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
 
 // generatePassword 生成随机密码
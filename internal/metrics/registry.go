@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标类型
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// Sample 单个样本
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Family 同名指标的一组样本
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// CollectFunc 抓取时动态生成的指标（例如连接数、证书过期时间）
+type CollectFunc func() []Family
+
+// Registry 指标注册表，输出 Prometheus 文本格式
+// 只实现 agent 需要的 counter/gauge，避免引入完整的客户端库
+type Registry struct {
+	mu         sync.Mutex
+	vecs       []*Vec
+	collectors []CollectFunc
+}
+
+// NewRegistry 创建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounterVec 注册带标签的计数器
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *Vec {
+	return r.newVec(name, help, TypeCounter, labelNames)
+}
+
+// NewGaugeVec 注册带标签的仪表
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *Vec {
+	return r.newVec(name, help, TypeGauge, labelNames)
+}
+
+func (r *Registry) newVec(name, help, typ string, labelNames []string) *Vec {
+	v := &Vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		values:     make(map[string]*vecEntry),
+	}
+
+	r.mu.Lock()
+	r.vecs = append(r.vecs, v)
+	r.mu.Unlock()
+	return v
+}
+
+// RegisterFunc 注册抓取时调用的指标生成函数
+func (r *Registry) RegisterFunc(fn CollectFunc) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, fn)
+	r.mu.Unlock()
+}
+
+// Gather 收集所有指标
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	vecs := append([]*Vec(nil), r.vecs...)
+	collectors := append([]CollectFunc(nil), r.collectors...)
+	r.mu.Unlock()
+
+	var families []Family
+	for _, v := range vecs {
+		families = append(families, v.family())
+	}
+	for _, fn := range collectors {
+		families = append(families, fn()...)
+	}
+	return families
+}
+
+// WriteText 以 Prometheus 文本格式输出
+func (r *Registry) WriteText(buf *bytes.Buffer) {
+	for _, f := range r.Gather() {
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			buf.WriteString(f.Name)
+			writeLabels(buf, s.Labels)
+			buf.WriteByte(' ')
+			buf.WriteString(formatValue(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// Handler 返回 /metrics HTTP 处理函数
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		r.WriteText(&buf)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	}
+}
+
+// Vec 带标签的 counter/gauge
+type Vec struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	values     map[string]*vecEntry
+}
+
+type vecEntry struct {
+	labelValues []string
+	value       float64
+}
+
+// Add 累加（counter 只应传入非负值）
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	v.update(labelValues, func(e *vecEntry) { e.value += delta })
+}
+
+// Inc 加一
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set 设置值（用于 gauge）
+func (v *Vec) Set(value float64, labelValues ...string) {
+	v.update(labelValues, func(e *vecEntry) { e.value = value })
+}
+
+func (v *Vec) update(labelValues []string, fn func(e *vecEntry)) {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d",
+			v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.values[key]
+	if !ok {
+		e = &vecEntry{labelValues: append([]string(nil), labelValues...)}
+		v.values[key] = e
+	}
+	fn(e)
+}
+
+// Retain 只保留 label 的值满足 keep 的序列（例如删除已删除用户的序列）
+func (v *Vec) Retain(label string, keep func(value string) bool) {
+	idx := -1
+	for i, name := range v.labelNames {
+		if name == label {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, e := range v.values {
+		if !keep(e.labelValues[idx]) {
+			delete(v.values, key)
+		}
+	}
+}
+
+func (v *Vec) family() Family {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f := Family{Name: v.name, Help: v.help, Type: v.typ}
+	for _, k := range keys {
+		e := v.values[k]
+		labels := make(map[string]string, len(v.labelNames))
+		for i, name := range v.labelNames {
+			labels[name] = e.labelValues[i]
+		}
+		f.Samples = append(f.Samples, Sample{Labels: labels, Value: e.value})
+	}
+	return f
+}
+
+// writeLabels 输出 {k="v",...}，按标签名排序保证输出稳定
+func writeLabels(buf *bytes.Buffer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabel(labels[name]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	traffic := r.NewCounterVec("otun_user_traffic_bytes_total", "Traffic per user.\nSecond line.", "user", "direction")
+	traffic.Add(10, "b", "upload")
+	traffic.Add(5, "a", "download")
+	traffic.Add(1.5, "a", "download")
+	up := r.NewGaugeVec("otun_up", "Whether it is up.")
+	up.Set(1)
+	r.RegisterFunc(func() []Family {
+		return []Family{{
+			Name:    "otun_odd",
+			Help:    `Label escaping.`,
+			Type:    TypeGauge,
+			Samples: []Sample{{Labels: map[string]string{"v": "a\"b\\c\nd"}, Value: math.Inf(1)}},
+		}}
+	})
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+
+	want := `# HELP otun_user_traffic_bytes_total Traffic per user.\nSecond line.
+# TYPE otun_user_traffic_bytes_total counter
+otun_user_traffic_bytes_total{direction="download",user="a"} 6.5
+otun_user_traffic_bytes_total{direction="upload",user="b"} 10
+# HELP otun_up Whether it is up.
+# TYPE otun_up gauge
+otun_up 1
+# HELP otun_odd Label escaping.
+# TYPE otun_odd gauge
+otun_odd{v="a\"b\\c\nd"} +Inf
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("output mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVecRetain(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("otun_test_total", "Test.", "user", "direction")
+	v.Inc("a", "upload")
+	v.Inc("a", "download")
+	v.Inc("b", "upload")
+
+	v.Retain("user", func(user string) bool { return user == "b" })
+
+	f := v.family()
+	if len(f.Samples) != 1 || f.Samples[0].Labels["user"] != "b" {
+		t.Fatalf("samples after retain = %+v, want only user b", f.Samples)
+	}
+}
@@ -0,0 +1,133 @@
+package persist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// BackupSuffix 上一代文件的后缀
+const BackupSuffix = ".bak"
+
+// CorruptError 文件存在但内容无法解析
+type CorruptError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%s is corrupt: %v (previous generation may be available at %s%s)",
+		e.Path, e.Err, e.Path, BackupSuffix)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// WriteFile 原子写入文件
+// 流程：写入同目录临时文件 → fsync → rename 覆盖 → fsync 目录
+// 任何时刻断电，目标文件要么是旧内容，要么是完整的新内容
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	// 出错时清理临时文件
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+
+	if err := Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	success = true
+	return nil
+}
+
+// WriteFileWithBackup 原子写入文件，并先把现有内容保存为 path.bak
+func WriteFileWithBackup(path string, data []byte, perm os.FileMode) error {
+	if old, err := os.ReadFile(path); err == nil {
+		if err := WriteFile(path+BackupSuffix, old, perm); err != nil {
+			return fmt.Errorf("write backup: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read current file: %w", err)
+	}
+
+	return WriteFile(path, data, perm)
+}
+
+// WriteJSON 序列化为带缩进的 JSON 并原子写入（保留 .bak）
+func WriteJSON(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", filepath.Base(path), err)
+	}
+	return WriteFileWithBackup(path, data, perm)
+}
+
+// ReadJSON 读取并解析 JSON 文件
+// 文件不存在时返回的错误满足 errors.Is(err, os.ErrNotExist)；内容损坏时返回 *CorruptError
+func ReadJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return &CorruptError{Path: path, Err: err}
+	}
+	return nil
+}
+
+// IsCorrupt 判断错误是否为文件损坏
+func IsCorrupt(err error) bool {
+	var corrupt *CorruptError
+	return errors.As(err, &corrupt)
+}
+
+// Rename 原子重命名并 fsync 所在目录，确保 rename 本身落盘
+func Rename(oldPath, newPath string) error {
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("rename %s: %w", filepath.Base(newPath), err)
+	}
+	return SyncDir(filepath.Dir(newPath))
+}
+
+// SyncDir fsync 目录
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
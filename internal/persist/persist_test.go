@@ -0,0 +1,62 @@
+package persist
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteFileWithBackup 测试写入新内容时保留上一代文件
+func TestWriteFileWithBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	if err := WriteFileWithBackup(path, []byte(`{"v":1}`), 0600); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	if _, err := os.Stat(path + BackupSuffix); !os.IsNotExist(err) {
+		t.Errorf("No backup expected after first write, got err=%v", err)
+	}
+
+	if err := WriteFileWithBackup(path, []byte(`{"v":2}`), 0600); err != nil {
+		t.Fatalf("second write: %v", err)
+	}
+
+	current, _ := os.ReadFile(path)
+	backup, _ := os.ReadFile(path + BackupSuffix)
+	if string(current) != `{"v":2}` || string(backup) != `{"v":1}` {
+		t.Errorf("Unexpected contents: current=%s backup=%s", current, backup)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// 不应残留临时文件
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".state.json.tmp-*"))
+	if len(matches) != 0 {
+		t.Errorf("Temp files left behind: %v", matches)
+	}
+}
+
+// TestReadJSON 测试文件不存在与文件损坏能被区分
+func TestReadJSON(t *testing.T) {
+	dir := t.TempDir()
+
+	var v map[string]int
+	err := ReadJSON(filepath.Join(dir, "missing.json"), &v)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte(`{"v":`), 0644)
+	err = ReadJSON(corrupt, &v)
+	if !IsCorrupt(err) {
+		t.Errorf("Expected corrupt error, got %v", err)
+	}
+}
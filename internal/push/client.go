@@ -0,0 +1,207 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/controlplane"
+)
+
+// 事件类型
+const (
+	EventCommand = "command" // data 为与心跳响应相同结构的指令
+	EventPing    = "ping"    // 保活
+)
+
+const (
+	minBackoff  = time.Second
+	maxBackoff  = time.Minute
+	idleTimeout = 90 * time.Second // 超过该时间没有收到任何数据（包括保活）视为连接已断开
+	stableAfter = 30 * time.Second // 连接保持超过该时间后重置退避
+)
+
+// Handler 处理一条推送指令
+type Handler func(ctx context.Context, cmd *config.HeartbeatResponse)
+
+// Client 管理端推送通道（SSE）客户端
+// 断开期间指令仍通过心跳轮询送达，推送只是让指令即时生效
+// 连接通过 controlplane 客户端建立：认证头、User-Agent 和熔断与其他管理端请求一致
+type Client struct {
+	control   *controlplane.Client
+	path      string
+	nodeID    string
+	handler   Handler
+	onConnect func()
+
+	connected   atomic.Bool
+	mu          sync.Mutex
+	lastEventID string
+}
+
+// NewClient 创建推送客户端，path 相对 control 的服务地址
+// onConnect 在每次连接建立后调用（可为 nil），用于补拉断线期间错过的指令
+func NewClient(control *controlplane.Client, path, nodeID string, handler Handler, onConnect func()) *Client {
+	return &Client{
+		control:   control,
+		path:      path,
+		nodeID:    nodeID,
+		handler:   handler,
+		onConnect: onConnect,
+	}
+}
+
+// Connected 推送通道当前是否已连接
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+// Run 保持连接直到 ctx 取消，断开后按指数退避重连
+func (c *Client) Run(ctx context.Context) {
+	backoff := minBackoff
+
+	for {
+		start := time.Now()
+		err := c.connect(ctx)
+		c.connected.Store(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) > stableAfter {
+			backoff = minBackoff
+		}
+		delay := backoff + rand.N(backoff/2+1)
+		log.Printf("[Push] Disconnected: %v, reconnecting in %s (heartbeat polling continues)",
+			err, delay.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// connect 建立一次连接并读取事件，直到连接断开
+func (c *Client) connect(ctx context.Context) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	header := http.Header{}
+	header.Set("Accept", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Node-ID", c.nodeID)
+	c.mu.Lock()
+	if c.lastEventID != "" {
+		header.Set("Last-Event-ID", c.lastEventID)
+	}
+	c.mu.Unlock()
+
+	// 空闲检测：每收到一行数据就推迟（长连接没有整体超时）
+	idle := time.AfterFunc(idleTimeout, cancel)
+	defer idle.Stop()
+
+	resp, err := c.control.Stream(connCtx, controlplane.Request{Method: http.MethodGet, Path: c.path, Header: header})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.connected.Store(true)
+	log.Printf("[Push] Connected to %s%s", c.control.BaseURL(), c.path)
+	if c.onConnect != nil {
+		c.onConnect()
+	}
+
+	err = c.readEvents(ctx, resp.Body, func() { idle.Reset(idleTimeout) })
+	if connCtx.Err() != nil && ctx.Err() == nil {
+		return fmt.Errorf("no data for %s", idleTimeout)
+	}
+	return err
+}
+
+// readEvents 解析 SSE 事件流
+func (c *Client) readEvents(ctx context.Context, r io.Reader, touch func()) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var event, id string
+	var data strings.Builder
+
+	for scanner.Scan() {
+		touch()
+		line := scanner.Text()
+
+		// 空行表示事件结束
+		if line == "" {
+			if data.Len() > 0 {
+				c.dispatch(ctx, event, id, data.String())
+			}
+			event, id = "", ""
+			data.Reset()
+			continue
+		}
+		// 注释行（常用于保活）
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "id":
+			id = value
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stream: %w", err)
+	}
+	return fmt.Errorf("stream closed by server")
+}
+
+// dispatch 处理一个完整事件
+func (c *Client) dispatch(ctx context.Context, event, id, data string) {
+	if id != "" {
+		c.mu.Lock()
+		c.lastEventID = id
+		c.mu.Unlock()
+	}
+
+	switch event {
+	case EventPing:
+		return
+	case EventCommand, "":
+	default:
+		log.Printf("[Push] Ignoring unknown event %q", event)
+		return
+	}
+
+	var cmd config.HeartbeatResponse
+	if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+		log.Printf("[Push] Invalid command payload: %v", err)
+		return
+	}
+	c.handler(ctx, &cmd)
+}
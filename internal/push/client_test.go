@@ -0,0 +1,75 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"otun-node-agent/internal/config"
+	"otun-node-agent/internal/controlplane"
+)
+
+// TestClientReceivesCommands 测试解析 SSE 指令、忽略保活，并在重连时携带 Last-Event-ID
+func TestClientReceivesCommands(t *testing.T) {
+	lastIDs := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" || r.URL.Path != "/api/node/push" ||
+			r.Header.Get("User-Agent") != "otun-node-agent/test (node node-1)" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lastIDs <- r.Header.Get("Last-Event-ID")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keepalive\n\n")
+		fmt.Fprint(w, "event: ping\ndata: {}\n\n")
+		fmt.Fprint(w, "id: 7\nevent: command\ndata: {\"kick_users\":[\"u1\"],\n")
+		fmt.Fprint(w, "data: \"reload_users\":true}\n\n")
+		w.(http.Flusher).Flush()
+		// 返回即断开连接，客户端应重连
+	}))
+	defer srv.Close()
+
+	cmds := make(chan *config.HeartbeatResponse, 4)
+	control := controlplane.New(controlplane.Options{BaseURL: srv.URL, APIKey: "key", NodeID: "node-1", Version: "test"})
+	c := NewClient(control, "/api/node/push", "node-1", func(ctx context.Context, cmd *config.HeartbeatResponse) {
+		cmds <- cmd
+	}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+
+	select {
+	case cmd := <-cmds:
+		if len(cmd.KickUsers) != 1 || cmd.KickUsers[0] != "u1" || !cmd.ReloadUsers {
+			t.Errorf("Unexpected command: %+v", cmd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No command received")
+	}
+
+	if id := <-lastIDs; id != "" {
+		t.Errorf("First connection should not send Last-Event-ID, got %q", id)
+	}
+	select {
+	case id := <-lastIDs:
+		if id != "7" {
+			t.Errorf("Expected Last-Event-ID 7 on reconnect, got %q", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Client did not reconnect")
+	}
+
+	cancel()
+	<-done
+	if c.Connected() {
+		t.Error("Client should report disconnected after stop")
+	}
+}
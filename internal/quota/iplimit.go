@@ -0,0 +1,221 @@
+package quota
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"otun-node-agent/internal/config"
+)
+
+// rekickWindow 被断开的 IP 在此时间内重新连接且仍超限时，不再给宽限期
+const rekickWindow = 10 * time.Minute
+
+// ClientConn 用于并发 IP 检查的连接信息
+type ClientConn struct {
+	ID   string
+	User string
+	IP   string
+}
+
+// IPLimitEvent 一次并发 IP 超限处理记录
+type IPLimitEvent struct {
+	UUID      string    `json:"uuid"`
+	Limit     int       `json:"limit"`
+	IPs       []string  `json:"ips"`        // 所有在线 IP（按首次出现排序）
+	KickedIPs []string  `json:"kicked_ips"` // 被断开的 IP
+	Kicked    int       `json:"kicked"`     // 断开的连接数
+	Time      time.Time `json:"time"`
+}
+
+// IPLimiter 限制每个用户同时在线的客户端 IP 数
+// 超出限制的 IP 按首次出现时间判定（最新的为多余），
+// 持续超限超过宽限期才断开，避免移动网络切换 IP 时误踢
+type IPLimiter struct {
+	mu      sync.Mutex
+	limits  map[string]int // uuid -> 最大 IP 数（0 = 不限制）
+	grace   time.Duration
+	kick    func(connID string) error
+	onEvent func(IPLimitEvent)
+
+	firstSeen   map[string]map[string]time.Time // uuid -> ip -> 首次出现时间（持续在线期间）
+	excessSince map[string]map[string]time.Time // uuid -> ip -> 开始超限的时间
+	kickedAt    map[string]map[string]time.Time // uuid -> ip -> 最近一次被断开的时间
+}
+
+// NewIPLimiter 创建并发 IP 限制器
+func NewIPLimiter(grace time.Duration, kick func(connID string) error, onEvent func(IPLimitEvent)) *IPLimiter {
+	return &IPLimiter{
+		limits:      make(map[string]int),
+		grace:       grace,
+		kick:        kick,
+		onEvent:     onEvent,
+		firstSeen:   make(map[string]map[string]time.Time),
+		excessSince: make(map[string]map[string]time.Time),
+		kickedAt:    make(map[string]map[string]time.Time),
+	}
+}
+
+// UpdateUsers 更新用户限制（从服务器同步或本地用户变更后调用）
+func (l *IPLimiter) UpdateUsers(users []config.User) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limits := make(map[string]int)
+	for _, u := range users {
+		if u.Enabled && u.MaxIPs > 0 {
+			limits[u.UUID] = u.MaxIPs
+		}
+	}
+	l.limits = limits
+
+	// 清理不再受限用户的状态
+	for uuid := range l.firstSeen {
+		if _, ok := limits[uuid]; !ok {
+			delete(l.firstSeen, uuid)
+			delete(l.excessSince, uuid)
+			delete(l.kickedAt, uuid)
+		}
+	}
+}
+
+// GetLimitedUserCount 获取设置了 IP 限制的用户数
+func (l *IPLimiter) GetLimitedUserCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limits)
+}
+
+// Scan 检查当前连接，断开超限用户最新 IP 上的连接（定时调用）
+func (l *IPLimiter) Scan(conns []ClientConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// 按用户、IP 分组
+	byUser := make(map[string]map[string][]string) // uuid -> ip -> conn IDs
+	for _, c := range conns {
+		if _, limited := l.limits[c.User]; !limited || c.IP == "" {
+			continue
+		}
+		if byUser[c.User] == nil {
+			byUser[c.User] = make(map[string][]string)
+		}
+		byUser[c.User][c.IP] = append(byUser[c.User][c.IP], c.ID)
+	}
+
+	// 没有连接的用户：重置状态
+	for uuid := range l.firstSeen {
+		if _, online := byUser[uuid]; !online {
+			delete(l.firstSeen, uuid)
+			delete(l.excessSince, uuid)
+			delete(l.kickedAt, uuid)
+		}
+	}
+
+	for uuid, ipConns := range byUser {
+		if event := l.checkUser(uuid, ipConns, now); event != nil && l.onEvent != nil {
+			go l.onEvent(*event)
+		}
+	}
+}
+
+// checkUser 检查单个用户（调用方需持有锁）
+func (l *IPLimiter) checkUser(uuid string, ipConns map[string][]string, now time.Time) *IPLimitEvent {
+	limit := l.limits[uuid]
+
+	seen := l.firstSeen[uuid]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		l.firstSeen[uuid] = seen
+	}
+	excess := l.excessSince[uuid]
+	if excess == nil {
+		excess = make(map[string]time.Time)
+		l.excessSince[uuid] = excess
+	}
+	kicked := l.kickedAt[uuid]
+	if kicked == nil {
+		kicked = make(map[string]time.Time)
+		l.kickedAt[uuid] = kicked
+	}
+	for ip, t := range kicked {
+		if now.Sub(t) >= rekickWindow {
+			delete(kicked, ip)
+		}
+	}
+
+	// 更新 IP 首次出现时间，移除已下线的 IP
+	for ip := range ipConns {
+		if _, ok := seen[ip]; !ok {
+			seen[ip] = now
+		}
+	}
+	for ip := range seen {
+		if _, online := ipConns[ip]; !online {
+			delete(seen, ip)
+		}
+	}
+
+	ips := make([]string, 0, len(ipConns))
+	for ip := range ipConns {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if !seen[ips[i]].Equal(seen[ips[j]]) {
+			return seen[ips[i]].Before(seen[ips[j]])
+		}
+		return ips[i] < ips[j]
+	})
+
+	// 最早的 limit 个 IP 保留，其余为多余
+	extra := make(map[string]bool)
+	if len(ips) > limit {
+		for _, ip := range ips[limit:] {
+			extra[ip] = true
+		}
+	}
+	for ip := range excess {
+		if !extra[ip] {
+			delete(excess, ip)
+		}
+	}
+
+	var event *IPLimitEvent
+	for _, ip := range ips[min(limit, len(ips)):] {
+		since, ok := excess[ip]
+		if !ok {
+			excess[ip] = now
+			since = now
+		}
+		if _, rekick := kicked[ip]; !rekick && now.Sub(since) < l.grace {
+			continue // 宽限期内（可能是网络切换）
+		}
+
+		if event == nil {
+			event = &IPLimitEvent{
+				UUID:  uuid,
+				Limit: limit,
+				IPs:   ips,
+				Time:  now,
+			}
+		}
+
+		for _, connID := range ipConns[ip] {
+			if err := l.kick(connID); err != nil {
+				log.Printf("[IPLimit] Failed to kick connection %s of user %s: %v", connID, uuid, err)
+				continue
+			}
+			event.Kicked++
+		}
+		event.KickedIPs = append(event.KickedIPs, ip)
+		kicked[ip] = now
+
+		delete(excess, ip)
+		delete(seen, ip)
+	}
+
+	return event
+}
@@ -0,0 +1,52 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"otun-node-agent/internal/config"
+)
+
+// TestIPLimiterKicksNewestIP 测试超限时只断开最新出现的 IP，且宽限期内不断开
+func TestIPLimiterKicksNewestIP(t *testing.T) {
+	var kicked []string
+	events := make(chan IPLimitEvent, 1)
+	l := NewIPLimiter(time.Hour, func(connID string) error {
+		kicked = append(kicked, connID)
+		return nil
+	}, func(e IPLimitEvent) { events <- e })
+	l.UpdateUsers([]config.User{{UUID: "u1", Enabled: true, MaxIPs: 1}})
+
+	l.Scan([]ClientConn{{ID: "a1", User: "u1", IP: "1.1.1.1"}})
+	conns := []ClientConn{
+		{ID: "a1", User: "u1", IP: "1.1.1.1"},
+		{ID: "b1", User: "u1", IP: "2.2.2.2"},
+		{ID: "b2", User: "u1", IP: "2.2.2.2"},
+	}
+
+	// 宽限期内
+	l.Scan(conns)
+	if len(kicked) != 0 {
+		t.Fatalf("Expected no kicks during grace window, got %v", kicked)
+	}
+
+	// 宽限期结束
+	l.grace = 0
+	l.Scan(conns)
+	if len(kicked) != 2 || kicked[0] != "b1" || kicked[1] != "b2" {
+		t.Fatalf("Expected connections of newest IP to be kicked, got %v", kicked)
+	}
+
+	e := <-events
+	if e.UUID != "u1" || e.Kicked != 2 || len(e.KickedIPs) != 1 || e.KickedIPs[0] != "2.2.2.2" {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+
+	// 被断开的 IP 重连后不再享有宽限期
+	l.grace = time.Hour
+	kicked = nil
+	l.Scan(conns)
+	if len(kicked) != 2 {
+		t.Errorf("Expected reconnecting IP to be kicked immediately, got %v", kicked)
+	}
+}
@@ -106,6 +106,16 @@ func (m *Monitor) CheckUser(uuid string, additionalTraffic int64) bool {
 	return true
 }
 
+// SetTrafficUsed 设置用户已用流量（本地模式下由本地存储提供权威值）
+func (m *Monitor) SetTrafficUsed(uuid string, used int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[uuid]; ok {
+		user.TrafficUsed = used
+	}
+}
+
 // GetSessionTraffic 获取用户会话流量
 func (m *Monitor) GetSessionTraffic(uuid string) int64 {
 	m.mu.RLock()
@@ -141,6 +151,17 @@ func (m *Monitor) ResetSessionTraffic() {
 	}
 }
 
+// SetSessionTraffic 将会话流量设为尚未送达管理端的流量（上报后调用）
+// 已送达的部分会在下次同步时计入 TrafficUsed；未送达的部分必须继续计入限额检查
+func (m *Monitor) SetSessionTraffic(pending map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for uuid, user := range m.users {
+		user.SessionTraffic = pending[uuid]
+	}
+}
+
 // CheckAllUsers 检查所有用户的过期和流量限额状态（定时调用）
 func (m *Monitor) CheckAllUsers() {
 	m.mu.Lock()
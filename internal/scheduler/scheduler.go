@@ -0,0 +1,217 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job 定时任务
+type Job struct {
+	Name     string
+	Interval time.Duration // 两次运行之间的间隔（从上次结束算起）
+	Jitter   time.Duration // 每次额外随机延迟 [0, Jitter)，避免多个节点同时请求管理端
+	Timeout  time.Duration // 单次运行超时，0 表示只受 Scheduler 生命周期约束
+	Run      func(ctx context.Context) error
+}
+
+// JobStats 任务运行统计
+type JobStats struct {
+	Name         string
+	Runs         uint64
+	Failures     uint64
+	Running      bool
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+}
+
+// jobState 每个任务一个 worker：同一任务不会并发运行，
+// 运行期间到期或被触发的请求合并为一次
+type jobState struct {
+	job     Job
+	trigger chan struct{}
+
+	mu    sync.Mutex
+	stats JobStats
+}
+
+// Scheduler 任务调度器
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobState
+	started bool
+	wg      sync.WaitGroup
+}
+
+// New 创建调度器
+func New() *Scheduler {
+	return &Scheduler{
+		jobs: make(map[string]*jobState),
+	}
+}
+
+// Add 注册任务（必须在 Start 之前调用）
+func (s *Scheduler) Add(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		panic(fmt.Sprintf("scheduler: job %s added after start", job.Name))
+	}
+	if _, exists := s.jobs[job.Name]; exists {
+		panic(fmt.Sprintf("scheduler: duplicate job %s", job.Name))
+	}
+	if job.Interval <= 0 {
+		panic(fmt.Sprintf("scheduler: job %s has no interval", job.Name))
+	}
+
+	s.jobs[job.Name] = &jobState{
+		job:     job,
+		trigger: make(chan struct{}, 1),
+		stats:   JobStats{Name: job.Name},
+	}
+}
+
+// Start 为每个任务启动 worker，ctx 取消时所有 worker 退出，运行中的任务会收到取消
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+
+	for _, js := range s.jobs {
+		s.wg.Add(1)
+		go func(js *jobState) {
+			defer s.wg.Done()
+			js.loop(ctx)
+		}(js)
+	}
+}
+
+// Wait 等待所有 worker 退出（在取消 Start 的 ctx 之后调用）
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Trigger 请求立即运行任务；任务正在运行时合并到运行结束后的下一次
+func (s *Scheduler) Trigger(name string) bool {
+	s.mu.Lock()
+	js, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case js.trigger <- struct{}{}:
+	default:
+		// 已有待处理的触发
+	}
+	return true
+}
+
+// Stats 返回所有任务的运行统计（按名称排序）
+func (s *Scheduler) Stats() []JobStats {
+	s.mu.Lock()
+	jobs := make([]*jobState, 0, len(s.jobs))
+	for _, js := range s.jobs {
+		jobs = append(jobs, js)
+	}
+	s.mu.Unlock()
+
+	result := make([]JobStats, 0, len(jobs))
+	for _, js := range jobs {
+		js.mu.Lock()
+		result = append(result, js.stats)
+		js.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// loop worker 主循环
+func (js *jobState) loop(ctx context.Context) {
+	timer := time.NewTimer(js.nextDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-js.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		js.run(ctx)
+
+		// ctx 已取消时不再调度
+		if ctx.Err() != nil {
+			return
+		}
+		timer.Reset(js.nextDelay())
+	}
+}
+
+// run 运行一次任务
+func (js *jobState) run(ctx context.Context) {
+	runCtx := ctx
+	if js.job.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, js.job.Timeout)
+		defer cancel()
+	}
+
+	js.mu.Lock()
+	js.stats.Running = true
+	js.mu.Unlock()
+
+	start := time.Now()
+	err := js.safeRun(runCtx)
+	duration := time.Since(start)
+
+	js.mu.Lock()
+	js.stats.Running = false
+	js.stats.Runs++
+	js.stats.LastRun = start
+	js.stats.LastDuration = duration
+	js.stats.LastError = ""
+	if err != nil {
+		js.stats.Failures++
+		js.stats.LastError = err.Error()
+	}
+	js.mu.Unlock()
+
+	if err != nil && ctx.Err() == nil {
+		log.Printf("[Scheduler] Job %s failed after %s: %v", js.job.Name, duration.Round(time.Millisecond), err)
+	}
+}
+
+// safeRun 运行任务并把 panic 转为错误，避免单个任务拖垮整个 Agent
+func (js *jobState) safeRun(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return js.job.Run(ctx)
+}
+
+// nextDelay 下次运行前的等待时间
+func (js *jobState) nextDelay() time.Duration {
+	delay := js.job.Interval
+	if js.job.Jitter > 0 {
+		delay += rand.N(js.job.Jitter)
+	}
+	return delay
+}
@@ -0,0 +1,88 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSchedulerNoOverlap 测试同一任务不会并发运行，触发会被合并
+func TestSchedulerNoOverlap(t *testing.T) {
+	var running, maxRunning, runs atomic.Int32
+	release := make(chan struct{})
+
+	s := New()
+	s.Add(Job{
+		Name:     "slow",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			n := running.Add(1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			defer running.Add(-1)
+			runs.Add(1)
+			<-release
+			return errors.New("boom")
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+
+	s.Trigger("slow")
+	time.Sleep(20 * time.Millisecond)
+	// 运行中的多次触发合并为一次
+	s.Trigger("slow")
+	s.Trigger("slow")
+	s.Trigger("slow")
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	s.Wait()
+
+	if maxRunning.Load() != 1 {
+		t.Errorf("Expected no overlapping runs, got %d concurrent", maxRunning.Load())
+	}
+	if runs.Load() != 2 {
+		t.Errorf("Expected 2 runs (initial + coalesced trigger), got %d", runs.Load())
+	}
+
+	stats := s.Stats()
+	if len(stats) != 1 || stats[0].Runs != 2 || stats[0].Failures != 2 || stats[0].LastError != "boom" {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestSchedulerCancelReachesRun 测试停止时运行中的任务收到取消
+func TestSchedulerCancelReachesRun(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	s := New()
+	s.Add(Job{
+		Name:     "blocking",
+		Interval: time.Millisecond,
+		Run: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	<-started
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Running job did not observe cancellation")
+	}
+	s.Wait()
+}
@@ -0,0 +1,140 @@
+package singbox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"otun-node-agent/internal/persist"
+)
+
+// ConfigStatus 最近一次配置应用的结果（用于日志、心跳和健康检查）
+type ConfigStatus struct {
+	LastApplyAt time.Time `json:"last_apply_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	RolledBack  bool      `json:"rolled_back"` // 是否已回滚到 last-good 配置
+}
+
+// stagingPath 暂存配置路径（config.json -> config.staging.json）
+func (m *Manager) stagingPath() string {
+	return strings.TrimSuffix(m.configPath, ".json") + ".staging.json"
+}
+
+// lastGoodPath 上一份可正常运行的配置路径（config.json -> config.last-good.json）
+func (m *Manager) lastGoodPath() string {
+	return strings.TrimSuffix(m.configPath, ".json") + ".last-good.json"
+}
+
+// ApplyConfig 校验并应用新配置
+// 流程：写入暂存文件 → sing-box check → 备份当前配置为 last-good → 原子替换 → 重载
+// 新配置导致 sing-box 无法恢复时，自动恢复 last-good 配置并重启
+func (m *Manager) ApplyConfig(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.applyConfigLocked(data)
+
+	m.status.LastApplyAt = time.Now()
+	if err != nil {
+		m.status.LastError = err.Error()
+		m.status.LastErrorAt = time.Now()
+		log.Printf("Config apply failed: %v", err)
+	} else {
+		m.status.LastError = ""
+		m.status.RolledBack = false
+	}
+	return err
+}
+
+// applyConfigLocked 内部实现（调用方需持有锁）
+func (m *Manager) applyConfigLocked(data []byte) error {
+	staging := m.stagingPath()
+	if err := persist.WriteFile(staging, data, 0644); err != nil {
+		return fmt.Errorf("write staging config: %w", err)
+	}
+
+	if err := m.checkConfigFile(staging); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("validate config: %w", err)
+	}
+
+	// 当前配置正在运行，说明它是可用的，保留为 last-good
+	if m.running {
+		if err := copyFile(m.configPath, m.lastGoodPath()); err != nil {
+			log.Printf("Failed to save last-good config: %v", err)
+		}
+	}
+
+	if err := persist.Rename(staging, m.configPath); err != nil {
+		return fmt.Errorf("install config: %w", err)
+	}
+
+	if !m.running {
+		return nil
+	}
+
+	reloadErr := m.reloadLocked()
+	if reloadErr == nil {
+		return nil
+	}
+
+	// 新配置无法启动，回滚
+	if rollbackErr := m.rollbackLocked(); rollbackErr != nil {
+		return fmt.Errorf("new config failed (%v), rollback failed: %w", reloadErr, rollbackErr)
+	}
+	return fmt.Errorf("new config failed to start, rolled back to last-good: %w", reloadErr)
+}
+
+// rollbackLocked 恢复 last-good 配置并重启（调用方需持有锁）
+func (m *Manager) rollbackLocked() error {
+	lastGood := m.lastGoodPath()
+	if _, err := os.Stat(lastGood); err != nil {
+		return fmt.Errorf("no last-good config: %w", err)
+	}
+
+	log.Printf("Restoring last-good config from %s", lastGood)
+	if err := copyFile(lastGood, m.configPath); err != nil {
+		return fmt.Errorf("restore last-good config: %w", err)
+	}
+
+	m.status.RolledBack = true
+	if err := m.restartLocked(); err != nil {
+		return fmt.Errorf("restart with last-good config: %w", err)
+	}
+	return nil
+}
+
+// checkConfigFile 使用 sing-box check 校验配置文件
+func (m *Manager) checkConfigFile(path string) error {
+	if _, err := os.Stat(m.binPath); os.IsNotExist(err) {
+		log.Printf("sing-box binary not found, skipping config check: %s", m.binPath)
+		return nil
+	}
+
+	cmd := exec.Command(m.binPath, "check", "-c", path)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("config check failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// GetConfigStatus 获取最近一次配置应用结果
+func (m *Manager) GetConfigStatus() ConfigStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// copyFile 复制文件内容
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return persist.WriteFile(dst, data, 0644)
+}
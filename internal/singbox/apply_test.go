@@ -0,0 +1,211 @@
+package singbox
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSingboxEnv 设置时测试二进制扮演 sing-box：
+//   - check：配置包含 "invalid" 时失败
+//   - run：监听 API 端口；配置包含 "crash" 时退出（启动时或 SIGHUP 重载后）；
+//     SIGHUP 时配置包含 "nohup" 则忽略信号，继续使用旧实例
+const fakeSingboxEnv = "FAKE_SINGBOX_API"
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(fakeSingboxEnv); addr != "" {
+		runFakeSingbox(addr, os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runFakeSingbox(addr string, args []string) {
+	if len(args) != 3 || args[1] != "-c" {
+		os.Exit(2)
+	}
+	readConfig := func() string {
+		data, err := os.ReadFile(args[2])
+		if err != nil {
+			os.Exit(1)
+		}
+		return string(data)
+	}
+
+	switch args[0] {
+	case "check":
+		if strings.Contains(readConfig(), "invalid") {
+			os.Stderr.WriteString("invalid config\n")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "run":
+	default:
+		os.Exit(2)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	for {
+		if strings.Contains(readConfig(), "crash") {
+			os.Exit(1)
+		}
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			os.Exit(1)
+		}
+		for {
+			if <-signals == syscall.SIGTERM {
+				os.Exit(0)
+			}
+			if !strings.Contains(readConfig(), "nohup") {
+				break
+			}
+		}
+		// 关闭旧实例后再启动新实例，API 端口短暂不可用
+		lis.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// newFakeManager 使用测试二进制作为 sing-box，API 端口为随机空闲端口
+func newFakeManager(t *testing.T) *Manager {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	prev := apiPort
+	apiPort = addr
+	t.Cleanup(func() { apiPort = prev })
+	t.Setenv(fakeSingboxEnv, addr)
+
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(bin, filepath.Join(t.TempDir(), "config.json"))
+	t.Cleanup(func() { m.Stop() })
+	return m
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestApplyConfigCheckFailure(t *testing.T) {
+	m := newFakeManager(t)
+	if err := m.ApplyConfig([]byte(`{"v":"good"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.ApplyConfig([]byte(`{"v":"invalid"}`))
+	if err == nil || !strings.Contains(err.Error(), "invalid config") {
+		t.Fatalf("err = %v, want check failure with sing-box output", err)
+	}
+	if got := readFile(t, m.configPath); got != `{"v":"good"}` {
+		t.Fatalf("config = %s, rejected config must not be installed", got)
+	}
+	if _, err := os.Stat(m.stagingPath()); !os.IsNotExist(err) {
+		t.Fatal("staging config should be removed after a failed check")
+	}
+
+	status := m.GetConfigStatus()
+	if status.LastError == "" || status.LastErrorAt.IsZero() || status.RolledBack {
+		t.Fatalf("status = %+v, want error without rollback", status)
+	}
+}
+
+func TestApplyConfigRollsBackWhenReloadFails(t *testing.T) {
+	m := newFakeManager(t)
+	var preStops int
+	m.SetPreStopHook(func() { preStops++ })
+
+	if err := m.ApplyConfig([]byte(`{"v":"good"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 通过校验但无法运行：热重载和重启都失败，恢复 last-good 并重启
+	err := m.ApplyConfig([]byte(`{"v":"crash"}`))
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("err = %v, want rollback", err)
+	}
+	if got := readFile(t, m.configPath); got != `{"v":"good"}` {
+		t.Fatalf("config = %s, want last-good restored", got)
+	}
+	if got := readFile(t, m.lastGoodPath()); got != `{"v":"good"}` {
+		t.Fatalf("last-good = %s", got)
+	}
+	if !m.IsRunning() {
+		t.Fatal("sing-box should be running with the last-good config")
+	}
+	status := m.GetConfigStatus()
+	if !status.RolledBack || status.LastError == "" {
+		t.Fatalf("status = %+v, want rolled back with error", status)
+	}
+	if preStops == 0 {
+		t.Fatal("pre-stop hook should run before reloading")
+	}
+
+	// 之后的成功应用清除错误和回滚标记
+	if err := m.ApplyConfig([]byte(`{"v":"better"}`)); err != nil {
+		t.Fatal(err)
+	}
+	status = m.GetConfigStatus()
+	if status.RolledBack || status.LastError != "" || status.LastApplyAt.IsZero() {
+		t.Fatalf("status = %+v, want clean status after successful apply", status)
+	}
+	if got := readFile(t, m.lastGoodPath()); got != `{"v":"good"}` {
+		t.Fatalf("last-good = %s, want the config that was running before", got)
+	}
+}
+
+func TestReloadFallsBackToRestartWhenNotConfirmed(t *testing.T) {
+	m := newFakeManager(t)
+	if err := m.ApplyConfig([]byte(`{"v":"good"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := m.cmd.Process.Pid
+
+	prev := reloadDownTimeout
+	reloadDownTimeout = time.Second
+	t.Cleanup(func() { reloadDownTimeout = prev })
+
+	// 正常的热重载：进程不变
+	if err := m.ApplyConfig([]byte(`{"v":"better"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if m.cmd.Process.Pid != pid {
+		t.Fatal("in-place reload should keep the process")
+	}
+
+	// 旧实例一直监听 API 端口：不能当作重载成功，应完整重启
+	if err := m.ApplyConfig([]byte(`{"v":"nohup"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if m.cmd.Process.Pid == pid {
+		t.Fatal("unconfirmed reload should fall back to a restart")
+	}
+	if !m.IsRunning() {
+		t.Fatal("sing-box should be running after the restart")
+	}
+}
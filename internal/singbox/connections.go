@@ -3,8 +3,12 @@ package singbox
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
+
+	"otun-node-agent/internal/config"
 )
 
 // ConnectionManager 管理 sing-box 连接
@@ -30,12 +34,21 @@ type ActiveConnection struct {
 		User        string `json:"user"`
 		Source      string `json:"source"`
 		Destination string `json:"destination"`
+		Type        string `json:"type"` // inbound 类型/标签，如 "vless/vless-in"
 	} `json:"metadata"`
 	Upload   int64  `json:"upload"`
 	Download int64  `json:"download"`
 	Start    string `json:"start"`
 }
 
+// InboundTag 连接所属的 inbound 标签
+func (c *ActiveConnection) InboundTag() string {
+	if i := strings.Index(c.Metadata.Type, "/"); i >= 0 {
+		return c.Metadata.Type[i+1:]
+	}
+	return c.Metadata.Type
+}
+
 // ConnectionsResponse sing-box connections API 响应
 type ConnectionsResponse struct {
 	Connections []ActiveConnection `json:"connections"`
@@ -60,9 +73,22 @@ func (m *ConnectionManager) GetActiveConnections() ([]ActiveConnection, error) {
 		return nil, fmt.Errorf("decode connections: %w", err)
 	}
 
+	// 按协议统计时用户名为 uuid@protocol，调用方统一使用 UUID
+	for i := range result.Connections {
+		result.Connections[i].Metadata.User, _ = config.ParseStatsUserName(result.Connections[i].Metadata.User)
+	}
+
 	return result.Connections, nil
 }
 
+// SourceIP 返回客户端 IP（去掉端口）
+func (c *ActiveConnection) SourceIP() string {
+	if host, _, err := net.SplitHostPort(c.Metadata.Source); err == nil {
+		return host
+	}
+	return c.Metadata.Source
+}
+
 // KickConnection 断开指定连接
 func (m *ConnectionManager) KickConnection(connID string) error {
 	url := fmt.Sprintf("http://%s/connections/%s", m.apiAddr, connID)
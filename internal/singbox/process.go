@@ -11,25 +11,34 @@ import (
 	"time"
 )
 
+// sing-box V2Ray API 端口（测试时替换）
+var apiPort = "127.0.0.1:10085"
+
 const (
-	// sing-box V2Ray API 端口
-	apiPort = "127.0.0.1:10085"
 	// 最大重启尝试次数
 	maxRestartAttempts = 5
 	// 端口检查最大等待时间
 	maxPortWaitTime = 30 * time.Second
+	// SIGHUP 热重载后等待 API 端口恢复的最大时间
+	reloadReadyTimeout = 10 * time.Second
 )
 
+// SIGHUP 后等待旧实例关闭 API 端口的最大时间，超时视为没有重载（测试时替换）
+var reloadDownTimeout = 5 * time.Second
+
 // Manager 管理 sing-box 进程
 type Manager struct {
-	binPath        string
-	configPath     string
-	cmd            *exec.Cmd
-	mu             sync.Mutex
-	running        bool
-	restartCount   int       // 连续重启计数
-	lastRestartAt  time.Time // 上次重启时间
-	stopRequested  bool      // 是否正在停止（避免 monitor 重启）
+	binPath       string
+	configPath    string
+	cmd           *exec.Cmd
+	exited        chan struct{} // 当前进程退出时关闭
+	mu            sync.Mutex
+	running       bool
+	restartCount  int          // 连续重启计数
+	lastRestartAt time.Time    // 上次重启时间
+	stopRequested bool         // 是否正在停止（避免 monitor 重启）
+	status        ConfigStatus // 最近一次配置应用结果
+	preStop       func()       // 停止或重载前调用（此时 API 仍可用），用于保存流量计数
 }
 
 // NewManager 创建进程管理器
@@ -40,12 +49,42 @@ func NewManager(binPath, configPath string) *Manager {
 	}
 }
 
+// SetPreStopHook 设置停止/重载前的钩子：停止和重载都会清空 sing-box 的流量计数
+// 钩子在持有 Manager 锁时同步调用，不能再调用 Manager 的方法
+func (m *Manager) SetPreStopHook(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.preStop = fn
+}
+
+// runPreStopLocked 调用停止前钩子（调用方需持有锁）
+func (m *Manager) runPreStopLocked() {
+	if m.preStop != nil {
+		m.preStop()
+	}
+}
+
 // Start 启动 sing-box 进程
+// 如果进程未能正常提供 API 且存在 last-good 配置，则恢复 last-good 后重试
 func (m *Manager) Start() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	return m.startLocked()
+	if err := m.startLocked(); err != nil {
+		return err
+	}
+
+	if err := waitForAPIReady(m.exited, maxPortWaitTime); err != nil {
+		log.Printf("sing-box failed to come up: %v", err)
+		m.status.LastError = fmt.Sprintf("sing-box failed to come up: %v", err)
+		m.status.LastErrorAt = time.Now()
+		if rollbackErr := m.rollbackLocked(); rollbackErr != nil {
+			return fmt.Errorf("sing-box failed to come up (%v), rollback failed: %w", err, rollbackErr)
+		}
+		log.Println("sing-box started with last-good config")
+	}
+
+	return nil
 }
 
 // startLocked 内部启动函数（调用方需持有锁）
@@ -79,10 +118,11 @@ func (m *Manager) startLocked() error {
 
 	m.running = true
 	m.stopRequested = false
+	m.exited = make(chan struct{})
 	log.Printf("sing-box started with PID %d", m.cmd.Process.Pid)
 
 	// 监控进程退出
-	go m.monitor()
+	go m.monitor(m.cmd, m.exited)
 
 	return nil
 }
@@ -126,6 +166,8 @@ func (m *Manager) stopLocked() error {
 		return nil
 	}
 
+	m.runPreStopLocked()
+
 	m.stopRequested = true
 	log.Println("Stopping sing-box...")
 
@@ -135,11 +177,8 @@ func (m *Manager) stopLocked() error {
 		m.cmd.Process.Kill()
 	}
 
-	// 等待进程退出
-	done := make(chan error, 1)
-	go func() {
-		done <- m.cmd.Wait()
-	}()
+	// 等待进程退出（monitor 负责 Wait，退出时关闭 exited）
+	done := m.exited
 
 	select {
 	case <-done:
@@ -164,7 +203,9 @@ func (m *Manager) stopLocked() error {
 	return nil
 }
 
-// Reload 重载配置（重启 sing-box 进程）
+// Reload 重载配置
+// 优先发送 SIGHUP 让 sing-box 原地重载（进程不退出），
+// 只有热重载失败时才回退到完整重启
 func (m *Manager) Reload() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -173,7 +214,53 @@ func (m *Manager) Reload() error {
 		return fmt.Errorf("sing-box is not running")
 	}
 
-	log.Println("Reloading sing-box config...")
+	return m.reloadLocked()
+}
+
+// reloadLocked 先尝试热重载，失败时完整重启（调用方需持有锁）
+func (m *Manager) reloadLocked() error {
+	log.Println("Reloading sing-box config (SIGHUP)...")
+
+	if err := m.reloadInPlaceLocked(); err != nil {
+		log.Printf("In-place reload failed: %v, falling back to restart", err)
+		return m.restartLocked()
+	}
+
+	log.Println("sing-box reloaded in place")
+	return nil
+}
+
+// reloadInPlaceLocked 通过 SIGHUP 热重载，并确认 API 端口恢复（调用方需持有锁）
+func (m *Manager) reloadInPlaceLocked() error {
+	if m.cmd == nil || m.cmd.Process == nil {
+		return fmt.Errorf("no running process")
+	}
+
+	m.runPreStopLocked()
+
+	exited := m.exited
+	if err := m.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("send SIGHUP: %w", err)
+	}
+
+	// sing-box 收到 SIGHUP 后会关闭旧实例再用新配置启动，API 端口会短暂不可用；
+	// 必须先看到端口关闭，否则端口可用只能说明旧实例还在运行
+	if err := waitForAPIDown(exited, reloadDownTimeout); err != nil {
+		return fmt.Errorf("reload not confirmed: %w", err)
+	}
+
+	if err := waitForAPIReady(exited, reloadReadyTimeout); err != nil {
+		return err
+	}
+
+	// 主动 reload 成功，重置崩溃计数
+	m.restartCount = 0
+	return nil
+}
+
+// restartLocked 完整重启 sing-box 进程（调用方需持有锁）
+func (m *Manager) restartLocked() error {
+	log.Println("Restarting sing-box...")
 
 	// 先停止旧进程
 	if err := m.stopLocked(); err != nil {
@@ -188,9 +275,67 @@ func (m *Manager) Reload() error {
 		return fmt.Errorf("start sing-box after reload: %w", err)
 	}
 
+	// 确认新进程正常提供 API
+	if err := waitForAPIReady(m.exited, maxPortWaitTime); err != nil {
+		return fmt.Errorf("sing-box not healthy after restart: %w", err)
+	}
+
 	return nil
 }
 
+// waitForAPIReady 等待 API 端口可以连接；进程退出或超时则返回错误
+func waitForAPIReady(exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("sing-box process exited")
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", apiPort, 200*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for API port %s", apiPort)
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("sing-box process exited")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// waitForAPIDown 等待 API 端口停止接受连接；进程退出或超时则返回错误
+func waitForAPIDown(exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		conn, err := net.DialTimeout("tcp", apiPort, 200*time.Millisecond)
+		if err != nil {
+			return nil
+		}
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("API port %s stayed up, old instance still running", apiPort)
+		}
+
+		// 新旧实例之间的间隔很短，轮询间隔要足够小
+		select {
+		case <-exited:
+			return fmt.Errorf("sing-box process exited")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
 // IsRunning 检查是否运行中
 func (m *Manager) IsRunning() bool {
 	m.mu.Lock()
@@ -199,14 +344,10 @@ func (m *Manager) IsRunning() bool {
 }
 
 // monitor 监控进程状态，崩溃时自动重启（带指数退避）
-func (m *Manager) monitor() {
-	if m.cmd == nil {
-		return
-	}
-
-	// 保存当前 cmd 的引用，避免竞态
-	cmd := m.cmd
+// cmd 和 exited 由启动方传入，避免竞态
+func (m *Manager) monitor(cmd *exec.Cmd, exited chan struct{}) {
 	err := cmd.Wait()
+	close(exited)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -275,14 +416,9 @@ func (m *Manager) monitor() {
 	}
 }
 
-// CheckConfig 验证配置文件
+// CheckConfig 验证当前配置文件
 func (m *Manager) CheckConfig() error {
-	cmd := exec.Command(m.binPath, "check", "-c", m.configPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("config check failed: %s", string(output))
-	}
-	return nil
+	return m.checkConfigFile(m.configPath)
 }
 
 // GetRestartCount 获取当前重启计数（用于监控）
@@ -4,81 +4,257 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials/insecure"
 
 	statsService "github.com/v2fly/v2ray-core/v5/app/stats/command"
+
+	"otun-node-agent/internal/config"
 )
 
+// queryTimeout 单次收集的超时（包括等待连接恢复）
+const queryTimeout = 5 * time.Second
+
 // Collector 从 sing-box V2Ray API (gRPC) 收集流量统计
+// gRPC 连接长期保持，sing-box 重启后自动重连
 type Collector struct {
 	apiAddr string
+
+	connMu sync.Mutex
+	conn   *grpc.ClientConn
+
+	mu sync.Mutex
+	// 计数按 V2Ray stats 名称保存，例如 user>>>uuid>>>traffic>>>uplink
+	// 已经记录、但还没有在 sing-box 中清零的计数（清零查询失败时保留，避免下次重复记录）
+	baseline map[string]int64
+	// 已经在 sing-box 中清零、但记录失败的计数，下次一并记录
+	carry map[string]int64
+}
+
+// Traffic 上下行流量
+type Traffic struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
 }
 
 // UserStats 用户流量统计
 type UserStats struct {
 	Upload   int64
 	Download int64
+	// Protocols 按协议拆分的流量（需开启按协议统计，否则为空）
+	Protocols map[string]Traffic
 }
 
+// Usage 一次收集的流量增量
+type Usage struct {
+	Users     map[string]*UserStats // UUID -> 流量（各协议汇总）
+	Inbounds  map[string]Traffic    // inbound 标签 -> 流量
+	Outbounds map[string]Traffic    // outbound 标签 -> 流量
+}
+
+// RecordFunc 持久化一批用户流量增量，返回 nil 表示已落盘
+type RecordFunc func(map[string]*UserStats) error
+
 // NewCollector 创建统计收集器
 func NewCollector(apiAddr string) *Collector {
 	return &Collector{
-		apiAddr: apiAddr,
+		apiAddr:  apiAddr,
+		baseline: make(map[string]int64),
+		carry:    make(map[string]int64),
+	}
+}
+
+// client 返回 stats 客户端，首次调用时创建连接
+// grpc.NewClient 不阻塞，连接断开后在后台按退避重连
+func (c *Collector) client() (statsService.StatsServiceClient, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.conn == nil {
+		conn, err := grpc.NewClient(c.apiAddr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			// sing-box 重载/重启只需几秒，缩短重连退避（默认最长 120 秒）
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff: backoff.Config{
+					BaseDelay:  500 * time.Millisecond,
+					Multiplier: 1.6,
+					Jitter:     0.2,
+					MaxDelay:   5 * time.Second,
+				},
+				MinConnectTimeout: 2 * time.Second,
+			}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("create grpc client: %w", err)
+		}
+		c.conn = conn
 	}
+	return statsService.NewStatsServiceClient(c.conn), nil
 }
 
-// Collect 收集所有用户的流量统计
-// 通过 gRPC 访问 V2Ray Stats API
-func (c *Collector) Collect() (map[string]*UserStats, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// Close 关闭 gRPC 连接
+func (c *Collector) Close() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// CollectDurable 收集流量并把用户流量交给 record 持久化，保证 sing-box 中的计数只在落盘后清零：
+//  1. 不清零读取快照，把相对 baseline 的增量交给 record
+//  2. record 成功后清零读取，把两次读取之间新增的部分再交给 record
+//
+// record 失败时计数保留在 sing-box 中（或 carry 中）等下次收集，不会丢失也不会重复
+// 返回本次记录的全部增量（包括 inbound / outbound 流量）
+func (c *Collector) CollectDurable(ctx context.Context, record RecordFunc) (*Usage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
 	defer cancel()
 
-	conn, err := grpc.DialContext(ctx, c.apiAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-	)
+	client, err := c.client()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. 快照
+	snapshot, err := queryCounters(ctx, client, false)
 	if err != nil {
-		return nil, fmt.Errorf("connect to grpc: %w", err)
+		return nil, err
 	}
-	defer conn.Close()
+	first := subtractCounters(snapshot, c.baseline)
+	addCounters(first, c.carry)
+	if users := buildUsage(first).Users; len(users) > 0 {
+		if err := record(users); err != nil {
+			return nil, fmt.Errorf("record stats: %w", err)
+		}
+	}
+	c.carry = make(map[string]int64)
+	c.baseline = snapshot
 
-	client := statsService.NewStatsServiceClient(conn)
+	// 2. 清零
+	final, err := queryCounters(ctx, client, true)
+	if err != nil {
+		// 不确定是否已清零：保留 baseline，下次只记录超出部分
+		return buildUsage(first), fmt.Errorf("reset stats: %w", err)
+	}
+	second := subtractCounters(final, c.baseline)
+	c.baseline = make(map[string]int64)
+	if users := buildUsage(second).Users; len(users) > 0 {
+		if err := record(users); err != nil {
+			c.carry = second
+			return buildUsage(first), fmt.Errorf("record stats: %w", err)
+		}
+	}
 
-	// 查询用户统计数据
+	addCounters(first, second)
+	return buildUsage(first), nil
+}
+
+// queryCounters 查询所有流量计数（user / inbound / outbound），按 stats 名称返回
+func queryCounters(ctx context.Context, client statsService.StatsServiceClient, reset bool) (map[string]int64, error) {
 	resp, err := client.QueryStats(ctx, &statsService.QueryStatsRequest{
-		Pattern: "user>>>",
-		Reset_:  true, // 重置统计，避免重复计算
-	})
+		Reset_: reset,
+	}, grpc.WaitForReady(true)) // 连接正在恢复时等待，而不是立即失败
 	if err != nil {
 		return nil, fmt.Errorf("query stats: %w", err)
 	}
 
-	// 解析统计数据
-	// V2Ray stats 格式: user>>>uuid>>>traffic>>>uplink 或 user>>>uuid>>>traffic>>>downlink
-	stats := make(map[string]*UserStats)
-
+	counters := make(map[string]int64, len(resp.Stat))
 	for _, stat := range resp.Stat {
-		parts := strings.Split(stat.Name, ">>>")
-		if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+		counters[stat.Name] = stat.Value
+	}
+	return counters, nil
+}
+
+// buildUsage 解析计数名称并汇总
+// V2Ray stats 格式: <user|inbound|outbound>>>><name>>>>traffic>>><uplink|downlink>
+// 按协议统计时用户名为 uuid@protocol
+func buildUsage(counters map[string]int64) *Usage {
+	usage := &Usage{
+		Users:     make(map[string]*UserStats),
+		Inbounds:  make(map[string]Traffic),
+		Outbounds: make(map[string]Traffic),
+	}
+
+	for name, value := range counters {
+		parts := strings.Split(name, ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" || value <= 0 {
+			continue
+		}
+		var up, down int64
+		switch parts[3] {
+		case "uplink":
+			up = value
+		case "downlink":
+			down = value
+		default:
 			continue
 		}
 
-		uuid := parts[1]
-		direction := parts[3]
-
-		if _, ok := stats[uuid]; !ok {
-			stats[uuid] = &UserStats{}
+		switch parts[0] {
+		case "user":
+			uuid, protocol := config.ParseStatsUserName(parts[1])
+			s, ok := usage.Users[uuid]
+			if !ok {
+				s = &UserStats{}
+				usage.Users[uuid] = s
+			}
+			s.Upload += up
+			s.Download += down
+			if protocol != "" {
+				if s.Protocols == nil {
+					s.Protocols = make(map[string]Traffic)
+				}
+				t := s.Protocols[protocol]
+				t.Upload += up
+				t.Download += down
+				s.Protocols[protocol] = t
+			}
+		case "inbound":
+			t := usage.Inbounds[parts[1]]
+			t.Upload += up
+			t.Download += down
+			usage.Inbounds[parts[1]] = t
+		case "outbound":
+			t := usage.Outbounds[parts[1]]
+			t.Upload += up
+			t.Download += down
+			usage.Outbounds[parts[1]] = t
 		}
+	}
+	return usage
+}
 
-		if direction == "uplink" {
-			stats[uuid].Upload = stat.Value
-		} else if direction == "downlink" {
-			stats[uuid].Download = stat.Value
+// subtractCounters 计算 current 相对 base 的增量，只返回有增量的计数
+// 计数小于 base 说明 sing-box 已重启、计数从零开始，此时整个当前值都是增量
+func subtractCounters(current, base map[string]int64) map[string]int64 {
+	delta := make(map[string]int64)
+	for name, cur := range current {
+		b := base[name]
+		if cur < b {
+			b = 0
+		}
+		if d := cur - b; d > 0 {
+			delta[name] = d
 		}
 	}
+	return delta
+}
 
-	return stats, nil
+// addCounters 将 extra 累加到 dst
+func addCounters(dst, extra map[string]int64) {
+	for name, v := range extra {
+		dst[name] += v
+	}
 }
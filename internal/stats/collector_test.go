@@ -0,0 +1,185 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	statsService "github.com/v2fly/v2ray-core/v5/app/stats/command"
+)
+
+// fakeStatsServer 模拟 sing-box 的 V2Ray Stats API
+type fakeStatsServer struct {
+	statsService.UnimplementedStatsServiceServer
+
+	mu       sync.Mutex
+	counters map[string]int64
+	onQuery  func(reset bool) // 查询前调用，用于模拟两次查询之间产生的流量
+}
+
+func (s *fakeStatsServer) add(uuid string, up, down int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters["user>>>"+uuid+">>>traffic>>>uplink"] += up
+	s.counters["user>>>"+uuid+">>>traffic>>>downlink"] += down
+}
+
+func (s *fakeStatsServer) QueryStats(_ context.Context, req *statsService.QueryStatsRequest) (*statsService.QueryStatsResponse, error) {
+	if s.onQuery != nil {
+		s.onQuery(req.Reset_)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &statsService.QueryStatsResponse{}
+	for name, value := range s.counters {
+		if strings.HasPrefix(name, req.Pattern) {
+			resp.Stat = append(resp.Stat, &statsService.Stat{Name: name, Value: value})
+			if req.Reset_ {
+				s.counters[name] = 0
+			}
+		}
+	}
+	return resp, nil
+}
+
+func startFakeStats(t *testing.T) (*fakeStatsServer, *Collector) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeStatsServer{counters: make(map[string]int64)}
+	srv := grpc.NewServer()
+	statsService.RegisterStatsServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return fake, NewCollector(lis.Addr().String())
+}
+
+// recorder 累计所有记录成功的流量
+type recorder struct {
+	total map[string]Traffic
+	fail  bool
+}
+
+func (r *recorder) record(delta map[string]*UserStats) error {
+	if r.fail {
+		return errors.New("disk full")
+	}
+	for uuid, d := range delta {
+		t := r.total[uuid]
+		t.Upload += d.Upload
+		t.Download += d.Download
+		r.total[uuid] = t
+	}
+	return nil
+}
+
+func TestCollectDurableKeepsCountersUntilRecorded(t *testing.T) {
+	fake, c := startFakeStats(t)
+	rec := &recorder{total: make(map[string]Traffic)}
+	ctx := context.Background()
+
+	fake.add("a", 100, 200)
+	rec.fail = true
+	if _, err := c.CollectDurable(ctx, rec.record); err == nil {
+		t.Fatal("expected record error")
+	}
+	if fake.counters["user>>>a>>>traffic>>>uplink"] != 100 {
+		t.Fatal("counters must not be reset when record fails")
+	}
+
+	// 两次查询之间产生的流量也要记录
+	rec.fail = false
+	fake.onQuery = func(reset bool) {
+		if reset {
+			fake.add("a", 1, 2)
+		}
+	}
+	got, err := c.CollectDurable(ctx, rec.record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.onQuery = nil
+	want := Traffic{Upload: 101, Download: 202}
+	if a := got.Users["a"]; rec.total["a"] != want || a.Upload != want.Upload || a.Download != want.Download {
+		t.Fatalf("recorded %+v, returned %+v, want %+v", rec.total["a"], a, want)
+	}
+
+	// 没有新流量时不会重复记录
+	if _, err := c.CollectDurable(ctx, rec.record); err != nil {
+		t.Fatal(err)
+	}
+	if rec.total["a"].Upload != 101 {
+		t.Fatalf("traffic recorded twice: %+v", rec.total["a"])
+	}
+}
+
+func TestCollectDurableCarriesResetTraffic(t *testing.T) {
+	fake, c := startFakeStats(t)
+	rec := &recorder{total: make(map[string]Traffic)}
+	ctx := context.Background()
+
+	// 清零后的第二次记录失败：这部分流量已不在 sing-box 中，必须由 carry 保留
+	fake.add("a", 10, 0)
+	fake.onQuery = func(reset bool) {
+		if reset {
+			fake.add("a", 5, 0)
+			rec.fail = true
+		}
+	}
+	if _, err := c.CollectDurable(ctx, rec.record); err == nil {
+		t.Fatal("expected record error")
+	}
+	fake.onQuery = nil
+	rec.fail = false
+
+	fake.add("a", 1, 0)
+	if _, err := c.CollectDurable(ctx, rec.record); err != nil {
+		t.Fatal(err)
+	}
+	if rec.total["a"].Upload != 16 {
+		t.Fatalf("recorded upload = %d, want 16", rec.total["a"].Upload)
+	}
+}
+
+func TestSubtractCountersAfterRestart(t *testing.T) {
+	base := map[string]int64{"user>>>a>>>traffic>>>uplink": 100, "user>>>b>>>traffic>>>uplink": 5}
+	current := map[string]int64{"user>>>a>>>traffic>>>uplink": 30, "user>>>b>>>traffic>>>uplink": 5}
+
+	delta := subtractCounters(current, base)
+	if len(delta) != 1 || delta["user>>>a>>>traffic>>>uplink"] != 30 {
+		t.Fatalf("delta = %v, want a counted from zero and b omitted", delta)
+	}
+}
+
+func TestBuildUsageByProtocol(t *testing.T) {
+	usage := buildUsage(map[string]int64{
+		"user>>>a@vless>>>traffic>>>uplink":      10,
+		"user>>>a@vless>>>traffic>>>downlink":    20,
+		"user>>>a@trojan>>>traffic>>>uplink":     1,
+		"user>>>b>>>traffic>>>downlink":          7,
+		"inbound>>>vless-in>>>traffic>>>uplink":  10,
+		"outbound>>>direct>>>traffic>>>downlink": 27,
+	})
+
+	a := usage.Users["a"]
+	if a == nil || a.Upload != 11 || a.Download != 20 {
+		t.Fatalf("user a = %+v, want protocols summed", a)
+	}
+	if a.Protocols["vless"] != (Traffic{Upload: 10, Download: 20}) || a.Protocols["trojan"] != (Traffic{Upload: 1}) {
+		t.Fatalf("user a protocols = %+v", a.Protocols)
+	}
+	if b := usage.Users["b"]; b == nil || b.Download != 7 || b.Protocols != nil {
+		t.Fatalf("user b = %+v, want no protocol breakdown", b)
+	}
+	if usage.Inbounds["vless-in"].Upload != 10 || usage.Outbounds["direct"].Download != 27 {
+		t.Fatalf("inbounds = %+v, outbounds = %+v", usage.Inbounds, usage.Outbounds)
+	}
+}
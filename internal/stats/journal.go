@@ -0,0 +1,536 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"otun-node-agent/internal/persist"
+)
+
+// FullPolicy 统计日志写满时的处理策略
+type FullPolicy string
+
+const (
+	// PolicyCoalesce 把所有未发送过的报告合并为一条（保留流量总量，丢失时间分布），仍然放不下时丢弃最旧的
+	PolicyCoalesce FullPolicy = "coalesce"
+	// PolicyDropOldest 丢弃最旧的报告
+	PolicyDropOldest FullPolicy = "drop_oldest"
+	// PolicyDropNewest 拒绝新报告，保留已有的
+	PolicyDropNewest FullPolicy = "drop_newest"
+)
+
+// 默认参数
+const (
+	DefaultJournalMaxSize = 16 << 20
+	DefaultJournalBucket  = time.Hour
+)
+
+// journalFile 日志文件名
+const journalFile = "journal.log"
+
+// ErrJournalFull 日志已满且策略为拒绝新报告
+var ErrJournalFull = errors.New("stats journal full")
+
+// ParseFullPolicy 解析写满策略，空字符串为默认的 coalesce
+func ParseFullPolicy(s string) (FullPolicy, error) {
+	switch FullPolicy(s) {
+	case "":
+		return PolicyCoalesce, nil
+	case PolicyCoalesce, PolicyDropOldest, PolicyDropNewest:
+		return FullPolicy(s), nil
+	}
+	return "", fmt.Errorf("unknown stats journal policy: %s", s)
+}
+
+// JournalOptions 日志参数，零值字段使用默认值
+type JournalOptions struct {
+	MaxSize int64         // 文件大小上限
+	Bucket  time.Duration // 压缩时按该时间粒度合并未发送的报告
+	Policy  FullPolicy
+}
+
+// journal 记录类型
+const (
+	opAdd     = "add"     // 新报告
+	opAttempt = "attempt" // 已发送过但未确认送达
+	opAck     = "ack"     // 已送达或被服务器拒绝，不再需要
+	opSeq     = "seq"     // 压缩时保存的序号，保证重写后序号不回退
+)
+
+// journalRecord 日志中的一行
+type journalRecord struct {
+	Op     string       `json:"op"`
+	Report *StatsReport `json:"report,omitempty"`
+	ID     string       `json:"id,omitempty"`
+	Seq    uint64       `json:"seq,omitempty"`
+}
+
+// pendingReport 待送达的报告
+type pendingReport struct {
+	report StatsReport
+	// 已发出过：服务器可能已经记账只是响应丢失，只能以同一 report_id 原样重发，不能再合并
+	attempted bool
+}
+
+// Journal 待上报统计的追加写日志（JSON Lines）
+// 每次变更追加一行并 fsync；超过大小上限时压缩重写，仍然放不下时按策略丢弃
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	opts    JournalOptions
+	pending []*pendingReport // 按时间排序
+	seq     uint64
+	size    int64 // 当前文件大小
+	dropped int64 // 因日志写满丢弃的报告数
+}
+
+// OpenJournal 打开 dir 下的统计日志，并迁移旧版 stats_*.json 缓存文件
+func OpenJournal(dir string, opts JournalOptions) (*Journal, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultJournalMaxSize
+	}
+	if opts.Bucket <= 0 {
+		opts.Bucket = DefaultJournalBucket
+	}
+	if opts.Policy == "" {
+		opts.Policy = PolicyCoalesce
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create stats dir: %w", err)
+	}
+
+	j := &Journal{
+		path: filepath.Join(dir, journalFile),
+		opts: opts,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	legacy := j.loadLegacy(dir)
+
+	// 启动时总是重写：去掉已确认的记录和断电时写了一半的最后一行
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.compactLocked(); err != nil {
+		return nil, err
+	}
+	for _, path := range legacy {
+		os.Remove(path)
+	}
+	return j, nil
+}
+
+// load 重放日志
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open stats journal: %w", err)
+	}
+	defer f.Close()
+
+	byID := make(map[string]*pendingReport)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(j.opts.MaxSize)+1)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // 写了一半的行
+		}
+		switch rec.Op {
+		case opAdd:
+			if rec.Report == nil || rec.Report.ReportID == "" {
+				continue
+			}
+			p := &pendingReport{report: *rec.Report}
+			byID[p.report.ReportID] = p
+			j.pending = append(j.pending, p)
+			j.seq = max(j.seq, p.report.Seq)
+		case opAttempt:
+			if p, ok := byID[rec.ID]; ok {
+				p.attempted = true
+			}
+		case opAck:
+			delete(byID, rec.ID)
+		case opSeq:
+			j.seq = max(j.seq, rec.Seq)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stats journal: %w", err)
+	}
+
+	// 去掉已确认的
+	kept := j.pending[:0]
+	for _, p := range j.pending {
+		if byID[p.report.ReportID] == p {
+			kept = append(kept, p)
+		}
+	}
+	j.pending = kept
+	return nil
+}
+
+// loadLegacy 读取旧版每次失败一个文件的缓存，返回需要在重写后删除的文件
+func (j *Journal) loadLegacy(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "stats_*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var report StatsReport
+		if err := json.Unmarshal(data, &report); err != nil || len(report.Stats) == 0 {
+			continue
+		}
+		// 旧版报告没有 ID，服务器不可能已经按 ID 记账，视为未发送
+		j.seq++
+		report.ReportID = newReportID()
+		report.Seq = j.seq
+		j.pending = append(j.pending, &pendingReport{report: report})
+	}
+	if len(files) > 0 {
+		log.Printf("Migrated %d cached stats reports into journal", len(files))
+	}
+	return files
+}
+
+// Add 记录一份新报告（分配 report_id 和序号），返回记录的报告
+func (j *Journal) Add(entries []StatsEntry, timestamp time.Time) (*StatsReport, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	report := StatsReport{
+		ReportID:  newReportID(),
+		Seq:       j.seq + 1,
+		Timestamp: timestamp,
+		Stats:     entries,
+	}
+	line, err := marshalRecord(journalRecord{Op: opAdd, Report: &report})
+	if err != nil {
+		return nil, err
+	}
+
+	if j.size+int64(len(line)) > j.opts.MaxSize {
+		if err := j.makeRoomLocked(int64(len(line))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := j.appendLocked(line); err != nil {
+		return nil, err
+	}
+	j.seq = report.Seq
+	j.pending = append(j.pending, &pendingReport{report: report})
+	return &report, nil
+}
+
+// Pending 待送达的报告（复制，按时间排序）
+func (j *Journal) Pending() []StatsReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	reports := make([]StatsReport, len(j.pending))
+	for i, p := range j.pending {
+		reports[i] = p.report
+	}
+	return reports
+}
+
+// PendingTraffic 待送达报告中每个用户的流量合计（上传 + 下载）
+// 管理端同步的已用流量还不包含这部分，限额检查需要加上
+func (j *Journal) PendingTraffic() map[string]int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	traffic := make(map[string]int64)
+	for _, p := range j.pending {
+		for _, e := range p.report.Stats {
+			traffic[e.UUID] += e.Upload + e.Download
+		}
+	}
+	return traffic
+}
+
+// MarkAttempted 记录报告已发出但未确认，之后只能原样重发
+func (j *Journal) MarkAttempted(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	p := j.find(id)
+	if p == nil || p.attempted {
+		return nil
+	}
+	line, err := marshalRecord(journalRecord{Op: opAttempt, ID: id})
+	if err != nil {
+		return err
+	}
+	if err := j.appendLocked(line); err != nil {
+		return err
+	}
+	p.attempted = true
+	return nil
+}
+
+// Ack 移除已送达（或被服务器永久拒绝）的报告
+func (j *Journal) Ack(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.find(id) == nil {
+		return nil
+	}
+	line, err := marshalRecord(journalRecord{Op: opAck, ID: id})
+	if err != nil {
+		return err
+	}
+	if err := j.appendLocked(line); err != nil {
+		return err
+	}
+	j.remove(id)
+
+	// 全部送达后清空文件，避免只追加不回收
+	if len(j.pending) == 0 {
+		return j.compactLocked()
+	}
+	return nil
+}
+
+// Len 待送达的报告数
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// Size 日志文件当前大小
+func (j *Journal) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.size
+}
+
+// Dropped 因日志写满丢弃的报告数（进程启动以来）
+func (j *Journal) Dropped() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.dropped
+}
+
+// makeRoomLocked 为 need 字节的新记录腾出空间
+func (j *Journal) makeRoomLocked(need int64) error {
+	if err := j.compactLocked(); err != nil {
+		return err
+	}
+	if j.size+need <= j.opts.MaxSize {
+		return nil
+	}
+
+	switch j.opts.Policy {
+	case PolicyDropNewest:
+		j.dropped++
+		log.Printf("WARNING: stats journal full (%d bytes), dropping new report", j.size)
+		return ErrJournalFull
+	case PolicyCoalesce:
+		j.mergeLocked(func(time.Time) int64 { return 0 })
+		if err := j.rewriteLocked(); err != nil {
+			return err
+		}
+		if j.size+need <= j.opts.MaxSize {
+			log.Printf("WARNING: stats journal full, coalesced unsent reports into one")
+			return nil
+		}
+	}
+
+	// 丢弃最旧的，直到放得下
+	var lost int64
+	for len(j.pending) > 0 && j.size+need > j.opts.MaxSize {
+		lost += j.pending[0].report.totalBytes()
+		j.pending = j.pending[1:]
+		j.dropped++
+		if err := j.rewriteLocked(); err != nil {
+			return err
+		}
+	}
+	log.Printf("WARNING: stats journal full, dropped oldest reports (%d bytes of traffic lost)", lost)
+	if j.size+need > j.opts.MaxSize {
+		return ErrJournalFull
+	}
+	return nil
+}
+
+// compactLocked 合并同一时间粒度内未发送过的报告，并重写文件
+func (j *Journal) compactLocked() error {
+	bucket := j.opts.Bucket
+	j.mergeLocked(func(t time.Time) int64 { return t.Truncate(bucket).UnixNano() })
+	return j.rewriteLocked()
+}
+
+// mergeLocked 将 key 相同的未发送报告按用户合并为一条新报告
+// 已发送过的报告保持原样，服务器可能已按其 report_id 记账
+func (j *Journal) mergeLocked(key func(time.Time) int64) {
+	groups := make(map[int64][]*pendingReport)
+	var order []int64
+	var kept []*pendingReport
+	for _, p := range j.pending {
+		if p.attempted {
+			kept = append(kept, p)
+			continue
+		}
+		k := key(p.report.Timestamp)
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], p)
+	}
+
+	for _, k := range order {
+		group := groups[k]
+		if len(group) == 1 {
+			kept = append(kept, group[0])
+			continue
+		}
+		j.seq++
+		kept = append(kept, &pendingReport{report: mergeReports(group, newReportID(), j.seq)})
+	}
+
+	sort.SliceStable(kept, func(a, b int) bool {
+		return kept[a].report.Timestamp.Before(kept[b].report.Timestamp)
+	})
+	j.pending = kept
+}
+
+// rewriteLocked 用当前待送达的报告原子重写文件
+func (j *Journal) rewriteLocked() error {
+	var buf bytes.Buffer
+	line, err := marshalRecord(journalRecord{Op: opSeq, Seq: j.seq})
+	if err != nil {
+		return err
+	}
+	buf.Write(line)
+	for _, p := range j.pending {
+		if line, err = marshalRecord(journalRecord{Op: opAdd, Report: &p.report}); err != nil {
+			return err
+		}
+		buf.Write(line)
+		if p.attempted {
+			if line, err = marshalRecord(journalRecord{Op: opAttempt, ID: p.report.ReportID}); err != nil {
+				return err
+			}
+			buf.Write(line)
+		}
+	}
+
+	if err := persist.WriteFile(j.path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("rewrite stats journal: %w", err)
+	}
+	j.size = int64(buf.Len())
+	return nil
+}
+
+// appendLocked 追加一行并 fsync
+func (j *Journal) appendLocked(line []byte) error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open stats journal: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("write stats journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync stats journal: %w", err)
+	}
+	j.size += int64(len(line))
+	return nil
+}
+
+func (j *Journal) find(id string) *pendingReport {
+	for _, p := range j.pending {
+		if p.report.ReportID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (j *Journal) remove(id string) {
+	for i, p := range j.pending {
+		if p.report.ReportID == id {
+			j.pending = append(j.pending[:i], j.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// mergeReports 按用户累加流量，时间取最晚的一份
+func mergeReports(group []*pendingReport, id string, seq uint64) StatsReport {
+	merged := StatsReport{ReportID: id, Seq: seq}
+	index := make(map[string]int)
+	for _, p := range group {
+		if p.report.Timestamp.After(merged.Timestamp) {
+			merged.Timestamp = p.report.Timestamp
+		}
+		for _, e := range p.report.Stats {
+			if i, ok := index[e.UUID]; ok {
+				m := &merged.Stats[i]
+				m.Upload += e.Upload
+				m.Download += e.Download
+				for proto, t := range e.Protocols {
+					if m.Protocols == nil {
+						m.Protocols = make(map[string]Traffic)
+					}
+					sum := m.Protocols[proto]
+					sum.Upload += t.Upload
+					sum.Download += t.Download
+					m.Protocols[proto] = sum
+				}
+				continue
+			}
+			// 复制 Protocols，合并时不能修改原报告
+			e.Protocols = maps.Clone(e.Protocols)
+			index[e.UUID] = len(merged.Stats)
+			merged.Stats = append(merged.Stats, e)
+		}
+	}
+	return merged
+}
+
+// totalBytes 报告中的流量总和
+func (r *StatsReport) totalBytes() int64 {
+	var total int64
+	for _, e := range r.Stats {
+		total += e.Upload + e.Download
+	}
+	return total
+}
+
+func marshalRecord(rec journalRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("marshal journal record: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// newReportID 随机报告 ID，管理端据此对重发去重
+func newReportID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,203 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func totalOf(reports []StatsReport, uuid string) int64 {
+	var total int64
+	for _, r := range reports {
+		for _, e := range r.Stats {
+			if e.UUID == uuid {
+				total += e.Upload + e.Download
+			}
+		}
+	}
+	return total
+}
+
+func TestJournalPersistsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	j, err := OpenJournal(dir, JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := j.Add([]StatsEntry{{UUID: "a", Upload: 1}}, base)
+	second, _ := j.Add([]StatsEntry{{UUID: "a", Upload: 2}}, base.Add(2*time.Hour))
+	third, _ := j.Add([]StatsEntry{{UUID: "b", Download: 5}}, base.Add(4*time.Hour))
+	if first.ReportID == second.ReportID || second.Seq != first.Seq+1 {
+		t.Fatalf("reports must have unique ids and increasing seq: %+v %+v", first, second)
+	}
+	if err := j.MarkAttempted(second.ReportID); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Ack(first.ReportID); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟断电时写了一半的行
+	f, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"op":"add","report":{"report_id":"x`)
+	f.Close()
+
+	j, err = OpenJournal(dir, JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := j.Pending()
+	if len(pending) != 2 || pending[0].ReportID != second.ReportID || pending[1].ReportID != third.ReportID {
+		t.Fatalf("pending after restart = %+v", pending)
+	}
+	if p := j.find(second.ReportID); p == nil || !p.attempted {
+		t.Fatal("attempted flag lost across restart")
+	}
+
+	next, _ := j.Add([]StatsEntry{{UUID: "a", Upload: 1}}, base.Add(6*time.Hour))
+	if next.Seq <= third.Seq {
+		t.Fatalf("seq went backwards after restart: %d <= %d", next.Seq, third.Seq)
+	}
+
+	for _, r := range j.Pending() {
+		j.Ack(r.ReportID)
+	}
+	if j.Len() != 0 {
+		t.Fatal("journal should be empty after acking everything")
+	}
+	j, _ = OpenJournal(dir, JournalOptions{})
+	if j.Len() != 0 {
+		t.Fatal("acked reports came back after restart")
+	}
+}
+
+func TestJournalCompactsByBucket(t *testing.T) {
+	j, err := OpenJournal(t.TempDir(), JournalOptions{Bucket: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	attempted, _ := j.Add([]StatsEntry{{UUID: "a", Upload: 100}}, base)
+	j.MarkAttempted(attempted.ReportID)
+	j.Add([]StatsEntry{{UUID: "a", Upload: 10}}, base.Add(10*time.Minute))
+	j.Add([]StatsEntry{{UUID: "a", Upload: 20}, {UUID: "b", Download: 3}}, base.Add(20*time.Minute))
+	j.Add([]StatsEntry{{UUID: "a", Upload: 40}}, base.Add(90*time.Minute))
+
+	j.mu.Lock()
+	if err := j.compactLocked(); err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Unlock()
+
+	pending := j.Pending()
+	if len(pending) != 3 {
+		t.Fatalf("got %d reports after compaction, want 3 (attempted + two buckets)", len(pending))
+	}
+	if pending[0].ReportID != attempted.ReportID {
+		t.Fatal("attempted report must be kept as is")
+	}
+	if totalOf(pending, "a") != 170 || totalOf(pending, "b") != 3 {
+		t.Fatalf("traffic changed by compaction: a=%d b=%d", totalOf(pending, "a"), totalOf(pending, "b"))
+	}
+	if totalOf(pending[1:2], "a") != 30 {
+		t.Fatalf("first bucket a=%d, want 30", totalOf(pending[1:2], "a"))
+	}
+}
+
+func TestJournalFullPolicies(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fill := func(t *testing.T, policy FullPolicy) (*Journal, error) {
+		t.Helper()
+		j, err := OpenJournal(t.TempDir(), JournalOptions{MaxSize: 2048, Policy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lastErr error
+		for i := range 40 {
+			// 每份报告在不同的时间粒度内，压缩无法合并
+			if _, err := j.Add([]StatsEntry{{UUID: "a", Upload: 1}}, base.Add(time.Duration(i)*2*time.Hour)); err != nil {
+				lastErr = err
+			}
+		}
+		if j.Size() > 2048 {
+			t.Fatalf("journal size %d exceeds limit", j.Size())
+		}
+		return j, lastErr
+	}
+
+	t.Run("drop_newest", func(t *testing.T) {
+		j, err := fill(t, PolicyDropNewest)
+		if !errors.Is(err, ErrJournalFull) || j.Dropped() == 0 {
+			t.Fatalf("err = %v, dropped = %d; want ErrJournalFull", err, j.Dropped())
+		}
+		if pending := j.Pending(); !pending[0].Timestamp.Equal(base) {
+			t.Fatal("oldest report should be kept")
+		}
+	})
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		j, err := fill(t, PolicyDropOldest)
+		if err != nil || j.Dropped() == 0 {
+			t.Fatalf("err = %v, dropped = %d", err, j.Dropped())
+		}
+		pending := j.Pending()
+		if last := pending[len(pending)-1]; !last.Timestamp.Equal(base.Add(39 * 2 * time.Hour)) {
+			t.Fatal("newest report should be kept")
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		j, err := fill(t, PolicyCoalesce)
+		if err != nil || j.Dropped() != 0 {
+			t.Fatalf("err = %v, dropped = %d", err, j.Dropped())
+		}
+		if total := totalOf(j.Pending(), "a"); total != 40 {
+			t.Fatalf("coalesced total = %d, want 40", total)
+		}
+	})
+}
+
+func TestJournalMigratesLegacyCache(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := json.Marshal(StatsReport{Timestamp: time.Now(), Stats: []StatsEntry{{UUID: "a", Upload: 7}}})
+	legacy := filepath.Join(dir, "stats_123.json")
+	os.WriteFile(legacy, data, 0644)
+
+	j, err := OpenJournal(dir, JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].ReportID == "" || totalOf(pending, "a") != 7 {
+		t.Fatalf("legacy report not migrated: %+v", pending)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("legacy file should be removed after migration")
+	}
+}
+
+func TestJournalPendingTraffic(t *testing.T) {
+	j, err := OpenJournal(t.TempDir(), JournalOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	first, _ := j.Add([]StatsEntry{{UUID: "a", Upload: 1, Download: 2}}, base)
+	j.Add([]StatsEntry{{UUID: "a", Upload: 10}, {UUID: "b", Download: 5}}, base.Add(2*time.Hour))
+
+	if got := j.PendingTraffic(); got["a"] != 13 || got["b"] != 5 {
+		t.Fatalf("pending traffic = %v", got)
+	}
+
+	// 已确认的报告不再计入
+	j.Ack(first.ReportID)
+	if got := j.PendingTraffic(); got["a"] != 10 || got["b"] != 5 {
+		t.Fatalf("pending traffic after ack = %v", got)
+	}
+}
@@ -1,15 +1,15 @@
 package stats
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"path/filepath"
+	"log"
+	"maps"
 	"sync"
 	"time"
+
+	"otun-node-agent/internal/controlplane"
 )
 
 // StatsEntry 单个用户统计
@@ -17,151 +17,112 @@ type StatsEntry struct {
 	UUID     string `json:"uuid"`
 	Upload   int64  `json:"upload"`
 	Download int64  `json:"download"`
+	// Protocols 按协议拆分（开启按协议统计时才有），各协议之和等于 Upload / Download
+	Protocols map[string]Traffic `json:"protocols,omitempty"`
 }
 
 // StatsReport 统计上报数据
+// ReportID 在重发时保持不变，管理端据此去重；Seq 在节点内单调递增
 type StatsReport struct {
+	ReportID  string       `json:"report_id"`
+	Seq       uint64       `json:"seq"`
 	Timestamp time.Time    `json:"timestamp"`
 	Stats     []StatsEntry `json:"stats"`
 }
 
-// Reporter 负责上报流量统计
+// Reporter 负责上报流量统计：先写入日志，再按顺序送达
 type Reporter struct {
-	apiURL     string
-	apiKey     string
-	cacheDir   string
-	httpClient *http.Client
-	mu         sync.Mutex
+	client  *controlplane.Client
+	journal *Journal
+	mu      sync.Mutex // 串行化发送，避免同一报告被并发重发
 }
 
 // NewReporter 创建统计上报器
-func NewReporter(apiURL, apiKey, cacheDir string) *Reporter {
-	os.MkdirAll(cacheDir, 0755)
+func NewReporter(client *controlplane.Client, journal *Journal) *Reporter {
 	return &Reporter{
-		apiURL:   apiURL,
-		apiKey:   apiKey,
-		cacheDir: cacheDir,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		client:  client,
+		journal: journal,
 	}
 }
 
-// Report 上报统计数据
-func (r *Reporter) Report(stats map[string]*UserStats) error {
-	if len(stats) == 0 {
-		return nil
+// Report 记录统计数据并尝试上报
+// 只有写入日志失败时返回错误（流量会丢失）；上报失败的报告留在日志中，之后由 FlushCache 重发
+func (r *Reporter) Report(ctx context.Context, stats map[string]*UserStats) error {
+	if err := r.Record(stats); err != nil {
+		return err
 	}
 
-	report := StatsReport{
-		Timestamp: time.Now().UTC(),
-		Stats:     make([]StatsEntry, 0, len(stats)),
+	if err := r.FlushCache(ctx); err != nil {
+		log.Printf("Stats delivery deferred (%d reports pending): %v", r.journal.Len(), err)
 	}
+	return nil
+}
 
+// Record 只把统计数据写入日志，不发送（用于停止/重载 sing-box 前的快速落盘）
+func (r *Reporter) Record(stats map[string]*UserStats) error {
+	entries := make([]StatsEntry, 0, len(stats))
 	for uuid, s := range stats {
 		if s.Upload > 0 || s.Download > 0 {
-			report.Stats = append(report.Stats, StatsEntry{
-				UUID:     uuid,
-				Upload:   s.Upload,
-				Download: s.Download,
+			entries = append(entries, StatsEntry{
+				UUID:      uuid,
+				Upload:    s.Upload,
+				Download:  s.Download,
+				Protocols: maps.Clone(s.Protocols),
 			})
 		}
 	}
 
-	if len(report.Stats) == 0 {
+	if len(entries) == 0 {
 		return nil
 	}
 
-	// 尝试上报
-	if err := r.send(&report); err != nil {
-		// 上报失败，保存到本地缓存
-		return r.saveToCache(&report)
+	if _, err := r.journal.Add(entries, time.Now().UTC()); err != nil {
+		return fmt.Errorf("journal stats: %w", err)
 	}
-
 	return nil
 }
 
-// send 发送统计到服务器
-func (r *Reporter) send(report *StatsReport) error {
-	url := fmt.Sprintf("%s/api/node/stats", r.apiURL)
-
-	data, err := json.Marshal(report)
-	if err != nil {
-		return fmt.Errorf("marshal report: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+r.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := r.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
-	}
-
-	return nil
+// send 发送统计到服务器（带 report_id，可以安全重试）
+func (r *Reporter) send(ctx context.Context, report *StatsReport) error {
+	return r.client.PostJSON(ctx, "/api/node/stats", report, nil, true)
 }
 
-// saveToCache 保存统计到本地缓存
-func (r *Reporter) saveToCache(report *StatsReport) error {
+// FlushCache 按时间顺序上报日志中的报告
+// 服务器永久拒绝的报告丢弃后继续；临时错误时停止，剩余的留到下次
+func (r *Reporter) FlushCache(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	filename := fmt.Sprintf("stats_%d.json", time.Now().UnixNano())
-	path := filepath.Join(r.cacheDir, filename)
-
-	data, err := json.Marshal(report)
-	if err != nil {
-		return fmt.Errorf("marshal report: %w", err)
-	}
-
-	return os.WriteFile(path, data, 0644)
-}
-
-// FlushCache 上报缓存的统计数据
-func (r *Reporter) FlushCache() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	files, err := filepath.Glob(filepath.Join(r.cacheDir, "stats_*.json"))
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		data, err := os.ReadFile(file)
-		if err != nil {
-			continue
-		}
-
-		var report StatsReport
-		if err := json.Unmarshal(data, &report); err != nil {
-			os.Remove(file) // 删除损坏的文件
-			continue
+	for _, report := range r.journal.Pending() {
+		err := r.send(ctx, &report)
+		switch {
+		case err == nil:
+		case controlplane.IsBadRequest(err):
+			log.Printf("Dropping stats report %s rejected by server: %v", report.ReportID, err)
+		default:
+			// 熔断时请求没有发出，报告仍可与之后的报告合并
+			if !errors.Is(err, controlplane.ErrCircuitOpen) {
+				if markErr := r.journal.MarkAttempted(report.ReportID); markErr != nil {
+					log.Printf("Failed to update stats journal: %v", markErr)
+				}
+			}
+			return err
 		}
 
-		if err := r.send(&report); err != nil {
-			return err // 上报失败，停止继续
+		if err := r.journal.Ack(report.ReportID); err != nil {
+			return fmt.Errorf("update stats journal: %w", err)
 		}
-
-		os.Remove(file) // 上报成功，删除缓存
 	}
 
 	return nil
 }
 
-// GetCacheCount 获取缓存文件数量
+// GetCacheCount 获取待上报的报告数量
 func (r *Reporter) GetCacheCount() int {
-	files, _ := filepath.Glob(filepath.Join(r.cacheDir, "stats_*.json"))
-	return len(files)
+	return r.journal.Len()
+}
+
+// Journal 统计日志（用于指标）
+func (r *Reporter) Journal() *Journal {
+	return r.journal
 }